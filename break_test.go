@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 const tmpdirName = "break-tmp"
@@ -267,3 +274,329 @@ func TestAllTheThings(t *testing.T) {
 
 	t.Logf("Ran %v tests", ran)
 }
+
+var faultyWriteErr = errors.New("faulty write")
+
+// A FileLike that "crashes" once a budget of written bytes is used
+// up, partially writing whatever straddles the limit.
+type faultyFileLike struct {
+	file   FileLike
+	budget int64
+}
+
+func (f *faultyFileLike) Close() error {
+	return f.file.Close()
+}
+
+func (f *faultyFileLike) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultyFileLike) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
+
+func (f *faultyFileLike) Sync() error {
+	if f.budget <= 0 {
+		return faultyWriteErr
+	}
+	return f.file.Sync()
+}
+
+func (f *faultyFileLike) WriteAt(p []byte, off int64) (int, error) {
+	if f.budget <= 0 {
+		return 0, faultyWriteErr
+	}
+	if int64(len(p)) > f.budget {
+		n, _ := f.file.WriteAt(p[:f.budget], off)
+		f.budget = 0
+		return n, faultyWriteErr
+	}
+	f.budget -= int64(len(p))
+	return f.file.WriteAt(p, off)
+}
+
+func testDispatchKey(t *testing.T, vb *VBucket, cmd gomemcached.CommandCode,
+	key int) {
+	req := &gomemcached.MCRequest{
+		Opcode: cmd,
+		Key:    []byte(strconv.Itoa(key)),
+		Body:   []byte(strconv.Itoa(key)),
+	}
+	if cmd == gomemcached.SET {
+		req.Extras = make([]byte, 8)
+	}
+	if res := vb.Dispatch(ioutil.Discard, req); res.Status != 0 {
+		t.Fatalf("Unexpected dispatch failure: %v, key: %v, res: %v",
+			cmd, key, res)
+	}
+}
+
+// Checks that a store file's key-indexes and changes-streams agree,
+// without the help of any load-time fixup.
+func testCheckStoreConsistent(t *testing.T, fname string) {
+	f, err := os.OpenFile(fname, os.O_RDONLY, 0666)
+	if err != nil {
+		t.Fatalf("Error opening store file: %v", err)
+	}
+	defer f.Close()
+	store, err := gkvlite.NewStore(f)
+	if err != nil {
+		t.Fatalf("Error reading store file: %v", err)
+	}
+	for _, kName := range store.GetCollectionNames() {
+		if !strings.HasSuffix(kName, COLL_SUFFIX_KEYS) {
+			continue
+		}
+		keys := store.GetCollection(kName)
+		changes := store.GetCollection(
+			strings.TrimSuffix(kName, COLL_SUFFIX_KEYS) + COLL_SUFFIX_CHANGES)
+		if changes == nil {
+			t.Errorf("Missing changes for %v", kName)
+			continue
+		}
+		keys.VisitItemsAscend(nil, false, func(kItem *gkvlite.Item) bool {
+			cItem, err := changes.GetItem(kItem.Val, true)
+			if err != nil || cItem == nil {
+				t.Errorf("Key %s references missing change, err: %v",
+					kItem.Key, err)
+				return true
+			}
+			i := &item{}
+			if err = i.fromValueBytes(cItem.Val); err != nil ||
+				!bytes.Equal(i.key, kItem.Key) || i.isDeletion() {
+				t.Errorf("Key %s references bad change: %v, err: %v",
+					kItem.Key, i, err)
+			}
+			return true
+		})
+		changes.VisitItemsAscend(nil, true, func(cItem *gkvlite.Item) bool {
+			i := &item{}
+			if err := i.fromValueBytes(cItem.Val); err != nil {
+				t.Errorf("Undecodable change, err: %v", err)
+				return true
+			}
+			if len(i.key) == 0 {
+				return true
+			}
+			kItem, err := keys.GetItem(i.key, false)
+			if err != nil {
+				t.Errorf("Error reading key %s, err: %v", i.key, err)
+				return true
+			}
+			if kItem == nil {
+				if !i.isDeletion() {
+					t.Errorf("Change for key %s not in key-index", i.key)
+				}
+				return true
+			}
+			if cas, _ := casBytesParse(kItem.Val); cas < i.cas {
+				t.Errorf("Key %s is behind its change, %v < %v",
+					i.key, cas, i.cas)
+			}
+			return true
+		})
+	}
+}
+
+func testVisitIntKeys(t *testing.T, vb *VBucket) []int {
+	rv := []int{}
+	err := vb.ps.visitItems(nil, false, func(i *item) bool {
+		n, err := strconv.Atoi(string(i.key))
+		if err != nil {
+			t.Errorf("Unexpected key: %s", i.key)
+		}
+		rv = append(rv, n)
+		return true
+	})
+	if err != nil {
+		t.Errorf("Error visiting items: %v", err)
+	}
+	return rv
+}
+
+// Kills a flush at every so many bytes into its writes, and checks
+// that the store file always reopens consistent, with either all or
+// none of the flushed mutations.
+func TestFlushCrashConsistency(t *testing.T) {
+	before := []int{0, 1, 2, 3, 4}
+	after := []int{2, 3, 4, 5, 6}
+
+	prevFlushRetryDelay := flushRetryDelay
+	flushRetryDelay = 0
+	defer func() { flushRetryDelay = prevFlushRetryDelay }()
+
+	for budget := int64(0); ; budget += 97 {
+		testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+
+		b0, err := NewBucket(testBucketDir,
+			&BucketSettings{
+				NumPartitions: MAX_VBUCKETS,
+			})
+		if err != nil {
+			t.Fatalf("Expected NewBucket to work, got: %v", err)
+		}
+		vb0, _ := b0.CreateVBucket(0)
+		b0.SetVBState(0, VBActive)
+		for _, k := range before {
+			testDispatchKey(t, vb0, gomemcached.SET, k)
+		}
+		if err = b0.Flush(); err != nil {
+			t.Fatalf("Expected initial Flush to work, got: %v", err)
+		}
+
+		testDispatchKey(t, vb0, gomemcached.DELETE, 0)
+		testDispatchKey(t, vb0, gomemcached.DELETE, 1)
+		testDispatchKey(t, vb0, gomemcached.SET, 5)
+		testDispatchKey(t, vb0, gomemcached.SET, 6)
+
+		bsf := b0.GetBucketStore(0).BSF()
+		bsf.apply(func() {
+			bsf.file = &faultyFileLike{file: bsf.file, budget: budget}
+		})
+		flushErr := b0.Flush()
+		b0.Close()
+
+		names, err := latestStoreFileNames(testBucketDir, STORES_PER_BUCKET,
+			STORE_FILE_SUFFIX)
+		if err != nil {
+			t.Fatalf("Expected latestStoreFileNames to work, got: %v", err)
+		}
+		testCheckStoreConsistent(t, path.Join(testBucketDir, names[0]))
+
+		b1, err := NewBucket(testBucketDir,
+			&BucketSettings{
+				NumPartitions: MAX_VBUCKETS,
+			})
+		if err != nil {
+			t.Fatalf("Expected NewBucket to work, got: %v", err)
+		}
+		if err = b1.Load(); err != nil {
+			t.Errorf("Expected Load to work, budget: %v, got: %v", budget, err)
+		}
+		vb1, _ := b1.GetVBucket(0)
+		if vb1 == nil {
+			t.Fatalf("Expected vbucket after reload, budget: %v", budget)
+		}
+		got := testVisitIntKeys(t, vb1)
+		if !reflect.DeepEqual(got, before) && !reflect.DeepEqual(got, after) {
+			t.Errorf("Expected all or none of the flush, budget: %v, got: %v",
+				budget, got)
+		}
+		if flushErr == nil && !reflect.DeepEqual(got, after) {
+			t.Errorf("Expected a successful flush to persist, got: %v", got)
+		}
+		b1.Close()
+		os.RemoveAll(testBucketDir)
+
+		if flushErr == nil {
+			break // The budget was big enough for the whole flush.
+		}
+	}
+}
+
+// Flushes while mutations, which each touch both a key-index and a
+// changes-stream, keep running on a few vbuckets, and checks that the
+// store file as of every flush reopens consistent.
+func TestFlushConcurrentMutationConsistency(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	settings := &BucketSettings{
+		NumPartitions: MAX_VBUCKETS,
+	}
+	b0, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("Expected NewBucket to work, got: %v", err)
+	}
+	vbs := []*VBucket{}
+	for vbid := uint16(0); vbid < 4; vbid++ {
+		vb, _ := b0.CreateVBucket(vbid)
+		b0.SetVBState(vbid, VBActive)
+		vbs = append(vbs, vb)
+	}
+
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	for _, vb := range vbs {
+		wg.Add(1)
+		go func(vb *VBucket) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				req := &gomemcached.MCRequest{
+					Opcode: gomemcached.SET,
+					Key:    []byte(strconv.Itoa(n % 50)),
+					Body:   []byte(strconv.Itoa(n)),
+					Extras: make([]byte, 8),
+				}
+				if n%3 == 2 {
+					req.Opcode = gomemcached.DELETE
+					req.Extras = nil
+				}
+				// A DELETE of a missing key fails, which is fine.
+				vb.Dispatch(ioutil.Discard, req)
+			}
+		}(vb)
+	}
+
+	snapshots := []string{}
+	for i := 0; i < 100; i++ {
+		if err = b0.Flush(); err != nil {
+			t.Errorf("Expected Flush to work, got: %v", err)
+			break
+		}
+		// Copy the file as of the flush, where the copy holds off
+		// any other writes to the file.
+		fname := path.Join(testBucketDir, fmt.Sprintf("snapshot-%v", i))
+		bsf := b0.GetBucketStore(0).BSF()
+		bsf.apply(func() {
+			var b []byte
+			if b, err = ioutil.ReadFile(bsf.path); err == nil {
+				err = ioutil.WriteFile(fname, b, 0666)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Expected store file copy to work, got: %v", err)
+		}
+		snapshots = append(snapshots, fname)
+	}
+	close(done)
+	wg.Wait()
+
+	for _, fname := range snapshots {
+		testCheckStoreConsistent(t, fname)
+	}
+
+	expected := [][]int{}
+	for _, vb := range vbs {
+		expected = append(expected, testVisitIntKeys(t, vb))
+	}
+	if err = b0.Flush(); err != nil {
+		t.Errorf("Expected final Flush to work, got: %v", err)
+	}
+	b0.Close()
+
+	b1, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("Expected NewBucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Errorf("Expected Load to work, got: %v", err)
+	}
+	for vbid := range vbs {
+		vb1, _ := b1.GetVBucket(uint16(vbid))
+		if vb1 == nil {
+			t.Fatalf("Expected vbucket %v after reload", vbid)
+		}
+		if got := testVisitIntKeys(t, vb1); !reflect.DeepEqual(got, expected[vbid]) {
+			t.Errorf("Expected vbucket %v keys %v after reload, got: %v",
+				vbid, expected[vbid], got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log"
 	"path"
 	"strconv"
 	"sync"
@@ -10,6 +11,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/couchbaselabs/cbgb/storefile"
 	"github.com/dustin/go-broadcast"
 	"github.com/steveyen/gkvlite"
 )
@@ -18,9 +20,12 @@ const (
 	MAX_VBUCKETS        = 1024
 	BUCKET_DIR_SUFFIX   = "-bucket" // Suffix allows non-buckets to be ignored.
 	DEFAULT_BUCKET_NAME = "default"
-	STORE_FILE_SUFFIX   = "store"
-	STORES_PER_BUCKET   = 1 // The # of *.store files per bucket (ignoring compaction).
+	STORE_FILE_SUFFIX   = storefile.Suffix
+	STORES_PER_BUCKET   = 1 // The default # of *.store files per bucket (ignoring compaction).
 	VBID_DDOC           = uint16(0xffff)
+
+	// The default # of vbuckets that dev design docs index.
+	DEV_SUBSET_PARTITIONS = 64
 )
 
 var broadcastMux = broadcast.NewMuxObserver(0, 0)
@@ -57,10 +62,14 @@ type Bucket interface {
 	GetDDocVBucket() *VBucket
 	GetDDoc(ddocId string) ([]byte, error)
 	SetDDoc(ddocId string, body []byte) error
+	DelDDoc(ddocId string) error
 	VisitDDocs(start []byte, visitor func(key []byte, data []byte) bool) error
 	GetDDocs() *DDocs
 	SetDDocs(old, val *DDocs) bool
 
+	AddViewError(viewName string, e *ViewError)
+	GetViewErrors(viewName string) []*ViewError
+
 	GetItemBytes() int64
 }
 
@@ -81,20 +90,50 @@ type livebucket struct {
 
 	ddocs unsafe.Pointer // *DDocs, holding the json.Unmarshal'ed design docs.
 
+	viewErrors     map[string][]*ViewError // Keyed by view hash.
+	viewErrorsLock sync.Mutex
+
+	viewFunctionPools map[string]*viewFunctions // Keyed by view hash.
+	viewFunctionsLock sync.Mutex
 }
 
 func NewBucket(dirForBucket string, settings *BucketSettings) (b Bucket, err error) {
 	var fileNames []string
 
+	if err = checkNumStores(settings.NumStores); err != nil {
+		return nil, err
+	}
+	numStores := settings.numStores()
+
 	if settings.MemoryOnly < MemoryOnly_LEVEL_PERSIST_NOTHING {
+		var maxIdx int
+		maxIdx, err = maxStoreFileIdx(dirForBucket, STORE_FILE_SUFFIX)
+		if err != nil {
+			return nil, err
+		}
+		if maxIdx >= numStores {
+			return nil, fmt.Errorf("bucket dir: %v has store files up to index: %v,"+
+				" but numStores is: %v; use -migrate-bucket to change numStores",
+				dirForBucket, maxIdx, numStores)
+		}
 		fileNames, err = latestStoreFileNames(dirForBucket,
-			STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+			numStores, STORE_FILE_SUFFIX)
 		if err != nil {
 			return nil, err
 		}
+		var removed []string
+		removed, err = sweepStoreFiles(dirForBucket,
+			numStores, STORE_FILE_SUFFIX)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) > 0 {
+			log.Printf("removed stale store files in: %v, files: %v",
+				dirForBucket, removed)
+		}
 	} else {
-		fileNames = make([]string, STORES_PER_BUCKET)
-		for i := 0; i < STORES_PER_BUCKET; i++ {
+		fileNames = make([]string, numStores)
+		for i := 0; i < numStores; i++ {
 			fileNames[i] = makeStoreFileName(i, 0, STORE_FILE_SUFFIX)
 		}
 	}
@@ -218,28 +257,54 @@ func (b *livebucket) GetBucketStore(idx int) *bucketstore {
 }
 
 func (b *livebucket) Flush() error {
-	for _, bs := range b.bucketstores {
+	return b.eachBucketStore(func(bs *bucketstore) error {
 		_, err := bs.Flush()
-		if err != nil {
-			return err
+		return err
+	})
+}
+
+func (b *livebucket) Compact() error {
+	err := b.eachBucketStore(func(bs *bucketstore) error {
+		return bs.Compact()
+	})
+	if err != nil {
+		return err
+	}
+	for vbid := range b.vbuckets {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb != nil {
+			if vs := vb.openedViewsStore(); vs != nil {
+				if err = vs.Compact(); err != nil {
+					return err
+				}
+			}
 		}
 	}
 	return nil
 }
 
-func (b *livebucket) Compact() error {
+// Runs f concurrently on every bucketstore, so that one store's
+// flush or compaction doesn't hold up the others.  Returns the
+// first error.
+func (b *livebucket) eachBucketStore(f func(*bucketstore) error) error {
+	errs := make(chan error, len(b.bucketstores))
 	for _, bs := range b.bucketstores {
-		err := bs.Compact()
-		if err != nil {
-			return err
+		go func(bs *bucketstore) {
+			errs <- f(bs)
+		}(bs)
+	}
+	var rv error
+	for i := 0; i < len(b.bucketstores); i++ {
+		if err := <-errs; err != nil && rv == nil {
+			rv = err
 		}
 	}
-	return nil
+	return rv
 }
 
 func (b *livebucket) Load() (err error) {
 	b.bucketItemBytes = 0
-	for _, bs := range b.bucketstores {
+	for idx, bs := range b.bucketstores {
 		// TODO: Need to poke observers with changed vbstate?
 		var errVisit error
 		err = bs.collMeta(COLL_VBMETA).VisitItemsAscend(nil, true,
@@ -253,6 +318,11 @@ func (b *livebucket) Load() (err error) {
 					errVisit = fmt.Errorf("load failed with vbid too big: %v", vbid)
 					return false
 				}
+				if storeIdxForVBucket(uint16(vbid), len(b.bucketstores)) != idx {
+					log.Printf("loading vbucket: %v from store file: %v,"+
+						" not where numStores: %v would place it",
+						vbid, idx, len(b.bucketstores))
+				}
 				vb, errVisit := newVBucket(b, uint16(vbid), bs,
 					&b.bucketItemBytes)
 				if errVisit != nil {
@@ -308,7 +378,7 @@ func (b *livebucket) CreateVBucket(vbid uint16) (*VBucket, error) {
 	if b == nil || !b.Available() {
 		return nil, errors.New("cannot create vbucket as bucket is unavailable")
 	}
-	bs := b.bucketstores[int(vbid)%STORES_PER_BUCKET]
+	bs := b.bucketstores[storeIdxForVBucket(vbid, b.settings.numStores())]
 	if bs == nil {
 		return nil, errors.New("cannot create vbucket as bucketstore missing")
 	}
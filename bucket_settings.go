@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -19,6 +20,46 @@ const (
 	MemoryOnly_LEVEL_PERSIST_NOTHING = 2
 )
 
+const (
+	// Flushes don't fsync, leaving it to the OS.  This is the
+	// default, as it's how buckets always flushed.
+	Durability_NONE = "none"
+
+	// Every flush is fsync'ed.
+	Durability_FSYNC_ON_FLUSH = "fsync-on-flush"
+
+	// Mutations are only acknowledged after they're flushed and
+	// fsync'ed, where concurrent mutations share a flush.
+	Durability_FSYNC_PER_BATCH = "fsync-per-batch"
+)
+
+// The upper limit of the numStores bucket setting.
+const MAX_STORES_PER_BUCKET = 64
+
+func checkNumStores(numStores int) error {
+	if numStores < 0 || numStores > MAX_STORES_PER_BUCKET {
+		return fmt.Errorf("numStores: %v must be between 1 and %v, or 0 for the default",
+			numStores, MAX_STORES_PER_BUCKET)
+	}
+	return nil
+}
+
+func checkDevSubsetPartitions(devSubsetPartitions int) error {
+	if devSubsetPartitions < 0 {
+		return fmt.Errorf("devSubsetPartitions: %v must be positive, or 0 for the default",
+			devSubsetPartitions)
+	}
+	return nil
+}
+
+func checkDurability(durability string) error {
+	switch durability {
+	case "", Durability_NONE, Durability_FSYNC_ON_FLUSH, Durability_FSYNC_PER_BATCH:
+		return nil
+	}
+	return fmt.Errorf("unknown durability: %v", durability)
+}
+
 type BucketSettings struct {
 	NumPartitions    int    `json:"numPartitions"`
 	PasswordHashFunc string `json:"passwordHashFunc"`
@@ -27,6 +68,39 @@ type BucketSettings struct {
 	QuotaBytes       int64  `json:"quotaBytes"`
 	MemoryOnly       int    `json:"memoryOnly"`
 	UUID             string `json:"uuid"`
+	Durability       string `json:"durability,omitempty"`
+
+	// The number of *.store files that the bucket's vbuckets are
+	// spread across, each flushed and compacted independently.  Zero
+	// means STORES_PER_BUCKET.  Changing it for an existing bucket
+	// needs an offline migration (see migrateBucketStores()).
+	NumStores int `json:"numStores,omitempty"`
+
+	// The number of vbuckets that dev design docs ("_design/dev_*")
+	// index, unless queried with full_set=true.  Zero means
+	// DEV_SUBSET_PARTITIONS.
+	DevSubsetPartitions int `json:"devSubsetPartitions,omitempty"`
+
+	// Besides periodically, flush when this many mutations or bytes
+	// are waiting to be flushed.  Zero means no limit.
+	FlushDirtyItems int64 `json:"flushDirtyItems,omitempty"`
+	FlushDirtyBytes int64 `json:"flushDirtyBytes,omitempty"`
+
+	// When non-zero, compact when this percent of a store file is
+	// garbage, instead of after a number of writes.
+	CompactFragmentation int `json:"compactFragmentation,omitempty"`
+
+	// When set, automatic compactions only run during this local time
+	// of day window, like "01:00-05:00".
+	CompactWindow string `json:"compactWindow,omitempty"`
+
+	// When any is set, the bucket's store files are encrypted.  The
+	// key name is of a key file in the server's encryption keys dir,
+	// and takes precedence.  Only the server's own flags set the
+	// key file or env var.
+	EncryptionKeyName string `json:"encryptionKeyName,omitempty"`
+	EncryptionKeyFile string `json:"encryptionKeyFile,omitempty"`
+	EncryptionKeyEnv  string `json:"encryptionKeyEnv,omitempty"`
 }
 
 type pwverifier func(salt string, bpass, input []byte) bool
@@ -56,6 +130,20 @@ func (bs *BucketSettings) Copy() *BucketSettings {
 	return &rv
 }
 
+func (bs *BucketSettings) numStores() int {
+	if bs.NumStores > 0 {
+		return bs.NumStores
+	}
+	return STORES_PER_BUCKET
+}
+
+func (bs *BucketSettings) devSubsetPartitions() int {
+	if bs.DevSubsetPartitions > 0 {
+		return bs.DevSubsetPartitions
+	}
+	return DEV_SUBSET_PARTITIONS
+}
+
 // Returns a safe subset (no passwords) useful for JSON-ification.
 func (bs *BucketSettings) SafeView() map[string]interface{} {
 	return map[string]interface{}{
@@ -63,6 +151,16 @@ func (bs *BucketSettings) SafeView() map[string]interface{} {
 		"quotaBytes":    bs.QuotaBytes,
 		"memoryOnly":    bs.MemoryOnly,
 		"uuid":          bs.UUID,
+		"durability":    bs.Durability,
+		"numStores":     bs.numStores(),
+		"encrypted": bs.EncryptionKeyName != "" ||
+			bs.EncryptionKeyFile != "" || bs.EncryptionKeyEnv != "",
+
+		"flushDirtyItems":      bs.FlushDirtyItems,
+		"flushDirtyBytes":      bs.FlushDirtyBytes,
+		"compactFragmentation": bs.CompactFragmentation,
+		"compactWindow":        bs.CompactWindow,
+		"devSubsetPartitions":  bs.devSubsetPartitions(),
 	}
 }
 
@@ -75,10 +75,17 @@ func (b *Buckets) newUnlocked(name string,
 		}
 	}
 
-	_, err = settings.load(bdir)
+	// The default numStores only applies to brand new buckets, as
+	// an existing bucket's store files are laid out for its own.
+	numStores := settings.NumStores
+	settings.NumStores = 0
+	exists, err := settings.load(bdir)
 	if err != nil {
 		return nil, err
 	}
+	if !exists {
+		settings.NumStores = numStores
+	}
 
 	if rv, err = NewBucket(bdir, settings); err != nil {
 		return nil, err
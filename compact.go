@@ -3,28 +3,47 @@ package main
 import (
 	"fmt"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/steveyen/gkvlite"
 )
 
+// Compacts as a task of the server-wide compactTasks scheduler,
+// waiting first for a compaction slot.
 func (s *bucketstore) Compact() error {
-	s.diskLock.Lock()
-	defer s.diskLock.Unlock()
+	atomic.AddInt32(&s.compacting, 1)
+	return s.compactCounted()
+}
+
+// Compacts, when the caller has already counted the compaction in
+// s.compacting, as periodicPersist does so that it queues only one.
+func (s *bucketstore) compactCounted() error {
+	defer atomic.AddInt32(&s.compacting, -1)
+	s.compactLock.Lock() // Only one compaction at a time per bucketstore.
+	defer s.compactLock.Unlock()
 
+	// Only compaction swaps the bsf, so it's stable from here on.
 	bsf := s.BSF()
 	if bsf.file == nil { // We're in memory-only mode.
 		return nil
 	}
 
+	task, writeEvery, err := compactTasks.start(bsf.path)
+	if err != nil {
+		return err
+	}
 	compactPath := bsf.path + ".compact"
-	if err := s.compactGo(bsf, compactPath); err != nil {
-		atomic.AddInt64(&s.stats.CompactErrors, 1)
+	err = s.compactGo(bsf, compactPath, task, writeEvery)
+	compactTasks.done(task, err)
+	if err != nil {
+		if err != compactCancelledErr {
+			atomic.AddInt64(&s.stats.CompactErrors, 1)
+		}
 		return err
 	}
 
@@ -32,11 +51,93 @@ func (s *bucketstore) Compact() error {
 	return nil
 }
 
-func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error {
-	// TODO: Should cleanup all old, previous attempts to rescue disk space.
+// Store files smaller than this aren't compacted for fragmentation.
+var compactMinFileSize int64 = 1024 * 1024
+
+// Decides whether it's time for an automatic compaction.
+func (s *bucketstore) needsCompaction(now time.Time) bool {
+	if s.compactWindow != nil && !s.compactWindow.contains(now) {
+		return false
+	}
+	if s.compactFragmentation <= 0 || s.bsfMemoryOnly != nil {
+		return s.stats.Writes-s.stats.LastCompactAt > compact_every
+	}
+	fileSize := s.Stats().FileSize
+	if fileSize < compactMinFileSize ||
+		fileSize <= atomic.LoadInt64(&s.lastCompactFileSize) {
+		return false // Too small, or no growth since last compaction.
+	}
+	frag, err := s.fragmentation(fileSize)
+	return err == nil && frag >= s.compactFragmentation
+}
+
+// Returns the percent of a store file that's not live data.
+func (s *bucketstore) fragmentation(fileSize int64) (int, error) {
+	if fileSize <= 0 {
+		return 0, nil
+	}
+	var live uint64
+	var err error
+	s.apply(func() {
+		for _, p := range s.partitions {
+			var numBytes uint64
+			if numBytes, err = p.collsBytes(); err != nil {
+				return
+			}
+			live += numBytes
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if int64(live) >= fileSize {
+		return 0, nil
+	}
+	return int(100 * (fileSize - int64(live)) / fileSize), nil
+}
+
+// A time of day window, in minutes since midnight, which might wrap
+// around midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// Parses a window like "22:30-04:00", where "" means no window.
+func parseTimeWindow(s string) (*timeWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("time window should be like HH:MM-HH:MM, got: %v", s)
+	}
+	rv := &timeWindow{}
+	for i, dst := range []*int{&rv.start, &rv.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("time window: %v, err: %v", s, err)
+		}
+		*dst = t.Hour()*60 + t.Minute()
+	}
+	return rv, nil
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return w.start <= m && m < w.end
+	}
+	return w.start <= m || m < w.end
+}
+
+func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string,
+	task *compactTask, writeEvery int) error {
+	// Leftovers of attempts from before a restart are removed by
+	// sweepStoreFiles() at bucket load.
 	os.Remove(compactPath) // Clean up any previous attempts.
 
-	compactFile, err := fileService.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	compactFile, err := openStoreFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_EXCL,
+		s.encryptionKey)
 	if err != nil {
 		return err
 	}
@@ -51,20 +152,25 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 		return err
 	}
 
-	// TODO: Parametrize writeEvery.
-	writeEvery := 1000
-
 	lastChanges := make(map[uint16]*gkvlite.Item) // Last items in changes colls.
 	collNames := bsf.store.GetCollectionNames()   // Names of collections to process.
 	collRest := make([]string, 0, len(collNames)) // Names of unprocessed collections.
 	vbids := make([]uint16, 0, len(collNames))    // VBucket id's that we processed.
 
-	// Process compaction in a few steps: first, unlocked,
-	// snapshot-based collection copying meant to handle most of each
-	// vbucket's data; and then, locked copying of any vbucket
-	// mutations (deltas) that happened in the meantime.  Then, while
-	// still holding all vbucket collection locks, we copy any
+	// Process compaction in a few steps: first, unlocked (except for
+	// the diskLock), snapshot-based collection copying meant to handle
+	// most of each vbucket's data, during which mutations may continue
+	// and the task may be paused; and then, locked copying of any
+	// vbucket mutations (deltas) that happened in the meantime.  Then,
+	// while still holding all vbucket collection locks, we copy any
 	// remaining non-vbucket collections and atomically swap the files.
+	// A paused or throttled task lets go of the diskLock, so that
+	// flushes can go on meanwhile.
+	s.diskLock.Lock()
+	defer s.diskLock.Unlock()
+
+	task.setYieldLock(&s.diskLock)
+	task.setCollsTotal(len(collNames))
 	for _, collName := range collNames {
 		if !strings.HasSuffix(collName, COLL_SUFFIX_CHANGES) {
 			if !strings.HasSuffix(collName, COLL_SUFFIX_KEYS) {
@@ -74,7 +180,7 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 			continue
 		}
 		vbid, lastChange, err :=
-			s.copyVBucketColls(bsf, collName, compactStore, writeEvery)
+			s.copyVBucketColls(bsf, collName, compactStore, writeEvery, task)
 		if err != nil {
 			return err
 		}
@@ -83,9 +189,10 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 	}
 
 	return s.copyBucketStoreDeltas(bsf, compactStore,
-		vbids, 0, lastChanges, writeEvery, func() (err error) {
+		vbids, 0, lastChanges, writeEvery, task, func() (err error) {
 			// Copy any remaining (simple) collections (lifke COLL_VBMETA).
-			err = s.copyRemainingColls(bsf, collRest, compactStore, writeEvery)
+			err = s.copyRemainingColls(bsf, collRest, compactStore,
+				writeEvery, task)
 			if err != nil {
 				return err
 			}
@@ -100,19 +207,16 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 }
 
 func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string) error {
-	idx, ver, err := parseStoreFileName(filepath.Base(bsf.path), STORE_FILE_SUFFIX)
+	nextPath, err := nextVersionedFilePath(bsf.path)
 	if err != nil {
 		return err
 	}
 
-	nextName := makeStoreFileName(idx, ver+1, STORE_FILE_SUFFIX)
-	nextPath := path.Join(filepath.Dir(bsf.path), nextName)
-
 	if err = os.Rename(compactPath, nextPath); err != nil {
 		return err
 	}
 
-	nextFile, err := fileService.OpenFile(nextPath, os.O_RDWR|os.O_CREATE)
+	nextFile, err := openStoreFile(nextPath, os.O_RDWR|os.O_CREATE, s.encryptionKey)
 	if err != nil {
 		return err
 	}
@@ -123,19 +227,37 @@ func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string)
 		// TODO: Rollback the previous *.orig rename.
 		return err
 	}
+	setCollKeyCompares(nextStore)
 	nextBSF.store = nextStore
 
 	atomic.StorePointer(&s.bsf, unsafe.Pointer(nextBSF))
 
-	bsf.apply(func() {
-		bsf.purge = true // Mark the old file as purgable.
-	})
+	// The old file is deleted once any in-flight readers are done.
+	bsf.supersede()
 
 	return nil
 }
 
+// Both store and views files follow a "PREFIX-VER.SUFFIX" naming
+// pattern, where compaction writes the next VER.
+func nextVersionedFilePath(p string) (string, error) {
+	dir, fileName := filepath.Split(p)
+	ext := filepath.Ext(fileName)
+	base := fileName[0 : len(fileName)-len(ext)]
+	i := strings.LastIndex(base, "-")
+	if i <= 0 || ext == "" {
+		return "", fmt.Errorf("not a versioned filename: %v", p)
+	}
+	ver, err := strconv.Atoi(base[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("not a versioned filename: %v, err: %v", p, err)
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%d%s", base[0:i], ver+1, ext)), nil
+}
+
 func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
-	writeEvery int) (numItems uint64, lastItem *gkvlite.Item, err error) {
+	writeEvery int, task *compactTask) (
+	numItems uint64, lastItem *gkvlite.Item, err error) {
 	minItem, err := srcColl.MinItem(true)
 	if err != nil {
 		return 0, nil, err
@@ -155,6 +277,9 @@ func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 			if errVisit = dstColl.Write(); errVisit != nil {
 				return false
 			}
+			if errVisit = task.checkpoint(uint64(writeEvery), true); errVisit != nil {
+				return false
+			}
 		}
 		return true
 	})
@@ -164,13 +289,21 @@ func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 	if errVisit != nil {
 		return 0, nil, errVisit
 	}
+	if writeEvery > 0 {
+		err = task.checkpoint(numItems%uint64(writeEvery), true)
+	} else {
+		err = task.checkpoint(numItems, true)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
 
 	return numItems, lastItem, nil
 }
 
 func copyDelta(lastChangeCAS []byte, cName string, kName string,
 	srcStore *gkvlite.Store, dstStore *gkvlite.Store,
-	writeEvery int) (numVisits uint64, err error) {
+	writeEvery int, task *compactTask) (numVisits uint64, err error) {
 	cSrc := srcStore.GetCollection(cName)
 	cDst := dstStore.GetCollection(cName)
 	kDst := dstStore.GetCollection(kName)
@@ -214,6 +347,10 @@ func copyDelta(lastChangeCAS []byte, cName string, kName string,
 			if errVisit = kDst.Write(); errVisit != nil {
 				return false
 			}
+			// No pausing, as we're holding the partition locks.
+			if errVisit = task.checkpoint(uint64(writeEvery), false); errVisit != nil {
+				return false
+			}
 		}
 		return true
 	})
@@ -228,8 +365,8 @@ func copyDelta(lastChangeCAS []byte, cName string, kName string,
 }
 
 func (s *bucketstore) copyVBucketColls(bsf *bucketstorefile,
-	collName string, compactStore *gkvlite.Store, writeEvery int) (
-	uint16, *gkvlite.Item, error) {
+	collName string, compactStore *gkvlite.Store, writeEvery int,
+	task *compactTask) (uint16, *gkvlite.Item, error) {
 	vbidStr := collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)]
 	vbid, err := strconv.Atoi(vbidStr)
 	if err != nil {
@@ -273,21 +410,22 @@ func (s *bucketstore) copyVBucketColls(bsf *bucketstorefile,
 		return 0, nil, fmt.Errorf("compact missing colls from snapshot: %v, vbid: %v",
 			bsf.path, vbid)
 	}
-	// TODO: Record stats on # changes processed.
-	_, lastChange, err := copyColl(cCurrSnapshot, cDest, writeEvery)
+	_, lastChange, err := copyColl(cCurrSnapshot, cDest, writeEvery, task)
 	if err != nil {
 		return 0, nil, err
 	}
-	// TODO: Record stats on # keys processed.
-	_, _, err = copyColl(kCurrSnapshot, kDest, writeEvery)
+	task.collCopied()
+	_, _, err = copyColl(kCurrSnapshot, kDest, writeEvery, task)
 	if err != nil {
 		return 0, nil, err
 	}
+	task.collCopied()
 	return uint16(vbid), lastChange, err
 }
 
 func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
-	collRest []string, compactStore *gkvlite.Store, writeEvery int) error {
+	collRest []string, compactStore *gkvlite.Store, writeEvery int,
+	task *compactTask) error {
 	currSnapshot := bsf.store.Snapshot()
 	if currSnapshot == nil {
 		return fmt.Errorf("compact source snapshot failed: %v", bsf.path)
@@ -298,15 +436,16 @@ func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
 			return fmt.Errorf("compact rest coll missing: %v, collName: %v",
 				bsf.path, collName)
 		}
-		collNext := compactStore.SetCollection(collName, nil)
+		collNext := compactStore.SetCollection(collName, collKeyCompare(collName))
 		if collCurr == nil {
 			return fmt.Errorf("compact rest dest missing: %v, collName: %v",
 				bsf.path, collName)
 		}
-		_, _, err := copyColl(collCurr, collNext, writeEvery)
+		_, _, err := copyColl(collCurr, collNext, writeEvery, nil)
 		if err != nil {
 			return err
 		}
+		task.collCopied()
 	}
 	return nil
 }
@@ -318,7 +457,7 @@ func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
 func (s *bucketstore) copyBucketStoreDeltas(bsf *bucketstorefile,
 	compactStore *gkvlite.Store, vbids []uint16, vbidIdx int,
 	lastChanges map[uint16]*gkvlite.Item, writeEvery int,
-	done func() error) (err error) {
+	task *compactTask, done func() error) (err error) {
 	if vbidIdx >= len(vbids) {
 		return done() // Callback while we have all the locks.
 	}
@@ -332,12 +471,12 @@ func (s *bucketstore) copyBucketStoreDeltas(bsf *bucketstorefile,
 	}
 	ps.collsPauseSwap(func() (*gkvlite.Collection, *gkvlite.Collection) {
 		_, err = copyDelta(lastChanges[vbid].Key, cName, kName,
-			bsf.store.Snapshot(), compactStore, writeEvery)
+			bsf.store.Snapshot(), compactStore, writeEvery, task)
 		if err != nil {
 			return s.coll(kName), s.coll(cName)
 		}
 		err = s.copyBucketStoreDeltas(bsf, compactStore,
-			vbids, vbidIdx+1, lastChanges, writeEvery, done)
+			vbids, vbidIdx+1, lastChanges, writeEvery, task, done)
 		if err != nil {
 			return s.coll(kName), s.coll(cName)
 		}
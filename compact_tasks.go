@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	compactQueued    = "queued"
+	compactRunning   = "running"
+	compactPaused    = "paused"
+	compactDone      = "done"
+	compactCancelled = "cancelled"
+	compactFailed    = "failed"
+)
+
+// How many finished compaction tasks are kept around for reporting.
+const compactTasksFinishedKeep = 20
+
+var compactCancelledErr = errors.New("compaction cancelled")
+
+// The server-wide compaction scheduler.
+var compactTasks = newCompactScheduler(2, 1000, 0)
+
+// Limits the number of concurrent compactions across all buckets,
+// and tracks each compaction as a task that can be watched, paused
+// and cancelled.
+type compactScheduler struct {
+	m          sync.Mutex
+	slots      chan bool
+	writeEvery int           // Items copied between writes.
+	throttle   time.Duration // Sleep after each writeEvery items.
+	tasks      map[string]*compactTask
+	finished   []string // Ids of finished tasks, oldest first.
+	nextId     uint64
+}
+
+type CompactTaskInfo struct {
+	Id          string    `json:"id"`
+	Bucket      string    `json:"bucket"`
+	Path        string    `json:"path"`
+	Status      string    `json:"status"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	CollsTotal  int64     `json:"collsTotal"`
+	CollsCopied int64     `json:"collsCopied"`
+	ItemsCopied int64     `json:"itemsCopied"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type compactTask struct {
+	m         sync.Mutex
+	cond      *sync.Cond // Signaled on pause/resume/cancel changes.
+	info      CompactTaskInfo
+	paused    bool
+	cancelled bool
+	cancelch  chan bool // Closed on cancel.
+	throttle  time.Duration
+	yieldLock sync.Locker // Let go of while paused or throttled.
+}
+
+func newCompactScheduler(concurrency, writeEvery int,
+	throttle time.Duration) *compactScheduler {
+	return &compactScheduler{
+		slots:      make(chan bool, concurrency),
+		writeEvery: writeEvery,
+		throttle:   throttle,
+		tasks:      map[string]*compactTask{},
+	}
+}
+
+// Meant to be called at startup, before any compactions.
+func (cs *compactScheduler) configure(concurrency, writeEvery int,
+	throttle time.Duration) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	cs.slots = make(chan bool, concurrency)
+	cs.writeEvery = writeEvery
+	cs.throttle = throttle
+}
+
+// Registers a compaction of a store file and waits for a slot.
+func (cs *compactScheduler) start(storePath string) (*compactTask, int, error) {
+	cs.m.Lock()
+	cs.nextId++
+	t := &compactTask{
+		info: CompactTaskInfo{
+			Id:       fmt.Sprintf("compact-%v", cs.nextId),
+			Bucket:   bucketNameFromStorePath(storePath),
+			Path:     storePath,
+			Status:   compactQueued,
+			QueuedAt: time.Now(),
+		},
+		cancelch: make(chan bool),
+		throttle: cs.throttle,
+	}
+	t.cond = sync.NewCond(&t.m)
+	cs.tasks[t.info.Id] = t
+	slots := cs.slots
+	writeEvery := cs.writeEvery
+	cs.m.Unlock()
+
+	select {
+	case slots <- true:
+	case <-t.cancelch:
+		cs.finish(t, compactCancelledErr)
+		return nil, 0, compactCancelledErr
+	}
+
+	t.m.Lock()
+	t.info.Status = compactRunning
+	if t.paused {
+		t.info.Status = compactPaused
+	}
+	t.info.StartedAt = time.Now()
+	t.m.Unlock()
+	return t, writeEvery, nil
+}
+
+// Releases the task's slot and records how it ended.
+func (cs *compactScheduler) done(t *compactTask, err error) {
+	cs.m.Lock()
+	slots := cs.slots
+	cs.m.Unlock()
+	<-slots
+	cs.finish(t, err)
+}
+
+func (cs *compactScheduler) finish(t *compactTask, err error) {
+	t.m.Lock()
+	switch {
+	case err == nil:
+		t.info.Status = compactDone
+	case err == compactCancelledErr:
+		t.info.Status = compactCancelled
+	default:
+		t.info.Status = compactFailed
+		t.info.Error = err.Error()
+	}
+	t.info.FinishedAt = time.Now()
+	t.m.Unlock()
+
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	cs.finished = append(cs.finished, t.info.Id)
+	for len(cs.finished) > compactTasksFinishedKeep {
+		delete(cs.tasks, cs.finished[0])
+		cs.finished = cs.finished[1:]
+	}
+}
+
+func (cs *compactScheduler) get(id string) *compactTask {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	return cs.tasks[id]
+}
+
+// Returns info on all known tasks, ordered by when they were queued.
+func (cs *compactScheduler) list() []CompactTaskInfo {
+	cs.m.Lock()
+	tasks := make([]*compactTask, 0, len(cs.tasks))
+	for _, t := range cs.tasks {
+		tasks = append(tasks, t)
+	}
+	cs.m.Unlock()
+
+	rv := make([]CompactTaskInfo, 0, len(tasks))
+	for _, t := range tasks {
+		rv = append(rv, t.Info())
+	}
+	sort.Sort(compactTaskInfos(rv))
+	return rv
+}
+
+// Cancels all unfinished compactions of a bucket, returning how many.
+func (cs *compactScheduler) cancelBucket(bucketName string) int {
+	n := 0
+	for _, info := range cs.list() {
+		if info.Bucket == bucketName {
+			if t := cs.get(info.Id); t != nil && t.Cancel() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+type compactTaskInfos []CompactTaskInfo
+
+func (a compactTaskInfos) Len() int      { return len(a) }
+func (a compactTaskInfos) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a compactTaskInfos) Less(i, j int) bool {
+	return a[i].QueuedAt.Before(a[j].QueuedAt)
+}
+
+func (t *compactTask) Info() CompactTaskInfo {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.info
+}
+
+func (t *compactTask) finished() bool {
+	switch t.info.Status {
+	case compactDone, compactCancelled, compactFailed:
+		return true
+	}
+	return false
+}
+
+// Returns false if the task was already finished or cancelled.
+func (t *compactTask) Cancel() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.cancelled || t.finished() {
+		return false
+	}
+	t.cancelled = true
+	close(t.cancelch)
+	t.cond.Broadcast()
+	return true
+}
+
+func (t *compactTask) Pause() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.cancelled || t.finished() {
+		return false
+	}
+	t.paused = true
+	if t.info.Status == compactRunning {
+		t.info.Status = compactPaused
+	}
+	return true
+}
+
+func (t *compactTask) Resume() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.cancelled || t.finished() {
+		return false
+	}
+	t.paused = false
+	if t.info.Status == compactPaused {
+		t.info.Status = compactRunning
+	}
+	t.cond.Broadcast()
+	return true
+}
+
+func (t *compactTask) setCollsTotal(n int) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	t.info.CollsTotal = int64(n)
+	t.m.Unlock()
+}
+
+// Sets a lock that the copying holds, like a bucketstore's diskLock,
+// which checkpoints release while pausing or throttling.
+func (t *compactTask) setYieldLock(l sync.Locker) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	t.yieldLock = l
+	t.m.Unlock()
+}
+
+func (t *compactTask) collCopied() {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	t.info.CollsCopied++
+	t.m.Unlock()
+}
+
+// Called by the copying loops every so many items, to record
+// progress, throttle, and to handle pause and cancel requests.  A
+// paused task blocks here, unless pausing isn't allowed, as when
+// copying while holding the partition locks.  Where pausing is
+// allowed, the yieldLock is let go of meanwhile.
+func (t *compactTask) checkpoint(numItems uint64, allowPause bool) error {
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	t.info.ItemsCopied += int64(numItems)
+	yieldLock := t.yieldLock
+	t.m.Unlock()
+	if allowPause && yieldLock != nil {
+		yieldLock.Unlock()
+		defer yieldLock.Lock()
+	}
+	t.m.Lock()
+	for allowPause && t.paused && !t.cancelled {
+		t.cond.Wait()
+	}
+	cancelled := t.cancelled
+	t.m.Unlock()
+	if cancelled {
+		return compactCancelledErr
+	}
+	if t.throttle > 0 && allowPause {
+		time.Sleep(t.throttle)
+	}
+	return nil
+}
+
+// Store files live in a bucket directory named after the bucket.
+func bucketNameFromStorePath(storePath string) string {
+	return strings.TrimSuffix(filepath.Base(filepath.Dir(storePath)),
+		BUCKET_DIR_SUFFIX)
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"runtime"
+	"path"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dustin/gomemcached"
 )
@@ -191,7 +196,7 @@ func TestCompactionNumFiles(t *testing.T) {
 	}
 }
 
-func SKIP_TestCompactionPurgeTimeout(t *testing.T) {
+func TestCompactionPurge(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
 
@@ -204,7 +209,7 @@ func SKIP_TestCompactionPurgeTimeout(t *testing.T) {
 	}
 
 	r0 := &reqHandler{currentBucket: b0}
-	b0.CreateVBucket(2)
+	v0, _ := b0.CreateVBucket(2)
 	b0.SetVBState(2, VBActive)
 	for i := 0; i < 100; i++ {
 		testLoadInts(t, r0, 2, 5)
@@ -213,20 +218,32 @@ func SKIP_TestCompactionPurgeTimeout(t *testing.T) {
 		}
 	}
 	preCompactFiles, err := ioutil.ReadDir(testBucketDir)
+	prevPath := v0.bs.BSF().path
+
+	// A reader that's still using the old file keeps it around.
+	_, _, release, _ := v0.ps.collsRef()
+
 	if err = b0.Compact(); err != nil {
 		t.Errorf("expected Compact to work, got: %v", err)
 	}
+	if _, err = os.Stat(prevPath); err != nil {
+		t.Errorf("expected old file to exist while being read, got: %v", err)
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "after compaction")
+
+	release()
+	if _, err = os.Stat(prevPath); !os.IsNotExist(err) {
+		t.Errorf("expected old file to be purged after release, got: %v", err)
+	}
+	if v0.bs.Stats().FilesRetired != 1 {
+		t.Errorf("expected a retired file, got: %#v", v0.bs.Stats())
+	}
+
 	if err = b0.Flush(); err != nil {
 		t.Errorf("expected Flush to work, got: %v", err)
 	}
 	b0.Close()
 
-	// TODO: Even though there's a finalzer hook for the old
-	// bucketstorefile, the old file still seems to exist after the
-	// GC; so perhaps there are still references to the old
-	// bucketstorefile, or it's something else.
-	runtime.GC()
-
 	postCompactFiles, err := ioutil.ReadDir(testBucketDir)
 	if len(postCompactFiles) != len(preCompactFiles) {
 		t.Errorf("expected purged postCompactFiles == preCompactFiles with, got: %v vs %v",
@@ -234,6 +251,72 @@ func SKIP_TestCompactionPurgeTimeout(t *testing.T) {
 	}
 }
 
+func TestSweepStoreFiles(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	settings := &BucketSettings{NumPartitions: MAX_VBUCKETS}
+	b0, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 5)
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if err = b0.Compact(); err != nil {
+		t.Errorf("expected Compact to work, got: %v", err)
+	}
+	b0.Close()
+
+	// Simulate leftovers of a crash: a superseded store file that
+	// was never deleted and an unfinished compaction.
+	stale := []string{
+		makeStoreFileName(0, 0, STORE_FILE_SUFFIX),
+		makeStoreFileName(0, 1, STORE_FILE_SUFFIX) + ".compact",
+	}
+	for _, fname := range stale {
+		err = ioutil.WriteFile(path.Join(testBucketDir, fname),
+			[]byte("leftover"), 0666)
+		if err != nil {
+			t.Fatalf("expected WriteFile to work, got: %v", err)
+		}
+	}
+
+	du, err := diskUsage(testBucketDir, STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+	if err != nil {
+		t.Fatalf("expected diskUsage to work, got: %v", err)
+	}
+	if du.StaleBytes != int64(2*len("leftover")) || du.CurrentBytes <= 0 ||
+		du.TotalBytes < du.StaleBytes+du.CurrentBytes {
+		t.Errorf("expected stale bytes in disk usage, got: %#v", du)
+	}
+
+	b1, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected reopening the bucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	for _, fname := range stale {
+		if _, err = os.Stat(path.Join(testBucketDir, fname)); !os.IsNotExist(err) {
+			t.Errorf("expected stale file: %v to be swept, got: %v", fname, err)
+		}
+	}
+	testExpectInts(t, &reqHandler{currentBucket: b1}, 2,
+		[]int{0, 1, 2, 3, 4}, "after sweep")
+
+	du, err = diskUsage(testBucketDir, STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+	if err != nil || du.StaleBytes != 0 {
+		t.Errorf("expected no stale bytes after sweep, got: %#v, %v", du, err)
+	}
+}
+
 func TestCopyDelta(t *testing.T) {
 	testCopyDelta(t, 1)
 	testCopyDelta(t, 0x0800000)
@@ -284,7 +367,7 @@ func testCopyDelta(t *testing.T, writeEvery int) {
 	cName := fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_CHANGES)
 	kName := fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_KEYS)
 
-	numVisits, err := copyDelta(nil, cName, kName, v0.bs.BSF().store, v0.bs.BSF().store, writeEvery)
+	numVisits, err := copyDelta(nil, cName, kName, v0.bs.BSF().store, v0.bs.BSF().store, writeEvery, nil)
 	if err != nil {
 		t.Errorf("expected copyDelta to work, got: %v", err)
 	}
@@ -303,7 +386,7 @@ func TestCopyDeltaBadNames(t *testing.T) {
 		})
 	v0, _ := b0.CreateVBucket(2)
 
-	_, err = copyDelta(nil, "foo", "bar", v0.bs.BSF().store, v0.bs.BSF().store, 0)
+	_, err = copyDelta(nil, "foo", "bar", v0.bs.BSF().store, v0.bs.BSF().store, 0, nil)
 	if err == nil {
 		t.Errorf("expected copyDelta to fail on bad coll names")
 	}
@@ -331,3 +414,378 @@ func TestBadCompactSwapFile(t *testing.T) {
 		t.Errorf("expected compactSwapFile to fail on bad compactPath")
 	}
 }
+
+func TestParseTimeWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		tm, _ := time.Parse("15:04", hhmm)
+		return tm
+	}
+	tests := []struct {
+		window string
+		at     string
+		exp    bool
+	}{
+		{"01:00-05:00", "00:59", false},
+		{"01:00-05:00", "01:00", true},
+		{"01:00-05:00", "04:59", true},
+		{"01:00-05:00", "05:00", false},
+		{"22:30-04:00", "23:00", true},
+		{"22:30-04:00", "03:00", true},
+		{"22:30-04:00", "12:00", false},
+	}
+	for _, test := range tests {
+		w, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Errorf("expected parse of %v to work, got: %v", test.window, err)
+			continue
+		}
+		if w.contains(at(test.at)) != test.exp {
+			t.Errorf("expected window %v contains %v to be %v",
+				test.window, test.at, test.exp)
+		}
+	}
+
+	if w, err := parseTimeWindow(""); w != nil || err != nil {
+		t.Errorf("expected empty window to be nil, got: %v, %v", w, err)
+	}
+	for _, bad := range []string{"01:00", "1am-5am", "01:00-25:00"} {
+		if _, err := parseTimeWindow(bad); err == nil {
+			t.Errorf("expected parse of %v to fail", bad)
+		}
+	}
+}
+
+func TestFragmentationCompaction(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	prevCompactMinFileSize := compactMinFileSize
+	compactMinFileSize = 0
+	defer func() { compactMinFileSize = prevCompactMinFileSize }()
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions:        MAX_VBUCKETS,
+			CompactFragmentation: 30,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	for i := 0; i < 50; i++ {
+		testLoadInts(t, r0, 2, 5)
+		if err = b0.Flush(); err != nil {
+			t.Errorf("expected Flush (loop) to work, got: %v", err)
+		}
+	}
+
+	bs := v0.bs
+	frag, err := bs.fragmentation(bs.Stats().FileSize)
+	if err != nil || frag < 30 {
+		t.Errorf("expected rewrites to fragment the file, got: %v, err: %v",
+			frag, err)
+	}
+
+	// Not while outside of the compaction window.
+	now := time.Now()
+	bs.compactWindow, _ = parseTimeWindow(now.Add(2*time.Hour).Format("15:04") +
+		"-" + now.Add(3*time.Hour).Format("15:04"))
+	if bs.needsCompaction(now) {
+		t.Errorf("expected no compaction outside of the window")
+	}
+	bs.compactWindow = nil
+
+	if !bs.needsCompaction(now) {
+		t.Errorf("expected fragmentation to need compaction")
+	}
+	bs.periodicPersist(now)
+	for i := 0; i < 1000 && atomic.LoadInt64(&bs.lastCompactFileSize) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if bs.Stats().Compacts != 1 {
+		t.Errorf("expected a compaction, got: %v", bs.Stats().Compacts)
+	}
+	if bs.needsCompaction(now) {
+		t.Errorf("expected no compaction again without file growth")
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "after compaction")
+}
+
+func TestCompactSchedulerLimit(t *testing.T) {
+	cs := newCompactScheduler(1, 1000, 0)
+
+	a, _, err := cs.start("tmp/a" + BUCKET_DIR_SUFFIX + "/0-0.store")
+	if err != nil {
+		t.Fatalf("expected start to work, got: %v", err)
+	}
+	if a.Info().Bucket != "a" || a.Info().Status != compactRunning {
+		t.Errorf("unexpected task info: %#v", a.Info())
+	}
+
+	startedB := make(chan error)
+	go func() {
+		b, _, err := cs.start("tmp/b" + BUCKET_DIR_SUFFIX + "/0-0.store")
+		if err == nil {
+			cs.done(b, nil)
+		}
+		startedB <- err
+	}()
+	for i := 0; i < 100 && len(cs.list()) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	tasks := cs.list()
+	if len(tasks) != 2 || tasks[1].Status != compactQueued {
+		t.Fatalf("expected second task to be queued, got: %#v", tasks)
+	}
+	if n := cs.cancelBucket("b"); n != 1 {
+		t.Errorf("expected 1 cancelled task, got: %v", n)
+	}
+	if err = <-startedB; err != compactCancelledErr {
+		t.Errorf("expected queued task to be cancelled, got: %v", err)
+	}
+
+	cs.done(a, nil)
+	tasks = cs.list()
+	if tasks[0].Status != compactDone || tasks[1].Status != compactCancelled {
+		t.Errorf("unexpected task statuses: %#v", tasks)
+	}
+	if a.Cancel() || a.Pause() || a.Resume() {
+		t.Errorf("expected finished task to not be changeable")
+	}
+}
+
+func TestCompactPauseResumeCancel(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, 0)
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	prevCompactTasks := compactTasks
+	compactTasks = newCompactScheduler(1, 1, 0)
+	defer func() { compactTasks = prevCompactTasks }()
+
+	r0 := &reqHandler{currentBucket: bucket}
+	testLoadInts(t, r0, 0, 20)
+	if err := bucket.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+
+	// Starts a compaction that's paused at its first checkpoint.
+	startPaused := func() (chan error, string) {
+		blocker, _, _ := compactTasks.start("blocker")
+		compacted := make(chan error)
+		go func() { compacted <- bucket.Compact() }()
+		var id string
+		for i := 0; i < 1000 && id == ""; i++ {
+			for _, info := range compactTasks.list() {
+				if info.Status == compactQueued {
+					id = info.Id
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if !compactTasks.get(id).Pause() {
+			t.Fatalf("expected queued task to be pausable")
+		}
+		compactTasks.done(blocker, nil)
+		for i := 0; i < 1000; i++ {
+			if compactTasks.get(id).Info().ItemsCopied > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		info := compactTasks.get(id).Info()
+		if info.Status != compactPaused || info.ItemsCopied != 1 {
+			t.Fatalf("expected compaction to be paused, got: %#v", info)
+		}
+		return compacted, id
+	}
+
+	compacted, id := startPaused()
+
+	// Flushing continues while compaction is paused.
+	testLoadInts(t, r0, 0, 5)
+	if err := bucket.Flush(); err != nil {
+		t.Errorf("expected Flush during compaction to work, got: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/pools/default/tasks", nil)
+	mr.ServeHTTP(rr, r)
+	tasks := []map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tasks); err != nil {
+		t.Errorf("expected tasks JSON, got: %v, %v", err, rr.Body.String())
+	}
+	if len(tasks) != 1 || tasks[0]["taskId"] != id ||
+		tasks[0]["status"] != compactPaused {
+		t.Errorf("expected a paused task, got: %#v", tasks)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/compactions/"+id+"/resume", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected resume to work, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	if err := <-compacted; err != nil {
+		t.Errorf("expected resumed compaction to work, got: %v", err)
+	}
+	if compactTasks.get(id).Info().Status != compactDone {
+		t.Errorf("expected compaction to be done, got: %#v",
+			compactTasks.get(id).Info())
+	}
+	testExpectInts(t, r0, 0, []int{0, 1, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		2, 3, 4, 5, 6, 7, 8, 9}, "after resumed compaction")
+
+	compacted, id = startPaused()
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "http://127.0.0.1/pools/default/buckets/"+
+		"default/controller/cancelBucketCompaction", nil)
+	mr.ServeHTTP(rr, r)
+	if err := <-compacted; err != compactCancelledErr {
+		t.Errorf("expected cancelled compaction, got: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/compactions/"+id+"/resume", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 409 {
+		t.Errorf("expected resume of a cancelled task to fail, got: %v", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/compactions/no-such-task/pause", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 404 {
+		t.Errorf("expected pause of unknown task to fail, got: %v", rr.Code)
+	}
+
+	bs := bucket.(*livebucket).GetBucketStore(0)
+	if bs.Stats().Compacts != 1 || bs.Stats().CompactErrors != 0 {
+		t.Errorf("expected cancel to not count as a compaction or error, got: %#v",
+			bs.Stats())
+	}
+	if _, err := os.Stat(bs.BSF().path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("expected cancelled compaction file to be removed, got: %v", err)
+	}
+	testExpectInts(t, r0, 0, []int{0, 1, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		2, 3, 4, 5, 6, 7, 8, 9}, "after cancelled compaction")
+}
+
+func TestPausedCompactionDoesNotBlockFlushes(t *testing.T) {
+	prevCompactMinFileSize := compactMinFileSize
+	compactMinFileSize = 0
+	defer func() { compactMinFileSize = prevCompactMinFileSize }()
+
+	prevCompactTasks := compactTasks
+	compactTasks = newCompactScheduler(1, 1, 0)
+	defer func() { compactTasks = prevCompactTasks }()
+
+	var dirs []string
+	defer func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}()
+	newTestBucket := func(settings *BucketSettings) (*reqHandler, *bucketstore) {
+		d, _ := ioutil.TempDir("./tmp", "test")
+		dirs = append(dirs, d)
+		b, err := NewBucket(d, settings)
+		if err != nil {
+			t.Fatalf("expected NewBucket to work, got: %v", err)
+		}
+		v, _ := b.CreateVBucket(2)
+		b.SetVBState(2, VBActive)
+		return &reqHandler{currentBucket: b}, v.bs
+	}
+	// Persists like the persistRunner would, which mustn't get stuck.
+	persist := func(bs *bucketstore) {
+		persisted := make(chan bool)
+		go func() {
+			bs.periodicPersist(time.Now())
+			close(persisted)
+		}()
+		select {
+		case <-persisted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected periodicPersist to not get stuck")
+		}
+	}
+
+	rA, bsA := newTestBucket(&BucketSettings{
+		NumPartitions:        MAX_VBUCKETS,
+		CompactFragmentation: 30,
+	})
+	defer rA.currentBucket.Close()
+	rB, bsB := newTestBucket(&BucketSettings{NumPartitions: MAX_VBUCKETS})
+	defer rB.currentBucket.Close()
+
+	for i := 0; i < 50; i++ {
+		testLoadInts(t, rA, 2, 5)
+		if _, err := bsA.Flush(); err != nil {
+			t.Fatalf("expected Flush (loop) to work, got: %v", err)
+		}
+	}
+
+	// Bucket A's scheduled compaction waits for a slot, so it's
+	// queued, and then it's paused at its first checkpoint.
+	blocker, _, _ := compactTasks.start("blocker")
+	persist(bsA)
+	var id string
+	for i := 0; i < 1000 && id == ""; i++ {
+		for _, info := range compactTasks.list() {
+			if info.Status == compactQueued {
+				id = info.Id
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if id == "" || !compactTasks.get(id).Pause() {
+		t.Fatalf("expected a queued, pausable compaction, got: %#v",
+			compactTasks.list())
+	}
+	compactTasks.done(blocker, nil)
+	for i := 0; i < 1000 && compactTasks.get(id).Info().ItemsCopied == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if info := compactTasks.get(id).Info(); info.Status != compactPaused ||
+		info.ItemsCopied != 1 {
+		t.Fatalf("expected compaction to be paused, got: %#v", info)
+	}
+
+	// Bucket B still flushes, as does bucket A, on the side.
+	testLoadInts(t, rB, 2, 5)
+	flushesB := bsB.Stats().Flushes
+	persist(bsB)
+	if bsB.Stats().Flushes != flushesB+1 ||
+		atomic.LoadInt64(&bsB.dirtiness) != 0 {
+		t.Errorf("expected other bucket to flush, got: %#v", bsB.Stats())
+	}
+	testLoadInts(t, rA, 2, 7)
+	flushesA := bsA.Stats().Flushes
+	persist(bsA)
+	for i := 0; i < 1000 && bsA.Stats().Flushes == flushesA; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if bsA.Stats().Flushes == flushesA {
+		t.Errorf("expected flush during paused compaction, got: %#v",
+			bsA.Stats())
+	}
+
+	compactTasks.get(id).Resume()
+	for i := 0; i < 1000 && atomic.LoadInt64(&bsA.lastCompactFileSize) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if bsA.Stats().Compacts != 1 || bsA.Stats().CompactErrors != 0 {
+		t.Errorf("expected resumed compaction to work, got: %#v", bsA.Stats())
+	}
+	testExpectInts(t, rA, 2, []int{0, 1, 2, 3, 4, 5, 6},
+		"after paused compaction")
+	testExpectInts(t, rB, 2, []int{0, 1, 2, 3, 4}, "other bucket")
+}
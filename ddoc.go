@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"unsafe"
 
@@ -13,9 +19,37 @@ import (
 type DDocs map[string]*DDoc
 
 type DDoc struct {
-	Language string       `json:"language,omitempty"`
-	Views    Views        `json:"views,omitempty"`
-	Options  *DDocOptions `json:"options,omitempty"`
+	Language string            `json:"language,omitempty"`
+	Views    Views             `json:"views,omitempty"`
+	Spatial  map[string]string `json:"spatial,omitempty"` // Map functions.
+	Options  *DDocOptions      `json:"options,omitempty"`
+
+	spatialViews Views // Of the Spatial map functions, see parseDDoc().
+}
+
+// Parses a design doc, preparing its spatial map functions as views.
+func parseDDoc(data []byte) (*DDoc, error) {
+	ddoc := &DDoc{}
+	if err := json.Unmarshal(data, ddoc); err != nil {
+		return nil, err
+	}
+	if len(ddoc.Spatial) > 0 {
+		ddoc.spatialViews = Views{}
+		for viewId, src := range ddoc.Spatial {
+			ddoc.spatialViews[viewId] = &View{Map: src, spatial: true}
+		}
+	}
+	return ddoc, nil
+}
+
+// Visits the views of a design doc, then its spatial views.
+func (d *DDoc) visitViews(visitor func(viewId string, view *View)) {
+	for viewId, view := range d.Views {
+		visitor(viewId, view)
+	}
+	for viewId, view := range d.spatialViews {
+		visitor(viewId, view)
+	}
 }
 
 type DDocOptions struct {
@@ -26,16 +60,30 @@ type DDocOptions struct {
 type Views map[string]*View
 
 type View struct {
-	Map    string `json:"map"`
-	Reduce string `json:"reduce,omitempty"`
+	Map      string        `json:"map"`
+	Pointers *ViewPointers `json:"pointers,omitempty"` // Instead of Map.
+	Reduce   string        `json:"reduce,omitempty"`
 
-	preparedViewMapFunction *ViewMapFunction
+	functions *viewFunctions // Shared by the views of the same hash.
+	spatial   bool           // Emits geometries, see view_spatial.go.
 }
 
+// The most rows that a map function may emit for one doc, where 0
+// means no limit, so a runaway map function can't eat up the memory.
+var viewMaxEmits = 1000
+
 type ViewMapFunction struct {
 	otto         *otto.Otto
 	mapf         otto.Value
 	restartEmits func() (resEmits []*ViewRow, resEmitErr error)
+	halted       bool // When a call was cut short, see OttoCall().
+}
+
+type ViewReduceFunction struct {
+	builtin *builtinReducer // Instead of otto, for "_sum", etc.
+	otto    *otto.Otto
+	reducef otto.Value
+	halted  bool
 }
 
 func (b *livebucket) GetDDocVBucket() *VBucket {
@@ -54,6 +102,7 @@ func (b *livebucket) GetDDoc(ddocId string) ([]byte, error) {
 }
 
 func (b *livebucket) SetDDoc(ddocId string, body []byte) error {
+	prev := b.GetDDocs()
 	res := vbMutate(b.vbucketDDoc, nil, &gomemcached.MCRequest{
 		Opcode: gomemcached.SET,
 		Key:    []byte(ddocId),
@@ -62,9 +111,153 @@ func (b *livebucket) SetDDoc(ddocId string, body []byte) error {
 	if res.Status != gomemcached.SUCCESS {
 		return fmt.Errorf("set ddoc failed: %v, status: %v", ddocId, res.Status)
 	}
+	return b.ddocsChanged(prev)
+}
+
+func (b *livebucket) DelDDoc(ddocId string) error {
+	prev := b.GetDDocs()
+	res := vbMutate(b.vbucketDDoc, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte(ddocId),
+	})
+	if res.Status == gomemcached.KEY_ENOENT {
+		return ddocNotFound
+	}
+	if res.Status != gomemcached.SUCCESS {
+		return fmt.Errorf("delete ddoc failed: %v, status: %v", ddocId, res.Status)
+	}
+	return b.ddocsChanged(prev)
+}
+
+var ddocNotFound = errors.New("ddoc not found")
+
+// Updates the views indexes after a design doc change, given the
+// design docs from before the change.  Identical views share an
+// index, so a vbucket only rebuilds its index when a view that's not
+// like any view it indexed before shows up, and only drops an index
+// once it has no view referencing it anymore.
+func (b *livebucket) ddocsChanged(prev *DDocs) error {
+	atomic.StorePointer(&b.ddocs, nil) // Reparsed on the next GetDDocs().
+	prevProd, prevDev := ddocsViews(prev)
+	nextProd, nextDev := ddocsViews(b.GetDDocs())
+	for vbid := range b.vbuckets {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb != nil {
+			err := vb.viewsScopeChanged(vb.viewsInScope(prevProd, prevDev),
+				vb.viewsInScope(nextProd, nextDev))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	b.pruneViewErrors(nextProd, nextDev)
+	b.pruneViewFunctions(nextProd, nextDev)
 	return nil
 }
 
+// Dev design docs, named "_design/dev_*", only index a subset of the
+// vbuckets (see the devSubsetPartitions bucket setting), so edits to
+// their views are quick to try out against big buckets.
+func isDevDDocId(ddocId string) bool {
+	return strings.HasPrefix(ddocId, "_design/dev_")
+}
+
+// Whether a vbucket is in the subset that dev design docs index,
+// which is spread evenly across the vbucket ids.
+func inDevSubset(vbid uint16, numPartitions, devSubsetPartitions int) bool {
+	if devSubsetPartitions <= 0 || devSubsetPartitions >= numPartitions {
+		return true
+	}
+	stride := numPartitions / devSubsetPartitions
+	return int(vbid)%stride == 0 && int(vbid)/stride < devSubsetPartitions
+}
+
+// A view to index, along with the names of one of the design doc
+// views that it's the hash of.
+type indexedView struct {
+	ddocId string
+	viewId string
+	view   *View
+}
+
+// Returns the distinct views of the design docs by view hash, split
+// into those of production design docs and those only in dev design
+// docs.
+func ddocsViews(ddocs *DDocs) (prod, dev map[string]*indexedView) {
+	prod = map[string]*indexedView{}
+	dev = map[string]*indexedView{}
+	if ddocs == nil {
+		return prod, dev
+	}
+	for ddocId, ddoc := range *ddocs {
+		ddocId := ddocId
+		ddoc.visitViews(func(viewId string, view *View) {
+			viewName := view.hash()
+			iv := &indexedView{ddocId: ddocId, viewId: viewId, view: view}
+			if !isDevDDocId(ddocId) {
+				prod[viewName] = iv
+				delete(dev, viewName)
+			} else if prod[viewName] == nil {
+				dev[viewName] = iv
+			}
+		})
+	}
+	return prod, dev
+}
+
+// Has the vbuckets outside of the dev subset index a dev view too, as
+// asked for by full_set=true queries.  Such a vbucket rebuilds its
+// index the first time.
+func devViewFullSet(bucket Bucket, ddocs *DDocs, viewName string) error {
+	prod, _ := ddocsViews(ddocs)
+	if prod[viewName] != nil {
+		return nil // Already indexed by every vbucket.
+	}
+	settings := bucket.GetBucketSettings()
+	for vbid := 0; vbid < settings.NumPartitions; vbid++ {
+		if inDevSubset(uint16(vbid), settings.NumPartitions,
+			settings.devSubsetPartitions()) {
+			continue
+		}
+		vb, _ := bucket.GetVBucket(uint16(vbid))
+		if vb != nil {
+			if err := vb.addViewFullSet(viewName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copies a dev design doc to its production name, so that
+// "_design/dev_foo" becomes "_design/foo".  As identical views share
+// indexes, only the vbuckets that didn't index the dev views yet
+// have to build them.
+func publishDDoc(bucket Bucket, ddocId string) error {
+	if !isDevDDocId(ddocId) {
+		return fmt.Errorf("not a dev design doc: %v", ddocId)
+	}
+	body, err := bucket.GetDDoc(ddocId)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return ddocNotFound
+	}
+	prodId := "_design/" + strings.TrimPrefix(ddocId, "_design/dev_")
+	var into map[string]interface{}
+	if err = json.Unmarshal(body, &into); err != nil {
+		return err
+	}
+	if _, ok := into["_id"]; ok {
+		into["_id"] = prodId
+		if body, err = json.Marshal(into); err != nil {
+			return err
+		}
+	}
+	return bucket.SetDDoc(prodId, body)
+}
+
 func (b *livebucket) VisitDDocs(start []byte,
 	visitor func(key []byte, data []byte) bool) error {
 	return b.vbucketDDoc.Visit(start, visitor)
@@ -75,20 +268,23 @@ func (b *livebucket) GetDDocs() *DDocs {
 	if ddocs == nil {
 		for {
 			ddocs = &DDocs{}
-			var errJson error
 			var errVisit error
 			errVisit = b.VisitDDocs(nil, func(key []byte, data []byte) bool {
-				ddoc := &DDoc{}
-				errJson = json.Unmarshal(data, ddoc)
-				if errJson != nil {
-					// TODO: Perhaps should continue on with rest of ddocs
-					// if any ddoc fails to parse; and log the error somewhere.
-					return false
+				ddoc, err := parseDDoc(data)
+				if err != nil {
+					// One bad design doc, as from before PUT's were
+					// checked, shouldn't take down all the others.
+					log.Printf("skipping unparsable design doc: %q, err: %v",
+						key, err)
+					return true
 				}
+				ddoc.visitViews(func(viewId string, view *View) {
+					view.functions = b.viewFunctions(view.hash())
+				})
 				(*ddocs)[string(key)] = ddoc
 				return true
 			})
-			if errVisit != nil || errJson != nil {
+			if errVisit != nil {
 				return nil
 			}
 			if b.SetDDocs(nil, ddocs) {
@@ -104,9 +300,185 @@ func (b *livebucket) SetDDocs(old, val *DDocs) bool {
 		unsafe.Pointer(old), unsafe.Pointer(val))
 }
 
+// The index status of a design doc's views, as /{db}/_design/{docId}/_info
+// reports it.
+type DDocInfo struct {
+	Name    string                    `json:"name"`
+	Views   map[string]*ViewIndexInfo `json:"views"`
+	Spatial map[string]*ViewIndexInfo `json:"spatial,omitempty"`
+}
+
+type ViewIndexInfo struct {
+	Hash      string                      `json:"hash"`
+	VBuckets  map[string]*ViewVBucketInfo `json:"vbuckets"`
+	DiskSize  uint64                      `json:"disk_size"` // Of index items.
+	LastError *ViewError                  `json:"last_error,omitempty"`
+}
+
+// The index status of a vbucket that indexes a view, where the
+// staleness counts the vbucket's changes that aren't indexed yet.
+type ViewVBucketInfo struct {
+	IndexedSeq uint64 `json:"indexed_seq"`
+	Staleness  int64  `json:"staleness"`
+}
+
+// Returns the index status of a design doc's views, over the vbuckets
+// that index them, or nil if there's no such design doc.
+func ddocInfo(bucket Bucket, ddocId string) (*DDocInfo, error) {
+	ddocs := bucket.GetDDocs()
+	if ddocs == nil || (*ddocs)[ddocId] == nil {
+		return nil, nil
+	}
+	prod, dev := ddocsViews(ddocs)
+	rv := &DDocInfo{
+		Name:  strings.TrimPrefix(ddocId, "_design/"),
+		Views: map[string]*ViewIndexInfo{},
+	}
+	ddoc := (*ddocs)[ddocId]
+	for viewId, view := range ddoc.Views {
+		vi, err := viewIndexInfo(bucket, prod, dev, view)
+		if err != nil {
+			return nil, err
+		}
+		rv.Views[viewId] = vi
+	}
+	for viewId, view := range ddoc.spatialViews {
+		vi, err := viewIndexInfo(bucket, prod, dev, view)
+		if err != nil {
+			return nil, err
+		}
+		if rv.Spatial == nil {
+			rv.Spatial = map[string]*ViewIndexInfo{}
+		}
+		rv.Spatial[viewId] = vi
+	}
+	return rv, nil
+}
+
+func viewIndexInfo(bucket Bucket, prod, dev map[string]*indexedView,
+	view *View) (*ViewIndexInfo, error) {
+	viewName := view.hash()
+	vi := &ViewIndexInfo{
+		Hash:     viewName,
+		VBuckets: map[string]*ViewVBucketInfo{},
+	}
+	if errs := bucket.GetViewErrors(viewName); len(errs) > 0 {
+		vi.LastError = errs[len(errs)-1]
+	}
+	for vbid := 0; vbid < bucket.GetBucketSettings().NumPartitions; vbid++ {
+		vb, _ := bucket.GetVBucket(uint16(vbid))
+		if vb == nil || vb.viewsInScope(prod, dev)[viewName] == nil {
+			continue
+		}
+		seq, err := vb.viewsIndexedSeq()
+		if err != nil {
+			return nil, err
+		}
+		for _, collName := range []string{
+			viewIndexCollName(vb.vbid, viewName),
+			viewReduceCollName(vb.vbid, viewName),
+		} {
+			_, n, err := vb.viewCollTotals(collName)
+			if err != nil {
+				return nil, err
+			}
+			vi.DiskSize += n
+		}
+		vi.VBuckets[strconv.Itoa(vbid)] = &ViewVBucketInfo{
+			IndexedSeq: seq,
+			Staleness:  atomic.LoadInt64(&vb.staleness),
+		}
+	}
+	return vi, nil
+}
+
+// Validates the body of a design doc that's being PUT, so that a
+// broken view is refused up front, rather than failing its queries.
+func checkDDoc(body []byte) (*DDoc, error) {
+	ddoc, err := parseDDoc(body)
+	if err != nil {
+		return nil, fmt.Errorf("bad design doc: %v", err)
+	}
+	if ddoc.Language != "" && ddoc.Language != "javascript" {
+		return nil, fmt.Errorf("unsupported design doc language: %q",
+			ddoc.Language)
+	}
+	for viewId, view := range ddoc.Views {
+		if view == nil {
+			return nil, fmt.Errorf("view %q: not an object", viewId)
+		}
+		if err := view.check(); err != nil {
+			return nil, fmt.Errorf("view %q: %v", viewId, err)
+		}
+	}
+	for viewId, view := range ddoc.spatialViews {
+		if err := view.check(); err != nil {
+			return nil, fmt.Errorf("spatial view %q: %v", viewId, err)
+		}
+	}
+	return ddoc, nil
+}
+
+// Checks that a view's map function (or pointers) and reduce function
+// compile, where a reduce function named like "_sum" must be one of
+// the built-in reducers.
+func (v *View) check() error {
+	switch {
+	case v.Map != "" && v.Pointers != nil:
+		return fmt.Errorf("both map and pointers")
+	case v.Pointers != nil:
+		if _, _, err := v.Pointers.keyPointers(); err != nil {
+			return err
+		}
+	default:
+		if _, err := v.GetViewMapFunction(); err != nil {
+			return err
+		}
+	}
+	if v.Reduce == "" {
+		return nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(v.Reduce), "_") &&
+		findBuiltinReducer(v.Reduce) == nil {
+		return fmt.Errorf("unknown built-in reducer: %q", v.Reduce)
+	}
+	_, err := v.GetViewReduceFunction()
+	return err
+}
+
+// Identifies a view by its map function (or pointers), reduce
+// function and whether it's spatial, so views that differ only in
+// surrounding whitespace have the same hash and share an index.
+func (v *View) hash() string {
+	h := sha1.New()
+	h.Write([]byte(normalizeViewSource(v.Map)))
+	h.Write([]byte{0})
+	h.Write([]byte(normalizeViewSource(v.Reduce)))
+	if v.Pointers != nil {
+		j, _ := json.Marshal(v.Pointers)
+		h.Write([]byte{0})
+		h.Write(j)
+	}
+	if v.spatial {
+		h.Write([]byte("\x00spatial"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Only trims the surrounding whitespace, as whitespace within the
+// source can't be normalized safely without parsing it: a line break
+// ends a // comment and may end a statement, and regex literals and
+// comments hide where string literals are.
+func normalizeViewSource(src string) string {
+	return strings.TrimSpace(src)
+}
+
+// Returns a prepared map function of the view from its pool, or else
+// a newly compiled one, which the caller may only use on one
+// goroutine and should hand back with PutViewMapFunction().
 func (v *View) GetViewMapFunction() (*ViewMapFunction, error) {
-	if v.preparedViewMapFunction != nil {
-		return v.preparedViewMapFunction, nil
+	if f := v.functions.getMap(); f != nil {
+		return f, nil
 	}
 
 	if v.Map == "" {
@@ -123,6 +495,13 @@ func (v *View) GetViewMapFunction() (*ViewMapFunction, error) {
 	var emitErr error
 
 	o.Set("emit", func(call otto.FunctionCall) otto.Value {
+		if emitErr != nil {
+			return otto.UndefinedValue() // The doc's emits are dropped.
+		}
+		if viewMaxEmits > 0 && len(emits) >= viewMaxEmits {
+			emitErr = fmt.Errorf("more than %v emits for one doc", viewMaxEmits)
+			return otto.UndefinedValue()
+		}
 		if len(call.ArgumentList) <= 0 {
 			emitErr = fmt.Errorf("emit() invoked with no parameters")
 			return otto.UndefinedValue()
@@ -142,7 +521,7 @@ func (v *View) GetViewMapFunction() (*ViewMapFunction, error) {
 		return otto.UndefinedValue()
 	})
 
-	v.preparedViewMapFunction = &ViewMapFunction{
+	return &ViewMapFunction{
 		otto: o,
 		mapf: mapf,
 		restartEmits: func() (resEmits []*ViewRow, resEmitErr error) {
@@ -152,6 +531,94 @@ func (v *View) GetViewMapFunction() (*ViewMapFunction, error) {
 			emitErr = nil
 			return resEmits, resEmitErr
 		},
+	}, nil
+}
+
+// Hands back a map function for reuse, unless a call of its VM was
+// halted (by a timeout or a panic), which may have left the VM in a
+// bad state, so it's dropped instead.
+func (v *View) PutViewMapFunction(f *ViewMapFunction) {
+	if !f.halted {
+		v.functions.putMap(f)
+	}
+}
+
+// Like GetViewMapFunction(), but for the reduce function, which
+// should be handed back with PutViewReduceFunction().
+func (v *View) GetViewReduceFunction() (*ViewReduceFunction, error) {
+	if f := v.functions.getReduce(); f != nil {
+		return f, nil
+	}
+
+	if v.Reduce == "" {
+		return nil, fmt.Errorf("view reduce function missing")
+	}
+	if builtin := findBuiltinReducer(v.Reduce); builtin != nil {
+		return &ViewReduceFunction{builtin: builtin}, nil
+	}
+
+	o := newReducer()
+	reducef, err := OttoNewFunction(o, v.Reduce)
+	if err != nil {
+		return nil, fmt.Errorf("view reduce function error: %v", err)
+	}
+
+	return &ViewReduceFunction{
+		otto:    o,
+		reducef: reducef,
+	}, nil
+}
+
+// Like PutViewMapFunction(), for reduce functions.
+func (v *View) PutViewReduceFunction(f *ViewReduceFunction) {
+	if !f.halted {
+		v.functions.putReduce(f)
+	}
+}
+
+// Invokes the reduce function, where the keys are ignored when
+// rereducing previous reductions.
+func (r *ViewReduceFunction) reduce(keys, values []interface{},
+	rereduce bool) (interface{}, error) {
+	if r.builtin != nil {
+		res, err := r.builtin.reduce(keys, values, rereduce)
+		if err != nil {
+			return nil, fmt.Errorf("reduce err: %v, values: %v", err, values)
+		}
+		return res, nil
+	}
+	okeys := otto.NullValue()
+	orereduce := otto.TrueValue()
+	if !rereduce {
+		var err error
+		okeys, err = OttoFromGoArray(r.otto, keys)
+		if err != nil {
+			return nil, err
+		}
+		orereduce = otto.FalseValue()
+	}
+	ovalues, err := OttoFromGoArray(r.otto, values)
+	if err != nil {
+		return nil, err
+	}
+	r.halted = true // Until the call returns, as a panic leaves it so.
+	ores, err := OttoCall(r.otto, r.reducef, okeys, ovalues, orereduce)
+	_, r.halted = err.(*jsTimeoutError)
+	if err != nil {
+		return nil, fmt.Errorf("call reduce err: %v, values: %v", err, values)
+	}
+	res, err := ores.Export()
+	if err != nil {
+		return nil, fmt.Errorf("converting reduce result err: %v", err)
+	}
+	return res, nil
+}
+
+// Turns a final reduction into a query result, which only some
+// built-in reducers need.
+func (r *ViewReduceFunction) finalize(value interface{}) (interface{}, error) {
+	if r.builtin == nil || r.builtin.finalize == nil {
+		return value, nil
 	}
-	return v.preparedViewMapFunction, nil
+	return r.builtin.finalize(value)
 }
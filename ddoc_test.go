@@ -2,9 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetSetDDoc(t *testing.T) {
@@ -120,3 +126,408 @@ func TestGetSetDDocs(t *testing.T) {
 		t.Errorf("expected get ddocs to be e")
 	}
 }
+
+func TestViewHash(t *testing.T) {
+	v0 := &View{Map: "function(doc) { emit(doc.a, null); }"}
+	v1 := &View{Map: "  function(doc) { emit(doc.a, null); }\n"}
+	if v0.hash() != v1.hash() {
+		t.Errorf("expected views differing in surrounding whitespace to hash the same")
+	}
+	v2 := &View{Map: "function(doc) { emit(doc.a, null); }", Reduce: "_count"}
+	if v0.hash() == v2.hash() {
+		t.Errorf("expected a reduce function to change the hash")
+	}
+	v3 := &View{Map: `function(doc) { emit("a  b", null); }`}
+	v4 := &View{Map: `function(doc) { emit("a b", null); }`}
+	if v3.hash() == v4.hash() {
+		t.Errorf("expected whitespace in strings to change the hash")
+	}
+	// Line breaks end comments, and may end statements.
+	for _, srcs := range [][2]string{
+		{"function(doc) { emit(doc.a); // x\nemit(doc.b); }",
+			"function(doc) { emit(doc.a); // x emit(doc.b); }"},
+		{"function(doc) { var f = function() { return\ndoc.a; }; emit(f(), null); }",
+			"function(doc) { var f = function() { return doc.a; }; emit(f(), null); }"},
+		{"function(doc) { emit(doc.a.match(/' '/), '  '); }",
+			"function(doc) { emit(doc.a.match(/' '/), ' '); }"},
+	} {
+		if (&View{Map: srcs[0]}).hash() == (&View{Map: srcs[1]}).hash() {
+			t.Errorf("expected different hashes for: %q and %q", srcs[0], srcs[1])
+		}
+	}
+}
+
+func TestSharedViewIndexes(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	ddoc0 := `{"views":{"v":{"map":"function(doc) { emit(doc.amount, null); }"}}}`
+	ddoc1 := `{"views":{"w":{"map":" function(doc) { emit(doc.amount, null); }\n"}}}`
+	if err := bucket.SetDDoc("_design/d0", []byte(ddoc0)); err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"amount":1}`), VBActive)
+	vb, _ := bucket.GetVBucket(0)
+	if _, err := vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	vs := vb.openedViewsStore()
+	viewName := testViewHash(t, bucket, "_design/d0", "v")
+
+	// An identical view shares the index, which isn't rebuilt.
+	if err := bucket.SetDDoc("_design/d1", []byte(ddoc1)); err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	if testViewHash(t, bucket, "_design/d1", "w") != viewName {
+		t.Errorf("expected identical views to share a hash")
+	}
+	if vb.openedViewsStore() != vs {
+		t.Errorf("expected the views store to be kept")
+	}
+	vr := testGetViewRows(t, mr,
+		"http://127.0.0.1/default/_design/d1/_view/w?stale=ok")
+	if len(vr.Rows) != 1 || vr.Rows[0].Id != "a" {
+		t.Errorf("expected the shared index to answer, got: %#v", vr.Rows)
+	}
+
+	hasIndex := func() bool {
+		return vs.BSFData().store.GetCollection(
+			viewIndexCollName(0, viewName)) != nil
+	}
+	del := func(ddocId string, expectedCode int) {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("DELETE",
+			"http://127.0.0.1/default/_design/"+ddocId, nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != expectedCode {
+			t.Errorf("expected delete of %v to %v, got: %#v",
+				ddocId, expectedCode, rr)
+		}
+	}
+
+	// The index is dropped once its last view is deleted.
+	del("d0", 200)
+	if !hasIndex() {
+		t.Errorf("expected the index to be kept while still referenced")
+	}
+	del("d1", 200)
+	if hasIndex() {
+		t.Errorf("expected the unreferenced index to be dropped")
+	}
+	del("d1", 404)
+}
+
+func TestInDevSubset(t *testing.T) {
+	tests := []struct {
+		numPartitions, devSubsetPartitions int
+		expected                           []uint16
+	}{
+		{8, 0, []uint16{0, 1, 2, 3, 4, 5, 6, 7}},
+		{8, 8, []uint16{0, 1, 2, 3, 4, 5, 6, 7}},
+		{8, 2, []uint16{0, 4}},
+		{8, 3, []uint16{0, 2, 4}},
+		{8, 1, []uint16{0}},
+	}
+	for _, test := range tests {
+		got := []uint16{}
+		for vbid := 0; vbid < test.numPartitions; vbid++ {
+			if inDevSubset(uint16(vbid), test.numPartitions,
+				test.devSubsetPartitions) {
+				got = append(got, uint16(vbid))
+			}
+		}
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", test.expected) {
+			t.Errorf("expected dev subset %v for %v of %v, got: %v",
+				test.expected, test.devSubsetPartitions, test.numPartitions, got)
+		}
+	}
+	if !isDevDDocId("_design/dev_foo") || isDevDDocId("_design/foo") {
+		t.Errorf("expected only _design/dev_* to be dev design docs")
+	}
+}
+
+func TestDevDDocs(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+	bucket.GetBucketSettings().DevSubsetPartitions = 1 // Just vbucket 0.
+
+	for i := 0; i < 10; i++ {
+		SetItem(bucket, []byte(fmt.Sprintf("k%v", i)),
+			[]byte(fmt.Sprintf(`{"n":%v}`, i)), VBActive)
+	}
+	vb0, _ := bucket.GetVBucket(0)
+	vb1, _ := bucket.GetVBucket(1)
+	n0, _, _ := vb0.ps.getTotals()
+	if n0 == 0 || n0 == 10 {
+		t.Fatalf("expected items in both vbuckets, got: %v in vbucket 0", n0)
+	}
+
+	err := bucket.SetDDoc("_design/dev_d",
+		[]byte(`{"_id":"_design/dev_d",`+
+			`"views":{"v":{"map":"function(doc) { emit(doc.n, null); }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+
+	url := "http://127.0.0.1/default/_design/"
+	vr := testGetViewRows(t, mr, url+"dev_d/_view/v")
+	if uint64(len(vr.Rows)) != n0 {
+		t.Errorf("expected only rows of the dev subset, got: %#v", vr.Rows)
+	}
+	if vb1.openedViewsStore() != nil {
+		t.Errorf("expected no views index outside of the dev subset")
+	}
+	vr = testGetViewRows(t, mr, url+"dev_d/_view/v?full_set=true")
+	if len(vr.Rows) != 10 {
+		t.Errorf("expected rows of every vbucket, got: %#v", vr.Rows)
+	}
+
+	publish := func(ddocId string, expectedCode int) {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/_api/buckets/default/ddocs/"+
+			ddocId+"/publish", nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != expectedCode {
+			t.Errorf("expected publish of %v to %v, got: %#v",
+				ddocId, expectedCode, rr)
+		}
+	}
+	publish("dev_d", 200)
+	publish("d", 400)
+	publish("dev_none", 404)
+
+	body, err := bucket.GetDDoc("_design/d")
+	if err != nil || !bytes.Contains(body, []byte(`"_id":"_design/d"`)) {
+		t.Errorf("expected the published ddoc, got: %s, err: %v", body, err)
+	}
+	vr = testGetViewRows(t, mr, url+"d/_view/v")
+	if len(vr.Rows) != 10 {
+		t.Errorf("expected rows of every vbucket, got: %#v", vr.Rows)
+	}
+}
+
+func TestViewMapSandbox(t *testing.T) {
+	defer func(timeout time.Duration, maxEmits int) {
+		jsTimeout, viewMaxEmits = timeout, maxEmits
+	}(jsTimeout, viewMaxEmits)
+	jsTimeout, viewMaxEmits = 50*time.Millisecond, 10
+
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0", []byte(`{"views":{"v":{"map":`+
+		`"function(doc) { if (doc.loop) { while (true) {} }`+
+		` for (var i = 0; i < doc.n; i++) { emit(i, null); } }"},`+
+		`"w":{"map":"function(doc) { emit(doc.loop || false, null); }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"n":2}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"n":20}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"loop":true}`), VBActive)
+
+	// The docs that the map function fails on are left out.
+	url := "http://127.0.0.1/default/_design/d0/_view/v"
+	vr := testGetViewRows(t, mr, url)
+	if len(vr.Rows) != 2 || vr.Rows[0].Id != "a" || vr.Rows[1].Id != "a" {
+		t.Errorf("expected only the rows of the good doc, got: %#v", vr.Rows)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", url+"/_errors", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Fatalf("expected view errors to 200, got: %#v", rr)
+	}
+	res := struct{ Errors []*ViewError }{}
+	if err = json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected view errors json, got: %v", err)
+	}
+	if len(res.Errors) != 2 ||
+		res.Errors[0].DocId != "b" ||
+		!strings.Contains(res.Errors[0].Error, "emits") ||
+		res.Errors[1].DocId != "c" ||
+		!strings.Contains(res.Errors[1].Error, "timeout") ||
+		res.Errors[1].Time.IsZero() {
+		t.Errorf("expected the emits and timeout errors, got: %v",
+			rr.Body.String())
+	}
+
+	// A map function that keeps timing out is given up on, but only
+	// for its own view.
+	for i := 0; i <= maxViewTimeouts; i++ {
+		SetItem(bucket, []byte(fmt.Sprintf("loop%v", i)),
+			[]byte(`{"loop":true}`), VBActive)
+	}
+	vb, _ := bucket.GetVBucket(0)
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to skip the failing view, got: %v", err)
+	}
+	vr = testGetViewRows(t, mr, "http://127.0.0.1/default/_design/d0/_view/w")
+	if len(vr.Rows) != 3+maxViewTimeouts+1 {
+		t.Errorf("expected the other view to index every doc, got: %#v", vr.Rows)
+	}
+	v := (*bucket.GetDDocs())["_design/d0"].Views["v"]
+	errs := bucket.GetViewErrors(v.hash())
+	if len(errs) == 0 || errs[len(errs)-1].DocId != "" ||
+		!strings.Contains(errs[len(errs)-1].Error, "skipped") {
+		t.Errorf("expected the view to be marked as skipped, got: %#v", errs)
+	}
+
+	// VMs of halted calls aren't reused.
+	f0, _ := v.GetViewMapFunction()
+	f0.halted = true
+	v.PutViewMapFunction(f0)
+	if f1, _ := v.GetViewMapFunction(); f1 == f0 {
+		t.Errorf("expected a halted function to be dropped from the pool")
+	}
+}
+
+func TestViewFunctionPools(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	setDDoc := func(ddocId, body string) {
+		if err := bucket.SetDDoc(ddocId, []byte(body)); err != nil {
+			t.Fatalf("expected SetDDoc to work, got: %v", err)
+		}
+	}
+	getView := func(ddocId, viewId string) *View {
+		return (*bucket.GetDDocs())[ddocId].Views[viewId]
+	}
+	setDDoc("_design/d0", `{"views":{"v":{"map":"function(doc) { emit(1, 2); }",`+
+		`"reduce":"_count"}}}`)
+	setDDoc("_design/d1", `{"views":{"w":{"map":"function(doc) { emit(3, 4); }"}}}`)
+
+	// Functions in use aren't handed out twice, but are reused.
+	v := getView("_design/d0", "v")
+	f0, err := v.GetViewMapFunction()
+	if err != nil {
+		t.Fatalf("expected GetViewMapFunction to work, got: %v", err)
+	}
+	f1, _ := v.GetViewMapFunction()
+	if f0 == f1 || f0.otto == f1.otto {
+		t.Errorf("expected functions in use to have their own VMs")
+	}
+	v.PutViewMapFunction(f1)
+	if f2, _ := v.GetViewMapFunction(); f2 != f1 {
+		t.Errorf("expected a pooled function to be reused")
+	}
+	r0, _ := v.GetViewReduceFunction()
+	v.PutViewReduceFunction(r0)
+	if r1, _ := v.GetViewReduceFunction(); r1 != r0 {
+		t.Errorf("expected a pooled reduce function to be reused")
+	}
+
+	// A design doc change keeps the pools of the unchanged views,
+	// but not of the changed ones.
+	w := getView("_design/d1", "w")
+	g0, _ := w.GetViewMapFunction()
+	w.PutViewMapFunction(g0)
+	v.PutViewMapFunction(f0)
+	setDDoc("_design/d0", `{"views":{"v":{"map":"function(doc) { emit(5, 6); }"}}}`)
+	if getView("_design/d1", "w") == w {
+		t.Errorf("expected the design docs to be reparsed")
+	}
+	if g, _ := getView("_design/d1", "w").GetViewMapFunction(); g != g0 {
+		t.Errorf("expected the unchanged view to keep its pool")
+	}
+	if f, _ := getView("_design/d0", "v").GetViewMapFunction(); f == f0 {
+		t.Errorf("expected the changed view to get new functions")
+	}
+}
+
+func TestCouchPutDDocValidation(t *testing.T) {
+	d, _, _ := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"views":{"v":{"map":"function(doc) { emit(doc.a, null); }"}}}`, 201},
+		{`{"views":{"v":{"pointers":{"key":"/a"},"reduce":"_count"}}}`, 201},
+		{`{"views":{"v":{"map":"function(doc) { emit(doc.a, null); }",` +
+			`"reduce":"function(keys, values) { return values.length; }"}}}`, 201},
+		{`{"views":[]}`, 400},
+		{`{"views":{"v":{"map":7}}}`, 400},
+		{`{"views":{"v":{}}}`, 400},
+		{`{"views":{"v":{"map":"function(doc) { emit(doc.a, null); "}}}`, 400},
+		{`{"views":{"v":{"map":"not a function"}}}`, 400},
+		{`{"views":{"v":{"pointers":{"key":"a"}}}}`, 400},
+		{`{"views":{"v":{"map":"function(doc) {}","pointers":{"key":"/a"}}}}`, 400},
+		{`{"views":{"v":{"map":"function(doc) {}","reduce":"_median"}}}`, 400},
+		{`{"views":{"v":{"map":"function(doc) {}","reduce":"function( {"}}}`, 400},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "http://127.0.0.1/default/_design/d0",
+			bytes.NewBufferString(test.body))
+		mr.ServeHTTP(rr, r)
+		if rr.Code != test.code {
+			t.Errorf("expected PUT of %v to %v, got: %v, %v",
+				test.body, test.code, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestCouchDDocInfo(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0", []byte(`{"views":{`+
+		`"v":{"map":"function(doc) { emit(doc.a, null); }","reduce":"_count"},`+
+		`"w":{"map":"function(doc) { if (doc.a > 1) { throw 'big'; } }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"a":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"a":2}`), VBActive)
+
+	getInfo := func(url string, code int) *DDocInfo {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != code {
+			t.Fatalf("expected %v to %v, got: %#v", url, code, rr)
+		}
+		info := &DDocInfo{}
+		if code == 200 {
+			if err := json.Unmarshal(rr.Body.Bytes(), info); err != nil {
+				t.Fatalf("expected _info json, got: %v", err)
+			}
+		}
+		return info
+	}
+	getInfo("http://127.0.0.1/default/_design/none/_info", 404)
+
+	url := "http://127.0.0.1/default/_design/d0/_info"
+	info := getInfo(url, 200)
+	if info.Name != "d0" || len(info.Views) != 2 ||
+		info.Views["v"].VBuckets["0"] == nil ||
+		info.Views["v"].VBuckets["0"].Staleness == 0 {
+		t.Errorf("expected a stale index before any query, got: %#v", info)
+	}
+
+	vb, _ := bucket.GetVBucket(0)
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Fatalf("expected viewsRefresh to work, got: %v", err)
+	}
+	info = getInfo(url, 200)
+	v, w := info.Views["v"], info.Views["w"]
+	if v.VBuckets["0"].Staleness != 0 || v.VBuckets["0"].IndexedSeq == 0 ||
+		v.DiskSize == 0 || v.LastError != nil {
+		t.Errorf("expected a caught up index, got: %#v, %#v", v, v.VBuckets["0"])
+	}
+	if w.LastError == nil || w.LastError.DocId != "b" ||
+		v.Hash == w.Hash {
+		t.Errorf("expected the last error of the view, got: %#v", w)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/couchbaselabs/cbgb/storefile"
+)
+
+// The encrypted file format is shared with the offline tools, in
+// the storefile package.
+var cryptWrongKey = storefile.ErrWrongKey
+var cryptNotEncrypted = storefile.ErrNotEncrypted
+
+// Wraps a FileLike so that everything written through it is
+// encrypted with the given key.  A new (empty) file gets a fresh
+// header; an existing file must have been written with the same key.
+func NewCryptFileLike(file FileLike, key []byte) (FileLike, error) {
+	return storefile.NewCryptFile(file, key)
+}
+
+// The directory of key files that buckets may pick by name, as
+// buckets made over REST may not name any other file or env var.
+var encryptionKeysDir = ""
+
+// Returns the encryption key configured for a bucket, or nil if the
+// bucket is not encrypted.  The key comes from a named key file in
+// the encryptionKeysDir, a key file or an environment variable, and
+// is either hex encoded (tried first) or raw bytes, for AES-128,
+// AES-192 or AES-256.
+func (bs *BucketSettings) loadEncryptionKey() ([]byte, error) {
+	if bs.EncryptionKeyName != "" {
+		if err := checkEncryptionKeyName(bs.EncryptionKeyName); err != nil {
+			return nil, err
+		}
+		return storefile.LoadKey(
+			path.Join(encryptionKeysDir, bs.EncryptionKeyName), "")
+	}
+	return storefile.LoadKey(bs.EncryptionKeyFile, bs.EncryptionKeyEnv)
+}
+
+func checkEncryptionKeyName(name string) error {
+	if encryptionKeysDir == "" {
+		return fmt.Errorf("no encryption keys dir for key name: %v", name)
+	}
+	if name == "" || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("bad encryption key name: %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbgb/storefile"
+)
+
+var testCryptKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestCryptFileLike(t *testing.T) {
+	fn := ",crypt-file-like-thing"
+	defer os.Remove(fn)
+
+	fs := NewFileService(1)
+	defer fs.Close()
+	f, err := fs.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_EXCL)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	cf, err := NewCryptFileLike(f, testCryptKey)
+	if err != nil {
+		t.Fatalf("Error wrapping file: %v", err)
+	}
+
+	secret := []byte("some secret customer data")
+	// Write at an offset that isn't block aligned.
+	n, err := cf.WriteAt(secret, 8195)
+	if err != nil || n != len(secret) {
+		t.Fatalf("Error writing: %v, n: %v", err, n)
+	}
+
+	fi, err := cf.Stat()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Size() != int64(8195+len(secret)) {
+		t.Errorf("Expected header to be hidden from size, got: %v", fi.Size())
+	}
+
+	raw, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading raw file: %v", err)
+	}
+	if bytes.Contains(raw, secret) {
+		t.Errorf("Expected no plaintext in raw file")
+	}
+
+	// Partial reads at any offset should decrypt correctly.
+	buf := make([]byte, 6)
+	n, err = cf.ReadAt(buf, 8195+5)
+	if err != nil || n != len(buf) {
+		t.Fatalf("Error reading: %v, n: %v", err, n)
+	}
+	if string(buf) != "secret" {
+		t.Errorf("Misread: %q", buf)
+	}
+
+	// Reopening with the same key works.
+	cf2, err := NewCryptFileLike(f, testCryptKey)
+	if err != nil {
+		t.Fatalf("Error rewrapping file: %v", err)
+	}
+	buf = make([]byte, len(secret))
+	if _, err = cf2.ReadAt(buf, 8195); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if !bytes.Equal(buf, secret) {
+		t.Errorf("Misread after reopen: %q", buf)
+	}
+
+	// A different key is rejected.
+	_, err = NewCryptFileLike(f, []byte("fedcba9876543210"))
+	if err != cryptWrongKey {
+		t.Errorf("Expected cryptWrongKey, got: %v", err)
+	}
+}
+
+func TestCryptFileLikeNotEncrypted(t *testing.T) {
+	fn := ",crypt-file-like-plain"
+	defer os.Remove(fn)
+
+	if err := ioutil.WriteFile(fn, []byte(strings.Repeat("x", 100)), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	fs := NewFileService(1)
+	defer fs.Close()
+	f, err := fs.OpenFile(fn, os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	_, err = NewCryptFileLike(f, testCryptKey)
+	if err != cryptNotEncrypted {
+		t.Errorf("Expected cryptNotEncrypted, got: %v", err)
+	}
+}
+
+func TestEncryptedBucketCompaction(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	keyFile := path.Join(testBucketDir, "key")
+	if err := ioutil.WriteFile(keyFile, testCryptKey, 0600); err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+	settings := &BucketSettings{
+		NumPartitions:     MAX_VBUCKETS,
+		EncryptionKeyFile: keyFile,
+	}
+
+	b0, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 5)
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if err = b0.Compact(); err != nil {
+		t.Errorf("expected Compact to work, got: %v", err)
+	}
+	testLoadInts(t, r0, 2, 7)
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	b0.Close()
+
+	names, err := latestStoreFileNames(testBucketDir, STORES_PER_BUCKET,
+		STORE_FILE_SUFFIX)
+	if err != nil {
+		t.Fatalf("expected latestStoreFileNames to work, got: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path.Join(testBucketDir, names[0]))
+	if err != nil {
+		t.Fatalf("expected store file read to work, got: %v", err)
+	}
+	if !bytes.HasPrefix(raw, []byte(storefile.CryptMagic)) {
+		t.Errorf("expected compacted store file to be encrypted")
+	}
+	if bytes.Contains(raw, []byte(`"state":"active"`)) {
+		t.Errorf("expected no plaintext vbucket metadata in store file")
+	}
+
+	b1, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Errorf("expected Load to work, err: %v", err)
+	}
+	testExpectInts(t, &reqHandler{currentBucket: b1}, 2,
+		[]int{0, 1, 2, 3, 4, 5, 6}, "after encrypted reload")
+
+	_, err = NewBucket(testBucketDir, &BucketSettings{
+		NumPartitions:    MAX_VBUCKETS,
+		EncryptionKeyEnv: "CBGB_TEST_NO_SUCH_KEY_ENV",
+	})
+	if err == nil {
+		t.Errorf("expected NewBucket with missing key env var to fail")
+	}
+}
+
+func TestEncryptionKeyName(t *testing.T) {
+	testKeysDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testKeysDir)
+	defer func(dir string) { encryptionKeysDir = dir }(encryptionKeysDir)
+
+	err := ioutil.WriteFile(path.Join(testKeysDir, "k1"), testCryptKey, 0600)
+	if err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+	bs := &BucketSettings{EncryptionKeyName: "k1"}
+
+	encryptionKeysDir = ""
+	if _, err = bs.loadEncryptionKey(); err == nil {
+		t.Errorf("Expected key name without keys dir to fail")
+	}
+
+	encryptionKeysDir = testKeysDir
+	k, err := bs.loadEncryptionKey()
+	if err != nil || !bytes.Equal(k, testCryptKey) {
+		t.Errorf("Expected named key, got: %q, err: %v", k, err)
+	}
+	for _, name := range []string{"../k1", "sub/k1", ".hidden", ".."} {
+		if err = checkEncryptionKeyName(name); err == nil {
+			t.Errorf("Expected bad key name: %q", name)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Fault injection for store files, so we can see how buckets behave
+// when the disk misbehaves.  The probabilities are between 0 and 1,
+// and are checked on every file operation.
+type FileFaults struct {
+	ShortWriteProb  float64 `json:"shortWriteProb"`
+	ReadEIOProb     float64 `json:"readEIOProb"`
+	WriteENOSPCProb float64 `json:"writeENOSPCProb"`
+	SyncFailProb    float64 `json:"syncFailProb"`
+	LatencyMs       int64   `json:"latencyMs"`
+
+	// When non-empty, only files whose path contains this are faulty.
+	PathMatch string `json:"pathMatch,omitempty"`
+}
+
+var fileFaults unsafe.Pointer // *FileFaults, nil when disabled.
+
+func getFileFaults() *FileFaults {
+	return (*FileFaults)(atomic.LoadPointer(&fileFaults))
+}
+
+// Changes the faults of all store files, including already open ones.
+// A nil ff turns off fault injection.
+func setFileFaults(ff *FileFaults) {
+	atomic.StorePointer(&fileFaults, unsafe.Pointer(ff))
+}
+
+func parseFileFaults(s string) (*FileFaults, error) {
+	ff := &FileFaults{}
+	if err := json.Unmarshal([]byte(s), ff); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+type faultInjectingFileLike struct {
+	path string
+	file FileLike
+}
+
+func newFaultInjectingFileLike(path string, file FileLike) FileLike {
+	return &faultInjectingFileLike{path: path, file: file}
+}
+
+// Returns the current faults if they apply to this file, after
+// waiting out any configured latency.
+func (f *faultInjectingFileLike) faults() *FileFaults {
+	ff := getFileFaults()
+	if ff == nil ||
+		(ff.PathMatch != "" && !strings.Contains(f.path, ff.PathMatch)) {
+		return nil
+	}
+	if ff.LatencyMs > 0 {
+		time.Sleep(time.Duration(ff.LatencyMs) * time.Millisecond)
+	}
+	return ff
+}
+
+func faultHit(prob float64) bool {
+	return prob > 0 && rand.Float64() < prob
+}
+
+func (f *faultInjectingFileLike) Close() error {
+	return f.file.Close()
+}
+
+func (f *faultInjectingFileLike) Stat() (os.FileInfo, error) {
+	f.faults()
+	return f.file.Stat()
+}
+
+func (f *faultInjectingFileLike) ReadAt(p []byte, off int64) (n int, err error) {
+	if ff := f.faults(); ff != nil && faultHit(ff.ReadEIOProb) {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: syscall.EIO}
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultInjectingFileLike) WriteAt(p []byte, off int64) (n int, err error) {
+	ff := f.faults()
+	if ff != nil {
+		if faultHit(ff.WriteENOSPCProb) {
+			return 0, &os.PathError{Op: "write", Path: f.path, Err: syscall.ENOSPC}
+		}
+		if len(p) > 0 && faultHit(ff.ShortWriteProb) {
+			n, err = f.file.WriteAt(p[:rand.Intn(len(p))], off)
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return n, err
+		}
+	}
+	return f.file.WriteAt(p, off)
+}
+
+func (f *faultInjectingFileLike) Sync() error {
+	if ff := f.faults(); ff != nil && faultHit(ff.SyncFailProb) {
+		return &os.PathError{Op: "sync", Path: f.path, Err: syscall.EIO}
+	}
+	return f.file.Sync()
+}
+
+func isNoSpaceErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOSPC
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestFaultyFileLike(t *testing.T) {
+	fn := ",faulty-file-like-thing"
+	defer os.Remove(fn)
+	defer setFileFaults(nil)
+
+	fs := NewFileService(1)
+	defer fs.Close()
+	f, err := fs.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_EXCL)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	ff := newFaultInjectingFileLike(fn, f)
+
+	buf := []byte("hello world")
+	if n, err := ff.WriteAt(buf, 0); err != nil || n != len(buf) {
+		t.Errorf("Expected no faults by default, got: %v, n: %v", err, n)
+	}
+
+	setFileFaults(&FileFaults{ReadEIOProb: 1})
+	if _, err = ff.ReadAt(buf, 0); !strings.Contains(err.Error(), syscall.EIO.Error()) {
+		t.Errorf("Expected EIO, got: %v", err)
+	}
+
+	setFileFaults(&FileFaults{WriteENOSPCProb: 1})
+	if _, err = ff.WriteAt(buf, 0); !isNoSpaceErr(err) {
+		t.Errorf("Expected ENOSPC, got: %v", err)
+	}
+
+	setFileFaults(&FileFaults{ShortWriteProb: 1})
+	if n, err := ff.WriteAt(buf, 0); err != io.ErrShortWrite || n >= len(buf) {
+		t.Errorf("Expected short write, got: %v, n: %v", err, n)
+	}
+
+	setFileFaults(&FileFaults{SyncFailProb: 1})
+	if err = ff.Sync(); err == nil {
+		t.Errorf("Expected sync failure")
+	}
+
+	setFileFaults(&FileFaults{SyncFailProb: 1, PathMatch: "some-other-file"})
+	if err = ff.Sync(); err != nil {
+		t.Errorf("Expected faults only on matching paths, got: %v", err)
+	}
+
+	setFileFaults(nil)
+	if _, err = ff.ReadAt(buf, 0); err != nil {
+		t.Errorf("Expected faults to be turned off, got: %v", err)
+	}
+}
+
+func TestParseFileFaults(t *testing.T) {
+	ff, err := parseFileFaults(`{"writeENOSPCProb":0.5,"latencyMs":10}`)
+	if err != nil {
+		t.Fatalf("Expected parse to work, got: %v", err)
+	}
+	if ff.WriteENOSPCProb != 0.5 || ff.LatencyMs != 10 {
+		t.Errorf("Misparsed file faults: %#v", ff)
+	}
+	if _, err = parseFileFaults("not json"); err == nil {
+		t.Errorf("Expected parse error")
+	}
+}
+
+func TestReadOnlyOnFullDisk(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	defer setFileFaults(nil)
+
+	prevFlushRetryDelay := flushRetryDelay
+	flushRetryDelay = 0
+	defer func() { flushRetryDelay = prevFlushRetryDelay }()
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 3)
+
+	setFileFaults(&FileFaults{WriteENOSPCProb: 1, PathMatch: testBucketDir})
+
+	if err = b0.Flush(); err == nil {
+		t.Errorf("expected flush to fail on a full disk")
+	}
+	st := v0.bs.Stats()
+	if st.FlushErrors != 1 || st.FlushRetries != int64(flushRetries) ||
+		st.WriteErrors == 0 || st.ReadOnly == 0 {
+		t.Errorf("expected flush error stats and read-only, got: %#v", st)
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		Key:     []byte("hello"),
+		Body:    []byte("world"),
+		VBucket: 2,
+	}
+	res := r0.HandleMessage(nil, nil, req)
+	if res.Status != gomemcached.TMPFAIL {
+		t.Errorf("expected SET to a read-only bucket to fail, got: %v", res)
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2}, "read-only bucket")
+
+	setFileFaults(nil)
+
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected flush to work after freeing space, got: %v", err)
+	}
+	if v0.bs.Stats().ReadOnly != 0 {
+		t.Errorf("expected bucket to be writable again")
+	}
+	res = r0.HandleMessage(nil, nil, req)
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected SET to work again, got: %v", res)
+	}
+}
+
+func TestRestFileFaults(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	defer setFileFaults(nil)
+	mr := testSetupMux(d)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/_api/fileFaults",
+		strings.NewReader(`{"readEIOProb":0.25}`))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected req to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	if ff := getFileFaults(); ff == nil || ff.ReadEIOProb != 0.25 {
+		t.Errorf("expected file faults to be set, got: %#v", ff)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "http://127.0.0.1/_api/fileFaults",
+		strings.NewReader(`bad`))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected bad req to fail, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "http://127.0.0.1/_api/fileFaults", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || getFileFaults() != nil {
+		t.Errorf("expected file faults to be cleared, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+}
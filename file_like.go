@@ -16,6 +16,7 @@ type FileLike interface {
 	io.WriterAt
 
 	Stat() (os.FileInfo, error)
+	Sync() error
 }
 
 type fileLike struct {
@@ -43,6 +44,18 @@ func (f *fileLike) Stat() (os.FileInfo, error) {
 	return os.Lstat(f.path)
 }
 
+// Commit the contents of the underlying path to stable storage.  As
+// fsync applies to the file rather than the descriptor, this covers
+// writes done through the FileService's earlier opens of the path.
+func (f *fileLike) Sync() error {
+	if f.mode&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return nil
+	}
+	return f.fs.Do(f.path, f.mode, func(file *os.File) error {
+		return file.Sync()
+	})
+}
+
 func (f *fileLike) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.mode&os.O_WRONLY == os.O_WRONLY {
 		return 0, unReadable
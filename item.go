@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"time"
+
+	"github.com/couchbaselabs/cbgb/storefile"
 )
 
 type item struct {
@@ -55,7 +57,7 @@ func (i item) isExpired(t time.Time) bool {
 	return !time.Unix(int64(i.exp), 0).After(t)
 }
 
-const itemHdrLen = 4 + 4 + 8 + 2 + 4
+const itemHdrLen = storefile.ItemHdrLen
 
 // Serialize everything but the key.
 func (i *item) toValueBytes() []byte {
@@ -65,62 +67,17 @@ func (i *item) toValueBytes() []byte {
 	if len(i.data) > MAX_ITEM_DATA_LENGTH {
 		return nil
 	}
-
-	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data))
-	off := 0
-	binary.BigEndian.PutUint32(rv[off:], i.exp)
-	off += 4
-	binary.BigEndian.PutUint32(rv[off:], i.flag)
-	off += 4
-	binary.BigEndian.PutUint64(rv[off:], i.cas)
-	off += 8
-	binary.BigEndian.PutUint16(rv[off:], uint16(len(i.key)))
-	off += 2
-	binary.BigEndian.PutUint32(rv[off:], uint32(len(i.data)))
-	off += 4
-	n := copy(rv[off:], i.key)
-	off += n
-	copy(rv[off:], i.data)
-	return rv
+	si := storefile.Item{Key: i.key, Exp: i.exp, Flag: i.flag, Cas: i.cas,
+		Data: i.data}
+	return si.Bytes()
 }
 
-func (i *item) fromValueBytes(b []byte) (err error) {
-	if itemHdrLen > len(b) {
-		return fmt.Errorf("item.fromValueBytes(): arr too short: %v, minimum: %v",
-			len(b), itemHdrLen)
-	}
-	buf := bytes.NewBuffer(b)
-	if err = binary.Read(buf, binary.BigEndian, &i.exp); err != nil {
-		return err
-	}
-	if err = binary.Read(buf, binary.BigEndian, &i.flag); err != nil {
-		return err
-	}
-	if err = binary.Read(buf, binary.BigEndian, &i.cas); err != nil {
-		return err
-	}
-	var keylen uint16
-	if err = binary.Read(buf, binary.BigEndian, &keylen); err != nil {
-		return err
-	}
-	var datalen uint32
-	if err = binary.Read(buf, binary.BigEndian, &datalen); err != nil {
-		return err
-	}
-	if len(b) < itemHdrLen+int(keylen)+int(datalen) {
-		return fmt.Errorf("item.fromValueBytes(): arr too short: %v, wanted: %v",
-			len(b), itemHdrLen+int(keylen)+int(datalen))
-	}
-	if keylen > 0 {
-		i.key = b[itemHdrLen : itemHdrLen+int(keylen)]
-	} else {
-		i.key = []byte{}
-	}
-	if datalen > 0 {
-		i.data = b[itemHdrLen+int(keylen) : itemHdrLen+int(keylen)+int(datalen)]
-	} else {
-		i.data = []byte{}
+func (i *item) fromValueBytes(b []byte) error {
+	si, err := storefile.DecodeItem(b)
+	if err != nil {
+		return fmt.Errorf("item.fromValueBytes(): %v", err)
 	}
+	i.key, i.exp, i.flag, i.cas, i.data = si.Key, si.Exp, si.Flag, si.Cas, si.Data
 	return nil
 }
 
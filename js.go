@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/robertkrimen/otto"
 )
@@ -96,6 +97,51 @@ func OttoNewFunction(o *otto.Otto, f string) (otto.Value, error) {
 	return fnv, nil
 }
 
+// The longest that one call of a design doc's javascript function may
+// run, where 0 means no limit.
+var jsTimeout = 5 * time.Second
+
+// The error of a javascript call that ran out of time.
+type jsTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *jsTimeoutError) Error() string {
+	return fmt.Sprintf("javascript timeout after %v", e.timeout)
+}
+
+// Calls a javascript function, halting it through otto's interrupt
+// channel if it runs longer than jsTimeout, so that a function that
+// loops forever can't hang the caller.
+func OttoCall(o *otto.Otto, fn otto.Value,
+	args ...interface{}) (rv otto.Value, err error) {
+	timeout := jsTimeout
+	if timeout <= 0 {
+		return fn.Call(fn, args...)
+	}
+	// A fresh channel per call, dropped from the VM as the call
+	// returns, so an interrupt that a timer queues just as the call
+	// returns can't halt the next call or any other run of the VM.
+	// The buffer lets such a late timer finish without a reader.
+	interrupt := make(chan func(), 1)
+	o.Interrupt = interrupt
+	halt := &jsTimeoutError{timeout}
+	timer := time.AfterFunc(timeout, func() {
+		interrupt <- func() { panic(halt) }
+	})
+	defer func() {
+		timer.Stop()
+		o.Interrupt = nil
+		if r := recover(); r != nil {
+			if r != halt {
+				panic(r)
+			}
+			rv, err = otto.UndefinedValue(), halt
+		}
+	}()
+	return fn.Call(fn, args...)
+}
+
 func ArrayPrefix(arrayMaybe interface{}, prefixLen int) interface{} {
 	if prefixLen <= 0 {
 		return nil
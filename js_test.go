@@ -3,6 +3,9 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/robertkrimen/otto"
 )
 
 func TestArrayPrefix(t *testing.T) {
@@ -46,3 +49,32 @@ func TestArrayPrefix(t *testing.T) {
 		}
 	}
 }
+
+func TestOttoCallLateInterrupt(t *testing.T) {
+	defer func(timeout time.Duration) { jsTimeout = timeout }(jsTimeout)
+	jsTimeout = time.Millisecond
+
+	o := otto.New()
+	fn, err := OttoNewFunction(o, "function(x) { return x + 1; }")
+	if err != nil {
+		t.Fatalf("expected function to compile, got: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		rv, err := OttoCall(o, fn, i)
+		if err != nil {
+			t.Errorf("expected quick call to work, got: %v", err)
+		}
+		if x, _ := rv.ToInteger(); x != int64(i+1) {
+			t.Errorf("expected %v, got: %v", i+1, rv)
+		}
+		if o.Interrupt != nil {
+			t.Errorf("expected the call's interrupt to be dropped")
+		}
+		// Any interrupt that a late timer queues must not halt
+		// later runs of the VM.
+		time.Sleep(2 * time.Millisecond)
+		if _, err := o.Run("1 + 1"); err != nil {
+			t.Errorf("expected run after call to work, got: %v", err)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"runtime"
 	"time"
 
 	"github.com/daaku/go.flagbytes"
@@ -33,6 +35,35 @@ var defaultQuotaBytes = flagbytes.Bytes("default-quota",
 	"100MB", "quota for default bucket")
 var defaultPersistence = flag.Int("default-persistence",
 	2, "persistence level for default bucket")
+var encryptionKeyFile = flag.String("encryption-key-file",
+	"", "key file for encrypting store files of new buckets")
+var encryptionKeyEnv = flag.String("encryption-key-env",
+	"", "env var holding the key for encrypting store files of new buckets")
+var encryptionKeysDirFlag = flag.String("encryption-keys-dir",
+	"", "dir of key files that new buckets may pick by encryptionKeyName")
+var defaultDurability = flag.String("default-durability",
+	Durability_NONE, "durability of new buckets: "+
+		Durability_NONE+", "+Durability_FSYNC_ON_FLUSH+" or "+Durability_FSYNC_PER_BATCH)
+var numStores = flag.Int("num-stores",
+	STORES_PER_BUCKET, "number of store files for new buckets")
+var migrateBucket = flag.String("migrate-bucket",
+	"", "offline migrate this bucket to migrate-num-stores store files, then exit")
+var migrateNumStores = flag.Int("migrate-num-stores",
+	STORES_PER_BUCKET, "number of store files for migrate-bucket")
+var compactConcurrency = flag.Int("compact-concurrency",
+	2, "max number of concurrent compactions across all buckets")
+var compactWriteEvery = flag.Int("compact-write-every",
+	1000, "number of items copied by compaction between writes")
+var compactThrottle = flag.Duration("compact-throttle",
+	0, "compaction sleep after every compact-write-every items")
+var viewTimeout = flag.Duration("view-timeout",
+	jsTimeout, "max run time of one call of a view's javascript (0 is no limit)")
+var viewMaxEmitsFlag = flag.Int("view-max-emits",
+	viewMaxEmits, "max rows a view's map function may emit per doc (0 is no limit)")
+var viewWorkers = flag.Int("view-workers",
+	runtime.NumCPU(), "number of vbuckets whose views may be indexed at once")
+var fileFaultsFlag = flag.String("file-faults",
+	"", `JSON fault injection for store files, for testing (e.g. {"writeENOSPCProb":0.1})`)
 
 var buckets *Buckets
 var bucketSettings *BucketSettings
@@ -70,10 +101,47 @@ func main() {
 
 	var err error
 
+	compactTasks.configure(*compactConcurrency, *compactWriteEvery,
+		*compactThrottle)
+
+	jsTimeout = *viewTimeout
+	encryptionKeysDir = *encryptionKeysDirFlag
+	viewMaxEmits = *viewMaxEmitsFlag
+	configureViewsRefresher(*viewWorkers)
+
+	if *fileFaultsFlag != "" {
+		ff, err := parseFileFaults(*fileFaultsFlag)
+		if err != nil {
+			log.Fatalf("error: could not parse file-faults: %v", err)
+		}
+		setFileFaults(ff)
+	}
+
+	if *migrateBucket != "" {
+		bp, err := BucketPath(*migrateBucket)
+		if err != nil {
+			log.Fatalf("error: could not migrate bucket: %v", err)
+		}
+		dir := path.Join(*data, bp)
+		log.Printf("migrating bucket: %v, dir: %v, numStores: %v",
+			*migrateBucket, dir, *migrateNumStores)
+		if err = migrateBucketStores(dir, *migrateNumStores); err != nil {
+			log.Fatalf("error: could not migrate bucket: %v, err: %v",
+				*migrateBucket, err)
+		}
+		log.Printf("migrated bucket: %v", *migrateBucket)
+		return
+	}
+
 	bucketSettings = &BucketSettings{
 		NumPartitions: *numPartitions,
+		NumStores:     *numStores,
 		QuotaBytes:    int64(*defaultQuotaBytes),
 		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING - *defaultPersistence,
+		Durability:    *defaultDurability,
+
+		EncryptionKeyFile: *encryptionKeyFile,
+		EncryptionKeyEnv:  *encryptionKeyEnv,
 	}
 	buckets, err = NewBuckets(*data, bucketSettings)
 	if err != nil {
@@ -25,7 +25,7 @@ import (
 type partitionstore struct {
 	vbid    uint16
 	parent  *bucketstore
-	lock    sync.Mutex     // Properties below here are covered by this lock.
+	lock    sync.RWMutex   // Properties below here are covered by this lock.
 	keys    unsafe.Pointer // *gkvlite.Collection
 	changes unsafe.Pointer // *gkvlite.Collection
 }
@@ -36,7 +36,51 @@ func (p *partitionstore) colls() (keys, changes *gkvlite.Collection) {
 		(*gkvlite.Collection)(atomic.LoadPointer(&p.changes))
 }
 
+// Like colls(), but also holds a ref on the store file backing the
+// collections, so that a compaction won't delete the file while the
+// caller's still reading.  The caller must call the returned release.
+func (p *partitionstore) collsRef() (keys, changes *gkvlite.Collection,
+	release func(), err error) {
+	release, err = p.ref(func(*bucketstorefile) {
+		keys, changes = p.colls()
+	})
+	return keys, changes, release, err
+}
+
+// Like collsRef(), for some other collection in the partition's store
+// file, which is nil if the collection doesn't exist.
+func (p *partitionstore) collRef(collName string) (coll *gkvlite.Collection,
+	release func(), err error) {
+	release, err = p.ref(func(bsf *bucketstorefile) {
+		coll = bsf.store.GetCollection(collName)
+	})
+	return coll, release, err
+}
+
+// Holds a ref on the partition's current store file, calling cb to
+// grab collections from that file.  When the file was retired, it
+// tries again with the file that superseded it, erroring only if
+// there's none, as when the bucketstore was destroyed.
+func (p *partitionstore) ref(cb func(*bucketstorefile)) (func(), error) {
+	for {
+		p.lock.RLock()
+		bsf := p.parent.BSFData()
+		cb(bsf)
+		ok := bsf.addRef()
+		p.lock.RUnlock()
+		if ok {
+			return bsf.release, nil
+		}
+		if p.parent.BSFData() == bsf {
+			return nil, fmt.Errorf("store file retired: %v", bsf.path)
+		}
+	}
+}
+
 func (p *partitionstore) mutate(cb func(keys, changes *gkvlite.Collection)) {
+	p.parent.mutationLock.RLock()
+	defer p.parent.mutationLock.RUnlock()
+
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
@@ -65,30 +109,9 @@ func (p *partitionstore) getMeta(key []byte) (*item, error) {
 
 func (p *partitionstore) getItem(key []byte, withValue bool) (i *item, err error) {
 	for retries := 0; retries < 5; retries++ {
-		keys, changes := p.colls()
-		iItem, err := keys.GetItem(key, true)
-		if err != nil {
-			return nil, err
-		}
-		if iItem == nil {
-			return nil, nil
-		}
-		// TODO: What if a compaction happens in between the lookups,
-		// and the changes-feed no longer has the item?  Answer: compaction
-		// must not remove items that the key-index references.
-		cItem := (*gkvlite.Item)(atomic.LoadPointer(&iItem.Transient))
-		if cItem == nil {
-			cItem, err = changes.GetItem(iItem.Val, true)
-			if err != nil {
-				return nil, err
-			}
-		}
-		if cItem != nil {
-			i := &item{key: key}
-			if err = i.fromValueBytes(cItem.Val); err != nil {
-				return nil, err
-			}
-			return i, nil
+		i, done, err := p.getItemOnce(key)
+		if done || err != nil {
+			return i, err
 		}
 		// If cItem is nil, perhaps a concurrent set() happened after
 		// the keys.GetItem() and de-duped the old change.  So, retry.
@@ -96,8 +119,45 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (i *item, err error
 	return nil, fmt.Errorf("max getItem retries for key: %v", key)
 }
 
+func (p *partitionstore) getItemOnce(key []byte) (i *item, done bool, err error) {
+	keys, changes, release, err := p.collsRef()
+	if err != nil {
+		return nil, true, err
+	}
+	defer release()
+	iItem, err := keys.GetItem(key, true)
+	if err != nil {
+		return nil, true, err
+	}
+	if iItem == nil {
+		return nil, true, nil
+	}
+	// TODO: What if a compaction happens in between the lookups,
+	// and the changes-feed no longer has the item?  Answer: compaction
+	// must not remove items that the key-index references.
+	cItem := (*gkvlite.Item)(atomic.LoadPointer(&iItem.Transient))
+	if cItem == nil {
+		cItem, err = changes.GetItem(iItem.Val, true)
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	if cItem == nil {
+		return nil, false, nil
+	}
+	i = &item{key: key}
+	if err = i.fromValueBytes(cItem.Val); err != nil {
+		return nil, true, err
+	}
+	return i, true, nil
+}
+
 func (p *partitionstore) getTotals() (numItems uint64, numItemBytes uint64, err error) {
-	keys, changes := p.colls()
+	keys, changes, release, err := p.collsRef()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
 	numItems, _, err = keys.GetTotals()
 	if err != nil {
 		return 0, 0, err
@@ -109,9 +169,43 @@ func (p *partitionstore) getTotals() (numItems uint64, numItemBytes uint64, err
 	return numItems, numChangesBytes, nil
 }
 
+// Returns the bytes of the keys and changes collections.
+func (p *partitionstore) collsBytes() (uint64, error) {
+	keys, changes, release, err := p.collsRef()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var rv uint64
+	for _, coll := range []*gkvlite.Collection{keys, changes} {
+		_, numBytes, err := coll.GetTotals()
+		if err != nil {
+			return 0, err
+		}
+		rv += numBytes
+	}
+	return rv, nil
+}
+
 func (p *partitionstore) visitItems(start []byte, withValue bool,
 	visitor func(*item) bool) (err error) {
-	keys, changes := p.colls()
+	return p.visitItemsDir(start, false, withValue, visitor)
+}
+
+// Like visitItems(), but in descending key order, from start
+// (inclusive) or else from the last item.
+func (p *partitionstore) visitItemsDescend(start []byte, withValue bool,
+	visitor func(*item) bool) (err error) {
+	return p.visitItemsDir(start, true, withValue, visitor)
+}
+
+func (p *partitionstore) visitItemsDir(start []byte, descend bool,
+	withValue bool, visitor func(*item) bool) (err error) {
+	keys, changes, release, err := p.collsRef()
+	if err != nil {
+		return err
+	}
+	defer release()
 	var vErr error
 	v := func(iItem *gkvlite.Item) bool {
 		cItem := (*gkvlite.Item)(atomic.LoadPointer(&iItem.Transient))
@@ -130,7 +224,11 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 		}
 		return visitor(i)
 	}
-	if err := p.visit(keys, start, withValue, v); err != nil {
+	visit := p.visit
+	if descend {
+		visit = p.visitDescend
+	}
+	if err := visit(keys, start, withValue, v); err != nil {
 		return err
 	}
 	return vErr
@@ -138,7 +236,11 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 
 func (p *partitionstore) visitChanges(start []byte, withValue bool,
 	visitor func(*item) bool) (err error) {
-	_, changes := p.colls()
+	_, changes, release, err := p.collsRef()
+	if err != nil {
+		return err
+	}
+	defer release()
 	var vErr error
 	v := func(cItem *gkvlite.Item) bool {
 		i := &item{}
@@ -169,11 +271,35 @@ func (p *partitionstore) visit(coll *gkvlite.Collection,
 	return coll.VisitItemsAscend(start, withValue, v)
 }
 
+func (p *partitionstore) visitDescend(coll *gkvlite.Collection,
+	start []byte, withValue bool,
+	v func(*gkvlite.Item) bool) (err error) {
+	if start == nil {
+		i, err := coll.MaxItem(false)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			return nil
+		}
+		start = i.Key
+	}
+	// Descending visits are of keys less than the target, so the
+	// target is the least key that's greater than start.
+	target := make([]byte, len(start)+1)
+	copy(target, start)
+	return coll.VisitItemsDescend(target, withValue, v)
+}
+
 // All the following mutation methods need to be called while
 // single-threaded with respect to the mutating collection.
 
 func (p *partitionstore) set(newItem *item, oldItem *item) (
 	deltaItemBytes int64, err error) {
+	if len(newItem.key) > 0 && p.parent.readOnly() {
+		return 0, bucketStoreReadOnly
+	}
+
 	vBytes := newItem.toValueBytes()
 	cBytes := casBytes(newItem.cas)
 
@@ -191,10 +317,10 @@ func (p *partitionstore) set(newItem *item, oldItem *item) (
 		dirtyForce := false
 
 		if newItem.key != nil && len(newItem.key) > 0 {
-			// TODO: What if we flush between the keys update and changes
-			// update?  That could result in an inconsistent db file?
-			// Solution idea #1 is to have load-time fixup, that
-			// incorporates changes into the key-index.
+			// A flush can't happen between the changes update and
+			// keys update, as mutate() holds the parent's mutationLock.
+			// Files written before that was so are repaired by
+			// loadFixup() at load time.
 			kItem := &gkvlite.Item{
 				Key:       newItem.key,
 				Val:       cBytes,
@@ -213,6 +339,8 @@ func (p *partitionstore) set(newItem *item, oldItem *item) (
 			changes.Delete(casBytes(oldItem.cas))
 		}
 
+		atomic.AddInt64(&p.parent.dirtyBytes,
+			int64(len(newItem.key)+len(cBytes)+len(vBytes)))
 		p.parent.dirty(dirtyForce)
 	})
 	return deltaItemBytes, err
@@ -220,6 +348,10 @@ func (p *partitionstore) set(newItem *item, oldItem *item) (
 
 func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 	deltaItemBytes int64, err error) {
+	if len(key) > 0 && p.parent.readOnly() {
+		return 0, bucketStoreReadOnly
+	}
+
 	cBytes := casBytes(cas)
 	dItem := &item{key: key, cas: cas}
 	vBytes := dItem.markAsDeletion().toValueBytes()
@@ -236,10 +368,7 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 
 		dirtyForce := false
 		if key != nil && len(key) > 0 {
-			// TODO: What if we flush between the keys update and changes
-			// update?  That could result in an inconsistent db file?
-			// Solution idea #1 is to have load-time fixup, that
-			// incorporates changes into the key-index.
+			// See set() on flushing in between.
 			if _, err = keys.Delete(key); err != nil {
 				return
 			}
@@ -252,11 +381,127 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 			changes.Delete(casBytes(oldItem.cas))
 		}
 
+		atomic.AddInt64(&p.parent.dirtyBytes,
+			int64(len(key)+len(cBytes)+len(vBytes)))
 		p.parent.dirty(dirtyForce)
 	})
 	return deltaItemBytes, err
 }
 
+// Summary of what loadFixup() had to repair.
+type partitionFixup struct {
+	KeysScanned     int `json:"keysScanned"`
+	DanglingKeys    int `json:"danglingKeys"`
+	ReplayedChanges int `json:"replayedChanges"`
+	ReplayedSets    int `json:"replayedSets"`
+	ReplayedDeletes int `json:"replayedDeletes"`
+}
+
+func (f *partitionFixup) repaired() bool {
+	return f.DanglingKeys > 0 || f.ReplayedSets > 0 || f.ReplayedDeletes > 0
+}
+
+// Reconciles the key-index with the changes-stream after loading
+// from a db file, as a flush might have happened in between the
+// changes update and keys update of a mutation.  Keys that reference
+// missing changes are removed, and then changes newer than what the
+// key-index reflects are replayed into the key-index.
+func (p *partitionstore) loadFixup() (rv *partitionFixup, err error) {
+	rv = &partitionFixup{}
+	p.mutate(func(keys, changes *gkvlite.Collection) {
+		var maxCas uint64
+		var dangling [][]byte
+		var vErr error
+		err = p.visit(keys, nil, false, func(kItem *gkvlite.Item) bool {
+			rv.KeysScanned++
+			var cItem *gkvlite.Item
+			cItem, vErr = changes.GetItem(kItem.Val, false)
+			if vErr != nil {
+				return false
+			}
+			if cItem == nil {
+				dangling = append(dangling, kItem.Key)
+				return true
+			}
+			var cas uint64
+			if cas, vErr = casBytesParse(kItem.Val); vErr != nil {
+				return false
+			}
+			if maxCas < cas {
+				maxCas = cas
+			}
+			return true
+		})
+		if err == nil {
+			err = vErr
+		}
+		if err != nil {
+			return
+		}
+		for _, key := range dangling {
+			if _, err = keys.Delete(key); err != nil {
+				return
+			}
+			rv.DanglingKeys++
+		}
+
+		// Changes are replayed only if they're newer than the key
+		// that they're for, so replaying a change that the key-index
+		// already reflects is harmless.
+		err = p.visit(changes, casBytes(maxCas+1), true,
+			func(cItem *gkvlite.Item) bool {
+				i := &item{}
+				if vErr = i.fromValueBytes(cItem.Val); vErr != nil {
+					return false
+				}
+				if len(i.key) == 0 {
+					return true // Metadata change.
+				}
+				rv.ReplayedChanges++
+				var kItem *gkvlite.Item
+				kItem, vErr = keys.GetItem(i.key, false)
+				if vErr != nil {
+					return false
+				}
+				if kItem != nil {
+					var cas uint64
+					if cas, vErr = casBytesParse(kItem.Val); vErr != nil {
+						return false
+					}
+					if cas >= i.cas {
+						return true
+					}
+				}
+				if i.isDeletion() {
+					if kItem != nil {
+						if _, vErr = keys.Delete(i.key); vErr != nil {
+							return false
+						}
+						rv.ReplayedDeletes++
+					}
+					return true
+				}
+				vErr = keys.SetItem(&gkvlite.Item{
+					Key:      i.key,
+					Val:      cItem.Key,
+					Priority: int32(rand.Int()),
+				})
+				if vErr != nil {
+					return false
+				}
+				rv.ReplayedSets++
+				return true
+			})
+		if err == nil {
+			err = vErr
+		}
+		if err == nil && rv.repaired() {
+			p.parent.dirty(false)
+		}
+	})
+	return rv, err
+}
+
 // ------------------------------------------------------------
 
 func rangeCopy(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
@@ -265,10 +510,8 @@ func rangeCopy(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 	if err != nil {
 		return false, err
 	}
-	// TODO: What if we flush between the keys update and changes
-	// update?  That could result in an inconsistent db file?
-	// Solution idea #1 is to have load-time fixup, that
-	// incorporates changes into the key-index.
+	// A flush in the middle of a range copy can leave the keys and
+	// changes out of sync on disk; loadFixup() repairs that at load.
 	if minItem != nil {
 		if err := collRangeCopy(srcColl, dstColl, minItem.Key,
 			minKeyInclusive, maxKeyExclusive); err != nil {
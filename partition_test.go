@@ -52,6 +52,40 @@ func TestPartitionStoreEmptyVisit(t *testing.T) {
 	}
 }
 
+func TestPartitionStoreCollsRefRetired(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("Expected NewBucket() to work")
+	}
+	defer b.Close()
+
+	vb, _ := b.CreateVBucket(0)
+	keys, changes, release, err := vb.ps.collsRef()
+	if err != nil || keys == nil || changes == nil {
+		t.Fatalf("expected collsRef to work, got: %v", err)
+	}
+	release()
+
+	// Without a store file to move on to, readers get an error.
+	vb.bs.destroy()
+	if _, _, _, err = vb.ps.collsRef(); err == nil {
+		t.Errorf("expected collsRef of a destroyed store to fail")
+	}
+	if _, _, err = vb.ps.collRef(COLL_VBMETA); err == nil {
+		t.Errorf("expected collRef of a destroyed store to fail")
+	}
+	if err = vb.ps.visitItems(nil, true, func(*item) bool {
+		return true
+	}); err == nil {
+		t.Errorf("expected visitItems of a destroyed store to fail")
+	}
+}
+
 func TestCollRangeCopy(t *testing.T) {
 	s, _ := gkvlite.NewStore(nil)
 	x := s.SetCollection("x", nil)
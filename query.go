@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/dustin/gomemcached"
+)
+
+// Ad-hoc queries over a bucket's JSON docs, where fields are named by
+// JSON pointers and compared in view collation order.  For example...
+//
+//	{"where": [{"field": "/type", "op": "=", "value": "order"},
+//	           {"field": "/amount", "op": ">=", "value": 10}],
+//	 "select": ["/id", "/amount"],
+//	 "orderBy": "/amount", "descending": true,
+//	 "limit": 10}
+//
+// Without a select list, the rows have the whole doc, like _all_docs
+// rows; otherwise a row's value is an array of the selected fields.
+// Rows are in doc id order, unless there's an orderBy field.
+type Query struct {
+	Where      []*QueryFilter `json:"where,omitempty"`
+	Select     []string       `json:"select,omitempty"`
+	OrderBy    string         `json:"orderBy,omitempty"`
+	Descending bool           `json:"descending,omitempty"`
+	Limit      int            `json:"limit,omitempty"`
+}
+
+// A doc matches a filter when it has the field and the field compares
+// with the value by the op, which is one of =, !=, <, <=, > or >=.
+type QueryFilter struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+func parseQuery(b []byte) (*Query, error) {
+	q := &Query{}
+	if err := json.Unmarshal(b, q); err != nil {
+		return nil, err
+	}
+	fields := append([]string(nil), q.Select...)
+	for _, f := range q.Where {
+		switch f.Op {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, fmt.Errorf("unknown query op: %q", f.Op)
+		}
+		fields = append(fields, f.Field)
+	}
+	if q.OrderBy != "" {
+		fields = append(fields, q.OrderBy)
+	}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "/") {
+			return nil, fmt.Errorf("query field not a JSON pointer: %q", field)
+		}
+	}
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("negative query limit: %v", q.Limit)
+	}
+	return q, nil
+}
+
+func (f *QueryFilter) match(data []byte) bool {
+	v, found := findJSONPointer(data, f.Field)
+	if !found {
+		return false
+	}
+	c := walrus.CollateJSON(v, f.Value)
+	switch f.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func (q *Query) match(data []byte) bool {
+	for _, f := range q.Where {
+		if !f.match(data) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *Query) row(docId string, data []byte) *ViewRow {
+	if len(q.Select) == 0 {
+		return &ViewRow{Id: docId, Key: docId, Doc: docViewValue(docId, data)}
+	}
+	values := make([]interface{}, len(q.Select))
+	for i, field := range q.Select {
+		values[i], _ = findJSONPointer(data, field)
+	}
+	return &ViewRow{Id: docId, Key: docId, Value: values}
+}
+
+// Returns a declarative view of a production design doc whose key is
+// a where field, with the view params of the key range that covers
+// the filter, so the query only has to look at the docs in that
+// range.  Returns "" when there's no such view.  The rows of a range
+// aren't in doc id order, so range filters only use a view when the
+// query has an orderBy field.
+func (q *Query) index(ddocs *DDocs) (string, *ViewParams) {
+	prod, _ := ddocsViews(ddocs)
+	for _, ops := range []string{"=", "<,<=,>,>="} {
+		if ops != "=" && q.OrderBy == "" {
+			break
+		}
+		for _, f := range q.Where {
+			if !strings.Contains(","+ops+",", ","+f.Op+",") {
+				continue
+			}
+			for viewName, iv := range prod {
+				if iv.view.Pointers == nil || iv.view.Pointers.Key != f.Field {
+					continue
+				}
+				p := NewViewParams()
+				switch f.Op {
+				case "=":
+					p.Key = f.Value
+				case "<", "<=":
+					p.EndKey = f.Value
+				case ">", ">=":
+					p.StartKey = f.Value
+				}
+				return viewName, p
+			}
+		}
+	}
+	return "", nil
+}
+
+// Runs a query, passing the result rows to the visitor until the
+// limit or until the visitor returns false.
+func runQuery(bucket Bucket, q *Query, visitor func(*ViewRow) bool) error {
+	n := 0
+	emit := func(row *ViewRow) bool {
+		if !visitor(row) {
+			return false
+		}
+		n++
+		return q.Limit <= 0 || n < q.Limit
+	}
+
+	ordered := &queryRows{descending: q.Descending}
+	onDoc := emit
+	if q.OrderBy != "" {
+		onDoc = nil
+	}
+	visitDoc := func(docId string, data []byte) bool {
+		row := q.row(docId, data)
+		if onDoc != nil {
+			return onDoc(row)
+		}
+		orderKey, _ := findJSONPointer(data, q.OrderBy)
+		ordered.rows = append(ordered.rows,
+			&queryRow{row: row, orderKey: orderKey})
+		return true
+	}
+
+	var err error
+	if viewName, p := q.index(bucket.GetDDocs()); viewName != "" {
+		err = indexQueryDocs(bucket, q, viewName, p, visitDoc)
+	} else {
+		err = scanQueryDocs(bucket, q, visitDoc)
+	}
+	if err != nil || q.OrderBy == "" {
+		return err
+	}
+
+	sort.Sort(ordered)
+	for _, r := range ordered.rows {
+		if !emit(r.row) {
+			break
+		}
+	}
+	return nil
+}
+
+// Visits the docs that match a query by using the index of a
+// declarative view to find the candidate docs.  The view's rows are
+// streamed, so the visit stops as soon as the visitor returns false.
+// The docs of an = filter are in doc id order, as their rows all have
+// the same key.
+func indexQueryDocs(bucket Bucket, q *Query, viewName string, p *ViewParams,
+	visitDoc func(docId string, data []byte) bool) error {
+	vbs, err := viewQueryVBuckets(bucket, false, p)
+	if err != nil {
+		return err
+	}
+	defer viewQueryDone(vbs, p)
+	return streamViewIndexes(vbs, viewName, p, func(row *ViewRow) bool {
+		res := GetItem(bucket, []byte(row.Id), VBActive)
+		if res.Status != gomemcached.SUCCESS || !q.match(res.Body) {
+			return true
+		}
+		return visitDoc(row.Id, res.Body)
+	})
+}
+
+// Visits the docs that match a query, in doc id order, by scanning
+// every vbucket concurrently, returning the first error of any
+// vbucket's scan.
+func scanQueryDocs(bucket Bucket, q *Query,
+	visitDoc func(docId string, data []byte) bool) error {
+	np := bucket.GetBucketSettings().NumPartitions
+	done := make(chan bool)
+	errs := make(chan error, np)
+	in := make([]chan *ViewRow, np)
+	for vbid := 0; vbid < np; vbid++ {
+		in[vbid] = make(chan *ViewRow)
+		vb, _ := bucket.GetVBucket(uint16(vbid))
+		go func(vb *VBucket, ch chan *ViewRow) {
+			defer close(ch)
+			if vb == nil {
+				errs <- nil
+				return
+			}
+			errs <- vb.Visit(nil, func(key []byte, data []byte) bool {
+				if !q.match(data) {
+					return true
+				}
+				docId := string(key)
+				// The row carries the doc until it's merged.
+				select {
+				case ch <- &ViewRow{Id: docId, Key: docId, Value: data}:
+					return true
+				case <-done:
+					return false
+				}
+			})
+		}(vb, in[vbid])
+	}
+	out := make(chan *ViewRow)
+	go MergeViewRows(in, out)
+	for row := range out {
+		if !visitDoc(row.Id, row.Value.([]byte)) {
+			close(done)
+			for range out {
+				// Drain, as the vbucket visits wind down.
+			}
+			break
+		}
+	}
+	var err error
+	for ; np > 0; np-- {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type queryRow struct {
+	row      *ViewRow
+	orderKey interface{}
+}
+
+type queryRows struct {
+	rows       []*queryRow
+	descending bool
+}
+
+func (q *queryRows) Len() int {
+	return len(q.rows)
+}
+
+func (q *queryRows) Swap(i, j int) {
+	q.rows[i], q.rows[j] = q.rows[j], q.rows[i]
+}
+
+func (q *queryRows) Less(i, j int) bool {
+	c := walrus.CollateJSON(q.rows[i].orderKey, q.rows[j].orderKey)
+	if c == 0 {
+		return q.rows[i].row.Id < q.rows[j].row.Id
+	}
+	return (c < 0) != q.descending
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery([]byte(`{"where":[{"field":"/a","op":">=","value":1}],` +
+		`"select":["/b"],"orderBy":"/c","descending":true,"limit":3}`))
+	if err != nil {
+		t.Fatalf("expected parseQuery to work, got: %v", err)
+	}
+	if len(q.Where) != 1 || q.Where[0].Value.(float64) != 1 ||
+		q.OrderBy != "/c" || !q.Descending || q.Limit != 3 {
+		t.Errorf("expected a parsed query, got: %#v", q)
+	}
+	for _, bad := range []string{
+		`not json`,
+		`{"where":[{"field":"/a","op":"~","value":1}]}`,
+		`{"where":[{"field":"a","op":"=","value":1}]}`,
+		`{"select":["b"]}`,
+		`{"orderBy":"c"}`,
+		`{"limit":-1}`,
+	} {
+		if _, err := parseQuery([]byte(bad)); err == nil {
+			t.Errorf("expected an error for query: %v", bad)
+		}
+	}
+
+	f := &QueryFilter{Field: "/a", Op: "<", Value: 2.0}
+	if !f.match([]byte(`{"a":1}`)) || f.match([]byte(`{"a":2}`)) ||
+		f.match([]byte(`{"b":1}`)) {
+		t.Errorf("expected filters to compare fields")
+	}
+}
+
+func testQueryRows(t *testing.T, mr http.Handler, q string) *ViewResult {
+	return testGetViewRows(t, mr,
+		"http://127.0.0.1/default/_query?q="+url.QueryEscape(q))
+}
+
+func testRowIds(vr *ViewResult) string {
+	ids := []string{}
+	for _, row := range vr.Rows {
+		ids = append(ids, row.Id)
+	}
+	return fmt.Sprintf("%v", ids)
+}
+
+func TestCouchQuery(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+
+	for i := 0; i < 10; i++ {
+		SetItem(bucket, []byte(fmt.Sprintf("k%v", i)),
+			[]byte(fmt.Sprintf(`{"type":"t%v","n":%v}`, i%2, i)), VBActive)
+	}
+	SetItem(bucket, []byte("x"), []byte("not json"), VBActive)
+
+	vr := testQueryRows(t, mr, `{"where":[{"field":"/type","op":"=","value":"t1"}]}`)
+	if got := testRowIds(vr); got != "[k1 k3 k5 k7 k9]" {
+		t.Errorf("expected the t1 docs, got: %v", got)
+	}
+	if vr.Rows[0].Doc == nil {
+		t.Errorf("expected rows with docs, got: %#v", vr.Rows[0])
+	}
+	vr = testQueryRows(t, mr, `{"where":[{"field":"/type","op":"=","value":"t0"},`+
+		`{"field":"/n","op":">","value":2}],"select":["/n"],`+
+		`"orderBy":"/n","descending":true,"limit":2}`)
+	if got := testRowIds(vr); got != "[k8 k6]" {
+		t.Errorf("expected ordered and limited rows, got: %v", got)
+	}
+	if vals, ok := vr.Rows[0].Value.([]interface{}); !ok ||
+		len(vals) != 1 || vals[0].(float64) != 8 {
+		t.Errorf("expected selected values, got: %#v", vr.Rows[0])
+	}
+	vr = testQueryRows(t, mr, `{"limit":3}`)
+	if got := testRowIds(vr); got != "[k0 k1 k2]" {
+		t.Errorf("expected the first docs, got: %v", got)
+	}
+
+	// A declarative view on the field answers the query, with the same rows.
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"by_type":{"pointers":{"key":"/type"}}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	q, _ := parseQuery([]byte(`{"where":[{"field":"/n","op":"<","value":5},` +
+		`{"field":"/type","op":"=","value":"t1"}]}`))
+	if viewName, p := q.index(bucket.GetDDocs()); viewName !=
+		testViewHash(t, bucket, "_design/d0", "by_type") || p.Key != "t1" {
+		t.Errorf("expected the declarative view to be used, got: %v, %#v",
+			viewName, p)
+	}
+	vr = testQueryRows(t, mr, `{"where":[{"field":"/n","op":"<","value":5},`+
+		`{"field":"/type","op":"=","value":"t1"}]}`)
+	if got := testRowIds(vr); got != "[k1 k3]" {
+		t.Errorf("expected the indexed query to filter, got: %v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/default/_query",
+		bytes.NewBufferString(`{"where":[{"field":"/n","op":"=","value":4}]}`))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || !bytes.Contains(rr.Body.Bytes(), []byte(`"k4"`)) {
+		t.Errorf("expected a POST query to work, got: %#v, %v", rr, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://127.0.0.1/default/_query?q=bad", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected a bad query to 400, got: %#v", rr)
+	}
+}
+
+func TestQueryIndexMatchesScan(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+
+	for i := 0; i < 20; i++ {
+		SetItem(bucket, []byte(fmt.Sprintf("k%02d", i)),
+			[]byte(fmt.Sprintf(`{"type":"t%v","n":%v}`, i%3, (i*7)%20)), VBActive)
+	}
+
+	queries := []string{
+		`{"where":[{"field":"/type","op":"=","value":"t1"}]}`,
+		`{"where":[{"field":"/type","op":"=","value":"t2"}],"limit":3}`,
+		`{"where":[{"field":"/type","op":"=","value":"t0"},` +
+			`{"field":"/n","op":"<","value":10}],"select":["/n"]}`,
+		`{"where":[{"field":"/n","op":">=","value":5}],` +
+			`"orderBy":"/n","descending":true,"limit":4}`,
+		`{"where":[{"field":"/n","op":"<","value":8}],"orderBy":"/type"}`,
+	}
+	run := func(query string) string {
+		q, err := parseQuery([]byte(query))
+		if err != nil {
+			t.Fatalf("expected parseQuery of %v to work, got: %v", query, err)
+		}
+		rows := ViewRows{}
+		err = runQuery(bucket, q, func(row *ViewRow) bool {
+			rows = append(rows, row)
+			return true
+		})
+		if err != nil {
+			t.Errorf("expected runQuery of %v to work, got: %v", query, err)
+		}
+		j, _ := json.Marshal(rows)
+		return string(j)
+	}
+
+	scanned := make([]string, len(queries))
+	for i, query := range queries {
+		scanned[i] = run(query)
+	}
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"by_type":{"pointers":{"key":"/type"}},`+
+			`"by_n":{"pointers":{"key":"/n"}}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	for i, query := range queries {
+		q, _ := parseQuery([]byte(query))
+		if viewName, _ := q.index(bucket.GetDDocs()); viewName == "" {
+			t.Errorf("expected query %v to use an index", query)
+		}
+		if got := run(query); got != scanned[i] {
+			t.Errorf("expected query %v to have the same rows with an index,"+
+				" got: %v, scanned: %v", query, got, scanned[i])
+		}
+	}
+
+	// Without an orderBy, a range filter still scans, for doc id order.
+	q, _ := parseQuery([]byte(`{"where":[{"field":"/n","op":"<","value":8}]}`))
+	if viewName, _ := q.index(bucket.GetDDocs()); viewName != "" {
+		t.Errorf("expected an unordered range query to scan, got: %v", viewName)
+	}
+}
@@ -1,20 +1,83 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"sort"
+	"strings"
 
 	"github.com/robertkrimen/otto"
 )
 
+// A built-in reduce function, named by a view's reduce field, like
+// "_sum", which runs natively rather than in otto.
+type builtinReducer struct {
+	reduce func(keys, values []interface{}, rereduce bool) (interface{}, error)
+
+	// Optionally turns a final reduction into the query result, for
+	// reducers whose reductions are intermediate state.
+	finalize func(value interface{}) (interface{}, error)
+}
+
+var builtinReducers = map[string]*builtinReducer{
+	"_sum":   {reduce: reduceSum},
+	"_count": {reduce: reduceCount},
+	"_stats": {reduce: reduceStats},
+	"_approx_count_distinct": {
+		reduce:   reduceApproxCountDistinct,
+		finalize: finalizeApproxCountDistinct,
+	},
+}
+
+// Returns the built-in reducer that a view's reduce source names, or
+// nil if it's a javascript function.
+func findBuiltinReducer(src string) *builtinReducer {
+	return builtinReducers[strings.TrimSpace(src)]
+}
+
+// The built-in reducers are also javascript globals, so reduce
+// functions can call them.
 func newReducer() *otto.Otto {
 	o := otto.New()
-	must(o.Set("_sum", javascriptReduceSum))
-	must(o.Set("_count", javascriptReduceCount))
-	must(o.Set("_stats", javascriptReduceStats))
+	for name, r := range builtinReducers {
+		must(o.Set(name, javascriptBuiltinReducer(r)))
+	}
 	return o
 }
 
+func javascriptBuiltinReducer(r *builtinReducer) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		rere, err := call.Argument(2).ToBoolean()
+		if err != nil {
+			return ottoMust(otto.ToValue(fmt.Sprintf("Error getting rere flag: %v", err)))
+		}
+		var keys []interface{}
+		if !rere {
+			ob, err := call.Argument(0).Export()
+			if err != nil {
+				return ottoMust(otto.ToValue(fmt.Sprintf("Error getting keys: %v", err)))
+			}
+			keys, _ = ob.([]interface{})
+		}
+		ob, err := call.Argument(1).Export()
+		if err != nil {
+			return ottoMust(otto.ToValue(fmt.Sprintf("Error getting stuff: %v", err)))
+		}
+		l, ok := ob.([]interface{})
+		if !ok {
+			return ottoMust(otto.ToValue(fmt.Sprintf("unhandled %v/%T", ob, ob)))
+		}
+		rv, err := r.reduce(keys, l, rere)
+		if err != nil {
+			return ottoMust(otto.ToValue(err.Error()))
+		}
+		return ottoMust(call.Otto.ToValue(rv))
+	}
+}
+
 // Convert interface{} to float with NaN and infs to 0 for summing
 func zeroate(i interface{}) float64 {
 	f, ok := i.(float64)
@@ -34,46 +97,49 @@ func ottoMust(v otto.Value, err error) otto.Value {
 	return v
 }
 
-func javascriptReduceSum(call otto.FunctionCall) otto.Value {
-	ob, err := call.Argument(1).Export()
-	if err != nil {
-		return ottoMust(otto.ToValue(fmt.Sprintf("Error getting stuff: %v", err)))
+// Sums numbers, or arrays of numbers position by position, where a
+// shorter array counts as padded with zeros.  Rereducing is summing
+// again.
+func reduceSum(keys, values []interface{}, rereduce bool) (interface{}, error) {
+	var sum float64
+	var sums []interface{}
+	numbers := false
+	for _, v := range values {
+		a, ok := v.([]interface{})
+		if !ok {
+			sum += zeroate(v)
+			numbers = true
+			continue
+		}
+		for i, x := range a {
+			if i >= len(sums) {
+				sums = append(sums, float64(0))
+			}
+			sums[i] = sums[i].(float64) + zeroate(x)
+		}
+		if sums == nil {
+			sums = []interface{}{}
+		}
 	}
-	l, ok := ob.([]interface{})
-	if !ok {
-		return ottoMust(otto.ToValue(fmt.Sprintf("unhandled %v/%T", ob, ob)))
+	if sums == nil {
+		return sum, nil
 	}
-	rv := float64(0)
-	for _, i := range l {
-		rv += zeroate(i)
+	if numbers {
+		return nil, fmt.Errorf("_sum of both numbers and arrays")
 	}
-	return ottoMust(otto.ToValue(rv))
+	return sums, nil
 }
 
-func javascriptReduceCount(call otto.FunctionCall) otto.Value {
-	rere, err := call.Argument(2).ToBoolean()
-	if err != nil {
-		return ottoMust(otto.ToValue(fmt.Sprintf("Error getting rere flag: %v", err)))
+// Counts the values, where rereducing sums the counts.
+func reduceCount(keys, values []interface{}, rereduce bool) (interface{}, error) {
+	if !rereduce {
+		return float64(len(values)), nil
 	}
-
-	ob, err := call.Argument(1).Export()
-	if err != nil {
-		return ottoMust(otto.ToValue(fmt.Sprintf("Error getting stuff: %v", err)))
-	}
-	l, ok := ob.([]interface{})
-	if !ok {
-		return ottoMust(otto.ToValue(fmt.Sprintf("unhandled %v/%T", ob, ob)))
-	}
-
-	if !rere {
-		return ottoMust(otto.ToValue(len(l)))
-	}
-
 	rv := float64(0)
-	for _, i := range l {
-		rv += zeroate(i)
+	for _, v := range values {
+		rv += zeroate(v)
 	}
-	return ottoMust(otto.ToValue(rv))
+	return rv, nil
 }
 
 type statsResult struct {
@@ -81,8 +147,8 @@ type statsResult struct {
 	count                 int
 }
 
-func (s statsResult) toMap() map[string]float64 {
-	return map[string]float64{
+func (s statsResult) toMap() map[string]interface{} {
+	return map[string]interface{}{
 		"sum":    s.sum,
 		"count":  float64(s.count),
 		"min":    s.min,
@@ -91,11 +157,6 @@ func (s statsResult) toMap() map[string]float64 {
 	}
 }
 
-func (s statsResult) toOtto() otto.Value {
-	o := otto.New()
-	return ottoMust(o.ToValue(s.toMap()))
-}
-
 func (s *statsResult) load(ob interface{}) {
 	m, ok := ob.(map[string]interface{})
 	if !ok {
@@ -108,7 +169,16 @@ func (s *statsResult) load(ob interface{}) {
 	s.sumsqr = zeroate(m["sumsqr"])
 }
 
+// Adds the stats of other values, where stats of no values (whose
+// min and max are just zeros) don't count.
 func (s *statsResult) Add(from statsResult) {
+	if from.count == 0 {
+		return
+	}
+	if s.count == 0 {
+		*s = from
+		return
+	}
 	s.sum += from.sum
 	s.count += from.count
 	s.min = math.Min(s.min, from.min)
@@ -116,55 +186,148 @@ func (s *statsResult) Add(from statsResult) {
 	s.sumsqr += from.sumsqr
 }
 
-func javascriptReduceStats(call otto.FunctionCall) otto.Value {
-	rere, err := call.Argument(2).ToBoolean()
-	if err != nil {
-		return ottoMust(otto.ToValue(fmt.Sprintf("Error getting rere flag: %v", err)))
+// The sum, count, min, max and sum of squares of numbers, where
+// rereducing combines earlier stats.
+func reduceStats(keys, values []interface{}, rereduce bool) (interface{}, error) {
+	rv := statsResult{}
+	for _, v := range values {
+		ob := statsResult{}
+		if rereduce {
+			ob.load(v)
+		} else {
+			x := zeroate(v)
+			ob = statsResult{sum: x, min: x, max: x, sumsqr: x * x, count: 1}
+		}
+		rv.Add(ob)
 	}
+	return rv.toMap(), nil
+}
+
+// The approximate number of distinct keys, by HyperLogLog, whose
+// registers are the reductions.  The registers of few keys are kept
+// sparse, as a sorted array of register index and value pairs, each
+// packed as index<<8|value, and otherwise dense, as base64 bytes.
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+	hllMaxSparse = 256
+)
 
-	ob, err := call.Argument(1).Export()
+type hllRegs []uint8
+
+func (h hllRegs) add(key interface{}) error {
+	j, err := json.Marshal(key)
 	if err != nil {
-		return ottoMust(otto.ToValue(fmt.Sprintf("Error getting stuff: %v", err)))
+		return err
 	}
-	l, ok := ob.([]interface{})
-	if !ok {
-		return ottoMust(otto.ToValue(fmt.Sprintf("unhandled %v/%T", ob, ob)))
+	f := fnv.New64a()
+	f.Write(j)
+	x := f.Sum64()
+	i := x >> (64 - hllPrecision)
+	rank := uint8(1)
+	for w := x << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
 	}
+	if rank > h[i] {
+		h[i] = rank
+	}
+	return nil
+}
 
-	rv := statsResult{}
-
-	if len(l) == 0 {
-		return rv.toOtto()
+func (h hllRegs) load(ob interface{}) error {
+	m, ok := ob.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("_approx_count_distinct unexpected reduction: %v", ob)
 	}
+	switch regs := m["registers"].(type) {
+	case string:
+		b, err := base64.StdEncoding.DecodeString(regs)
+		if err != nil || len(b) != hllRegisters {
+			return fmt.Errorf("_approx_count_distinct bad registers: %v", err)
+		}
+		for i, r := range b {
+			if r > h[i] {
+				h[i] = r
+			}
+		}
+	case []interface{}:
+		for _, p := range regs {
+			packed := int(zeroate(p))
+			i, r := packed>>8, uint8(packed&0xff)
+			if i < 0 || i >= hllRegisters {
+				return fmt.Errorf("_approx_count_distinct bad register: %v", i)
+			}
+			if r > h[i] {
+				h[i] = r
+			}
+		}
+	default:
+		return fmt.Errorf("_approx_count_distinct missing registers")
+	}
+	return nil
+}
 
-	if rere {
-		// Rereduction goes here.
-		rv.load(l[0])
-		for i := 1; i < len(l); i++ {
-			ob := statsResult{}
-			ob.load(l[i])
-			rv.Add(ob)
+func (h hllRegs) toMap() map[string]interface{} {
+	sparse := []int{}
+	for i, r := range h {
+		if r > 0 {
+			sparse = append(sparse, i<<8|int(r))
 		}
-		return rv.toOtto()
 	}
+	if len(sparse) > hllMaxSparse {
+		return map[string]interface{}{
+			"registers": base64.StdEncoding.EncodeToString(h),
+		}
+	}
+	sort.Ints(sparse)
+	regs := make([]interface{}, len(sparse))
+	for i, p := range sparse {
+		regs[i] = float64(p)
+	}
+	return map[string]interface{}{"registers": regs}
+}
 
-	// Initial reduction
-	rv.count = 1
-	rv.sum = zeroate(l[0])
-	rv.min = rv.sum
-	rv.max = rv.sum
-	rv.sumsqr = rv.sum * rv.sum
+func (h hllRegs) estimate() float64 {
+	m := float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range h {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros)) // Small range correction.
+	}
+	return math.Floor(e + 0.5)
+}
 
-	for i := 1; i < len(l); i++ {
-		v := zeroate(l[i])
-		rv.count++
-		rv.sum += v
-		rv.min = math.Min(rv.min, v)
-		rv.max = math.Max(rv.max, v)
-		rv.sumsqr += (v * v)
+func reduceApproxCountDistinct(keys, values []interface{},
+	rereduce bool) (interface{}, error) {
+	h := make(hllRegs, hllRegisters)
+	if !rereduce {
+		for _, key := range keys {
+			if err := h.add(key); err != nil {
+				return nil, err
+			}
+		}
+		return h.toMap(), nil
 	}
+	for _, v := range values {
+		if err := h.load(v); err != nil {
+			return nil, err
+		}
+	}
+	return h.toMap(), nil
+}
 
-	return rv.toOtto()
+func finalizeApproxCountDistinct(value interface{}) (interface{}, error) {
+	h := make(hllRegs, hllRegisters)
+	if err := h.load(value); err != nil {
+		return nil, err
+	}
+	return h.estimate(), nil
 }
 
 func must(err error) {
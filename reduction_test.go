@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"math"
 	"testing"
@@ -78,3 +79,78 @@ func TestZeroate(t *testing.T) {
 		}
 	}
 }
+
+func TestBuiltinReducers(t *testing.T) {
+	for _, src := range []string{"_sum", "_count", " _stats\n",
+		"_approx_count_distinct"} {
+		v := &View{Reduce: src}
+		r, err := v.GetViewReduceFunction()
+		if err != nil || r.builtin == nil || r.otto != nil {
+			t.Errorf("expected %q to be a native reducer, got: %#v, %v",
+				src, r, err)
+		}
+	}
+	v := &View{Reduce: "function(keys, values) { return _count(keys, values); }"}
+	if r, err := v.GetViewReduceFunction(); err != nil || r.builtin != nil {
+		t.Errorf("expected a javascript reducer, got: %#v, %v", r, err)
+	}
+
+	if _, err := reduceSum(nil, []interface{}{1.0, []interface{}{2.0}},
+		false); err == nil {
+		t.Errorf("expected _sum of numbers and arrays to fail")
+	}
+	res, err := reduceCount(nil, []interface{}{3.0, 4.0}, true)
+	if err != nil || res != 7.0 {
+		t.Errorf("expected _count rereduce to sum, got: %v, %v", res, err)
+	}
+}
+
+func TestApproxCountDistinct(t *testing.T) {
+	// Partial reductions per key, as a vbucket keeps them, with the
+	// keys spread over (and repeated across) a few vbuckets.
+	n := 20000
+	partials := []interface{}{}
+	for vb := 0; vb < 4; vb++ {
+		group := []interface{}{}
+		for i := vb * n / 8; i < vb*n/8+n/2 && i < n; i++ {
+			key := []interface{}{"k", float64(i)}
+			p, err := reduceApproxCountDistinct([]interface{}{key, key},
+				[]interface{}{nil, nil}, false)
+			if err != nil {
+				t.Fatalf("expected reduce to work, got: %v", err)
+			}
+			group = append(group, p)
+		}
+		// Rereduce through JSON, as stored.
+		p, err := reduceApproxCountDistinct(nil, group, true)
+		if err != nil {
+			t.Fatalf("expected rereduce to work, got: %v", err)
+		}
+		j, _ := json.Marshal(p)
+		var stored interface{}
+		json.Unmarshal(j, &stored)
+		partials = append(partials, stored)
+	}
+	p, err := reduceApproxCountDistinct(nil, partials, true)
+	if err != nil {
+		t.Fatalf("expected rereduce to work, got: %v", err)
+	}
+	res, err := finalizeApproxCountDistinct(p)
+	if err != nil {
+		t.Fatalf("expected finalize to work, got: %v", err)
+	}
+	distinct := float64(n/8*3 + n/2)
+	if got := res.(float64); math.Abs(got-distinct) > distinct*0.05 {
+		t.Errorf("expected about %v distinct keys, got: %v", distinct, got)
+	}
+
+	// Few keys stay sparse, and are counted about exactly.
+	p, _ = reduceApproxCountDistinct([]interface{}{"a", "b", "a", "c"},
+		[]interface{}{1.0, 2.0, 3.0, 4.0}, false)
+	if _, ok := p.(map[string]interface{})["registers"].([]interface{}); !ok {
+		t.Errorf("expected sparse registers, got: %#v", p)
+	}
+	if res, _ = finalizeApproxCountDistinct(p); res != 3.0 {
+		t.Errorf("expected 3 distinct keys, got: %v", res)
+	}
+}
@@ -45,3 +45,31 @@ assert("builtin_stats rere sum", statsed.sum, 239);
 assert("builtin_stats rere sumsqr", statsed.sumsqr, 35781);
 assert("builtin_stats rere min", statsed.min, 1);
 assert("builtin_stats rere max", statsed.max, 187);
+
+// Partial stats of no values don't drag the min and max to zero.
+statsed = _stats([], [_stats([], [], false),
+                      _stats(["a", "b"], [3, 4], false)], true);
+
+assert("builtin_stats rere empty count", statsed.count, 2);
+assert("builtin_stats rere empty min", statsed.min, 3);
+assert("builtin_stats rere empty max", statsed.max, 4);
+
+statsed = _stats([], [_stats(["a", "b"], [-3, -4], false),
+                      _stats([], [], false)], true);
+
+assert("builtin_stats rere negative max", statsed.max, -3);
+
+//
+// _sum of arrays
+//
+
+var summed = _sum(["a", "b"], [[1, 2], [3, 4, 5]], false);
+
+assert("builtin_sum arrays 0", summed[0], 4);
+assert("builtin_sum arrays 1", summed[1], 6);
+assert("builtin_sum arrays 2", summed[2], 5);
+
+summed = _sum([], [summed, [10]], true);
+
+assert("builtin_sum arrays rere 0", summed[0], 14);
+assert("builtin_sum arrays rere 2", summed[2], 5);
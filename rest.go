@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -27,10 +28,18 @@ func restAPI(r *mux.Router) {
 		restDeleteBucket).Methods("DELETE")
 	sr.HandleFunc("/buckets/{bucketname}/compact",
 		restPostBucketCompact).Methods("POST")
+	sr.HandleFunc("/compactions",
+		restGetCompactions).Methods("GET")
+	sr.HandleFunc("/compactions/{taskid}/{action}",
+		restPostCompaction).Methods("POST")
 	sr.HandleFunc("/buckets/{bucketname}/flushDirty",
 		restPostBucketFlushDirty).Methods("POST")
+	sr.HandleFunc("/buckets/{bucketname}/ddocs/{docId}/publish",
+		restPostBucketDDocPublish).Methods("POST")
 	sr.HandleFunc("/buckets/{bucketname}/stats",
 		restGetBucketStats).Methods("GET")
+	sr.HandleFunc("/buckets/{bucketname}/diskUsage",
+		restGetBucketDiskUsage).Methods("GET")
 	sr.HandleFunc("/bucketsRescan",
 		restPostBucketsRescan).Methods("POST")
 	sr.HandleFunc("/profile/cpu",
@@ -45,6 +54,12 @@ func restAPI(r *mux.Router) {
 		restPostRuntimeGC).Methods("POST")
 	sr.HandleFunc("/settings",
 		restGetSettings).Methods("GET")
+	sr.HandleFunc("/fileFaults",
+		restGetFileFaults).Methods("GET")
+	sr.HandleFunc("/fileFaults",
+		restPostFileFaults).Methods("POST")
+	sr.HandleFunc("/fileFaults",
+		restDeleteFileFaults).Methods("DELETE")
 
 	r.PathPrefix("/_api/").HandlerFunc(authError)
 }
@@ -78,6 +93,32 @@ func restGetSettings(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// To make store files fail, for testing...
+//    curl -X POST http://127.0.0.1:8077/_api/fileFaults \
+//      -d '{"writeENOSPCProb":0.5,"latencyMs":10}'
+func restGetFileFaults(w http.ResponseWriter, r *http.Request) {
+	jsonEncode(w, getFileFaults())
+}
+
+func restPostFileFaults(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read request body, err: %v", err), 400)
+		return
+	}
+	ff, err := parseFileFaults(string(b))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse file faults, err: %v", err), 400)
+		return
+	}
+	setFileFaults(ff)
+	jsonEncode(w, ff)
+}
+
+func restDeleteFileFaults(w http.ResponseWriter, r *http.Request) {
+	setFileFaults(nil)
+}
+
 func restGetBuckets(w http.ResponseWriter, r *http.Request) {
 	jsonEncode(w, buckets.GetNames())
 }
@@ -114,6 +155,45 @@ func restPostBucket(w http.ResponseWriter, r *http.Request) {
 		bucketSettings.QuotaBytes)
 	bSettings.MemoryOnly = int(getIntValue(r, "memoryOnly",
 		int64(bucketSettings.MemoryOnly)))
+	bSettings.FlushDirtyItems = getIntValue(r, "flushDirtyItems",
+		bucketSettings.FlushDirtyItems)
+	bSettings.FlushDirtyBytes = getIntValue(r, "flushDirtyBytes",
+		bucketSettings.FlushDirtyBytes)
+	bSettings.CompactFragmentation = int(getIntValue(r, "compactFragmentation",
+		int64(bucketSettings.CompactFragmentation)))
+	if v := r.FormValue("compactWindow"); v != "" {
+		if _, err = parseTimeWindow(v); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		bSettings.CompactWindow = v
+	}
+	bSettings.NumStores = int(getIntValue(r, "numStores",
+		int64(bucketSettings.NumStores)))
+	if err = checkNumStores(bSettings.NumStores); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	bSettings.DevSubsetPartitions = int(getIntValue(r, "devSubsetPartitions",
+		int64(bucketSettings.DevSubsetPartitions)))
+	if err = checkDevSubsetPartitions(bSettings.DevSubsetPartitions); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if v := r.FormValue("durability"); v != "" {
+		if err = checkDurability(v); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		bSettings.Durability = v
+	}
+	if v := r.FormValue("encryptionKeyName"); v != "" {
+		if err = checkEncryptionKeyName(v); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		bSettings.EncryptionKeyName = v
+	}
 
 	_, err = createBucket(bucketName, bSettings)
 	if err != nil {
@@ -174,6 +254,39 @@ func restPostBucketCompact(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func restGetCompactions(w http.ResponseWriter, r *http.Request) {
+	jsonEncode(w, compactTasks.list())
+}
+
+// To pause, resume or cancel a compaction task...
+//    curl -X POST http://127.0.0.1:8077/_api/compactions/compact-1/pause
+func restPostCompaction(w http.ResponseWriter, r *http.Request) {
+	taskId := mux.Vars(r)["taskid"]
+	task := compactTasks.get(taskId)
+	if task == nil {
+		http.Error(w, fmt.Sprintf("no compaction task: %v", taskId), 404)
+		return
+	}
+	var ok bool
+	switch action := mux.Vars(r)["action"]; action {
+	case "pause":
+		ok = task.Pause()
+	case "resume":
+		ok = task.Resume()
+	case "cancel":
+		ok = task.Cancel()
+	default:
+		http.Error(w, fmt.Sprintf("unknown compaction action: %v", action), 400)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("compaction task already finished: %v",
+			taskId), 409)
+		return
+	}
+	jsonEncode(w, task.Info())
+}
+
 func restPostBucketFlushDirty(w http.ResponseWriter, r *http.Request) {
 	bucketName, bucket := parseBucketName(w, r)
 	if bucket == nil {
@@ -185,6 +298,30 @@ func restPostBucketFlushDirty(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// To copy a dev design doc to production, as in _design/dev_foo to
+// _design/foo...
+//    curl -X POST http://127.0.0.1:8077/_api/buckets/default/ddocs/dev_foo/publish
+func restPostBucketDDocPublish(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, r)
+	if bucket == nil {
+		return
+	}
+	ddocId := "_design/" + mux.Vars(r)["docId"]
+	if !isDevDDocId(ddocId) {
+		http.Error(w, fmt.Sprintf("not a dev design doc: %v", ddocId), 400)
+		return
+	}
+	err := publishDDoc(bucket, ddocId)
+	if err == ddocNotFound {
+		http.Error(w, fmt.Sprintf("no design doc: %v", ddocId), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error publishing design doc: %v,"+
+			" bucket: %v, err: %v", ddocId, bucketName, err), 500)
+	}
+}
+
 func restGetBucketStats(w http.ResponseWriter, r *http.Request) {
 	_, bucket := parseBucketName(w, r)
 	if bucket == nil {
@@ -201,6 +338,27 @@ func restGetBucketStats(w http.ResponseWriter, r *http.Request) {
 	jsonEncode(w, st.ToMap())
 }
 
+func restGetBucketDiskUsage(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, r)
+	if bucket == nil {
+		return
+	}
+	bucketPath, err := buckets.Path(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("no bucket path: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	du, err := diskUsage(bucketPath, bucket.GetBucketSettings().numStores(),
+		STORE_FILE_SUFFIX)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading disk usage of bucket: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	jsonEncode(w, du)
+}
+
 // To start a cpu profiling...
 //    curl -X POST http://127.0.0.1:8077/_api/profile/cpu -d secs=5
 // To analyze a profiling...
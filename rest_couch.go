@@ -12,13 +12,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +26,6 @@ import (
 	"github.com/couchbaselabs/walrus"
 	"github.com/dustin/gomemcached"
 	"github.com/gorilla/mux"
-	"github.com/robertkrimen/otto"
 )
 
 func restCouchServe(rest string, staticPath string) {
@@ -65,12 +64,23 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 
 	dbr.Handle("/_all_docs",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbAllDocs))).
-		Methods("GET")
+		Methods("GET", "POST")
+
+	dbr.Handle("/_query",
+		http.HandlerFunc(couchDbQuery)).
+		Methods("GET", "POST")
 
 	dbr.Handle("/_design/{docId}/_view/{viewId}",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbGetView))).
+		Methods("GET", "POST")
+	dbr.Handle("/_design/{docId}/_view/{viewId}/_errors",
+		http.HandlerFunc(couchDbGetViewErrors)).Methods("GET")
+	dbr.Handle("/_design/{docId}/_spatial/{viewId}",
+		http.HandlerFunc(deadlinedHandler(time.Second, couchDbGetSpatial))).
 		Methods("GET")
 
+	dbr.Handle("/_design/{docId}/_info",
+		http.HandlerFunc(couchDbGetDesignDocInfo)).Methods("GET")
 	dbr.Handle("/_design/{docId}",
 		http.HandlerFunc(couchDbGetDesignDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/_design/{docId}",
@@ -185,6 +195,10 @@ func couchDbPutDesignDoc(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
 		return
 	}
+	if _, err = checkDDoc(body); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
+		return
+	}
 	if err = bucket.SetDDoc("_design/"+ddocId, body); err != nil {
 		http.Error(w, fmt.Sprintf("Internal Server Error, err: %v", err), 500)
 		return
@@ -192,8 +206,38 @@ func couchDbPutDesignDoc(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(201)
 }
 
+func couchDbGetDesignDocInfo(w http.ResponseWriter, r *http.Request) {
+	_, _, bucket, ddocId := checkDocId(w, r)
+	if bucket == nil || ddocId == "" {
+		return
+	}
+	info, err := ddocInfo(bucket, "_design/"+ddocId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Server Error, err: %v", err), 500)
+		return
+	}
+	if info == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	jsonEncode(w, info)
+}
+
 func couchDbDelDesignDoc(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "unimplemented", 501)
+	_, _, bucket, ddocId := checkDocId(w, r)
+	if bucket == nil || ddocId == "" {
+		return
+	}
+	err := bucket.DelDDoc("_design/" + ddocId)
+	if err == ddocNotFound {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Server Error, err: %v", err), 500)
+		return
+	}
+	w.WriteHeader(200)
 }
 
 func couchDbGetDb(w http.ResponseWriter, r *http.Request) {
@@ -364,191 +408,307 @@ func deadlinedHandler(deadline time.Duration, h http.HandlerFunc) http.HandlerFu
 	}
 }
 
-func couchDbGetView(w http.ResponseWriter, r *http.Request) {
-	p, err := ParseViewParams(r)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("view param parsing err: %v", err), 400)
-		return
-	}
-
+// Returns the design doc view (or spatial view) named by a request's
+// path, or else responds with an error and returns a nil view.
+func checkDDocView(w http.ResponseWriter, r *http.Request, spatial bool) (
+	Bucket, *DDocs, string, *View) {
 	vars, _, bucket, ddocId := checkDocId(w, r)
 	if bucket == nil || ddocId == "" {
-		return
+		return nil, nil, "", nil
 	}
 	viewId, ok := vars["viewId"]
 	if !ok || viewId == "" {
 		http.Error(w, "missing viewId from path", 400)
-		return
+		return nil, nil, "", nil
 	}
 	ddocs := bucket.GetDDocs()
 	if ddocs == nil {
 		http.Error(w, "getDDocs nil", 500)
-		return
+		return nil, nil, "", nil
 	}
 	ddoc, ok := (*ddocs)["_design/"+ddocId]
 	if !ok {
 		http.Error(w, "design doc not found", 404)
-		return
+		return nil, nil, "", nil
 	}
-	view, ok := ddoc.Views[viewId]
+	views := ddoc.Views
+	if spatial {
+		views = ddoc.spatialViews
+	}
+	view, ok := views[viewId]
 	if !ok {
 		http.Error(w, "view not found", 404)
-		return
+		return nil, nil, "", nil
 	}
-	if view.Map == "" {
-		http.Error(w, "view map function missing", 400)
+	return bucket, ddocs, ddocId, view
+}
+
+// Responds with the recent errors of a view's functions on docs.
+func couchDbGetViewErrors(w http.ResponseWriter, r *http.Request) {
+	bucket, _, _, view := checkDDocView(w, r, false)
+	if view == nil {
 		return
 	}
+	jsonEncode(w, map[string]interface{}{
+		"errors": bucket.GetViewErrors(view.hash()),
+	})
+}
 
-	o := otto.New()
-	fnv, err := OttoNewFunction(o, view.Map)
+// Answers a bounding box query of a spatial view, as in
+// ?bbox=west,south,east,north, which defaults to the whole world,
+// with the skip, limit, include_docs, stale and full_set params.
+func couchDbGetSpatial(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseViewParams(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("view map function error: %v", err), 400)
+		http.Error(w, fmt.Sprintf("view param parsing err: %v", err), 400)
 		return
 	}
-
-	emits := []*ViewRow{}
-	var emitErr error
-
-	o.Set("emit", func(call otto.FunctionCall) otto.Value {
-		var key, value interface{}
-		var err error
-
-		if len(call.ArgumentList) <= 0 {
-			emitErr = fmt.Errorf("emit() invoked with no parameters")
-			return otto.UndefinedValue()
-		}
-		key, err = call.ArgumentList[0].Export()
-		if err != nil {
-			emitErr = err
-			return otto.UndefinedValue()
+	bbox := spatialBbox{-180, -90, 180, 90}
+	if param := r.FormValue("bbox"); param != "" {
+		if bbox, err = parseSpatialBboxParam(param); err != nil {
+			http.Error(w, fmt.Sprintf("view param parsing err: %v", err), 400)
+			return
 		}
+	}
 
-		if len(call.ArgumentList) >= 2 {
-			value, err = call.ArgumentList[1].Export()
-			if err != nil {
-				emitErr = err
-				return otto.UndefinedValue()
-			}
+	bucket, ddocs, ddocId, view := checkDDocView(w, r, true)
+	if view == nil {
+		return
+	}
+	viewName := view.hash()
+	devSubset := isDevDDocId("_design/" + ddocId)
+	if devSubset && p.FullSet {
+		if err = devViewFullSet(bucket, ddocs, viewName); err != nil {
+			http.Error(w, fmt.Sprintf("full_set error: %v", err), 500)
+			return
 		}
+		devSubset = false
+	}
+	vbs, err := viewQueryVBuckets(bucket, devSubset, p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("view query error: %v", err), 400)
+		return
+	}
+	defer viewQueryDone(vbs, p)
 
-		emits = append(emits, &ViewRow{Key: key, Value: value})
-		return otto.UndefinedValue()
-	})
-
-	vr := &ViewResult{Rows: make([]*ViewRow, 0, 100)}
-	np := bucket.GetBucketSettings().NumPartitions
-	for vbid := 0; vbid < np; vbid++ {
-		vb, _ := bucket.GetVBucket(uint16(vbid))
-		if vb != nil {
-			var errVisit error
-			numErr := 0
-			err = vb.Visit(nil, func(key []byte, data []byte) bool {
-				docId := string(key)
-
-				if numErr > maxViewErrors {
-					return false
-				}
-
-				docType := "json"
-				var doc interface{}
-				err := json.Unmarshal(data, &doc)
-				if err != nil {
-					doc = base64.StdEncoding.EncodeToString(data)
-					docType = "base64"
-				}
-
-				odoc, err := OttoFromGo(o, doc)
-				if err != nil {
-					log.Printf("Error sending object into otto %s: %v",
-						data, err)
-					errVisit = err
-					return false
-				}
-
-				meta := map[string]interface{}{
-					"id":   docId,
-					"type": docType,
-				}
-				ometa, err := OttoFromGo(o, meta)
-				if err != nil {
-					log.Printf("Error sending meta object into otto: %v -> %v",
-						meta, err)
-					errVisit = err
-					return false
-				}
+	rows, err := querySpatialIndexes(vbs, viewName, bbox)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("spatial query error: %v", err), 500)
+		return
+	}
+	if p.Skip >= uint64(len(rows)) {
+		rows = rows[:0]
+	} else {
+		rows = rows[p.Skip:]
+	}
+	if p.Limit > 0 && p.Limit < uint64(len(rows)) {
+		rows = rows[:p.Limit]
+	}
+	if p.IncludeDocs {
+		for _, row := range rows {
+			vr := &ViewRow{Id: row.Id}
+			docifyViewRow(bucket, vr)
+			row.Doc = vr.Doc
+		}
+	}
+	jsonEncode(w, map[string]interface{}{"rows": rows})
+}
 
-				_, err = fnv.Call(fnv, odoc, ometa)
-				if err != nil {
-					log.Printf("Error executing view function on %s (%s) -> %v",
-						key, data, err)
-					numErr++
-					errVisit = err
-					return true
-				}
+func couchDbGetView(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseViewParams(r)
+	if err == nil {
+		err = parseViewKeysBody(r, p)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("view param parsing err: %v", err), 400)
+		return
+	}
 
-				for _, emit := range emits {
-					emit.Id = docId
-				}
+	bucket, ddocs, ddocId, view := checkDDocView(w, r, false)
+	if view == nil {
+		return
+	}
+	if view.Map == "" && view.Pointers == nil {
+		http.Error(w, "view map function missing", 400)
+		return
+	}
 
-				vr.Rows = append(vr.Rows, emits...)
-				emits = emits[:0]
-				return true
-			})
-			if err != nil {
-				http.Error(w, fmt.Sprintf("view visit error: %v",
-					err), 400)
-				return
-			}
-			if numErr > maxViewErrors && errVisit != nil {
-				http.Error(w, fmt.Sprintf("view visit function error: %v",
-					errVisit), 400)
-				return
-			}
+	viewName := view.hash()
+	// Dev design docs only index a subset of the vbuckets, unless
+	// full_set=true asks for all of them.
+	devSubset := isDevDDocId("_design/" + ddocId)
+	if devSubset && p.FullSet {
+		if err = devViewFullSet(bucket, ddocs, viewName); err != nil {
+			http.Error(w, fmt.Sprintf("full_set error: %v", err), 500)
+			return
 		}
+		devSubset = false
+	}
+	reduce := view.Reduce != "" && p.Reduce
+	vbs, err := viewQueryVBuckets(bucket, devSubset, p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("view query error: %v", err), 400)
+		return
 	}
-	sort.Sort(vr.Rows)
+	defer viewQueryDone(vbs, p)
 
-	// TODO: Handle p.Keys.
+	totalRows := -1 // Reduce queries have no total_rows, as in CouchDB.
+	if !reduce {
+		if totalRows, err = viewIndexTotalRows(vbs, viewName); err != nil {
+			http.Error(w, fmt.Sprintf("view total rows error: %v", err), 500)
+			return
+		}
+	}
+	var updateSeq uint64
+	if p.UpdateSeq {
+		if updateSeq, err = viewsUpdateSeq(vbs); err != nil {
+			http.Error(w, fmt.Sprintf("view update_seq error: %v", err), 500)
+			return
+		}
+	}
 
-	vr, err = processViewResult(bucket, vr, p)
+	// Reduce and keys queries are small enough to gather up front,
+	// while other queries stream their rows straight from the indexes.
+	var vr *ViewResult
+	if p.Keys != nil {
+		vr, err = queryViewKeys(vbs, view, viewName, reduce, p)
+	} else if reduce {
+		vr, err = queryView(vbs, view, viewName, reduce, p)
+	}
+	if err == nil && reduce {
+		vr, err = finalizeViewResult(vr, view)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("processViewResult error: %v", err), 400)
+		http.Error(w, fmt.Sprintf("view query error: %v", err), 400)
 		return
 	}
-	if view.Reduce == "" || p.Reduce == false {
-		// TODO: Handle p.UpdateSeq.
-		if p.IncludeDocs {
-			vr, err = docifyViewResult(bucket, vr)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("docifyViewResults error: %v", err), 500)
-				return
-			}
+
+	vw := startViewResult(w, totalRows, p.UpdateSeq, updateSeq)
+	skip, limit := p.Skip, p.Limit
+	visitor := func(row *ViewRow) bool {
+		if skip > 0 {
+			skip--
+			return true
 		}
-	} else {
-		vr, err = reduceViewResult(bucket, vr, p, view.Reduce)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("reduceViewResult error: %v", err), 400)
-			return
+		if !reduce && p.IncludeDocs {
+			docifyViewRow(bucket, row)
 		}
+		if err := vw.row(row); err != nil {
+			return false
+		}
+		return limit == 0 || uint64(vw.n) < limit
 	}
-	skip := int(p.Skip)
-	if skip > 0 {
-		if skip > len(vr.Rows) {
-			skip = len(vr.Rows)
+	if vr != nil {
+		for _, row := range vr.Rows {
+			if !visitor(row) {
+				break
+			}
 		}
-		vr.Rows = vr.Rows[skip:]
+	} else {
+		err = streamViewIndexes(vbs, viewName, p, visitor)
+	}
+	vw.end(err)
+}
+
+// Writes a view response as its rows come, like _all_docs does.
+type viewResultWriter struct {
+	w http.ResponseWriter
+	n int
+}
+
+// Starts a view response, where a negative totalRows is left out.
+func startViewResult(w http.ResponseWriter, totalRows int,
+	withUpdateSeq bool, updateSeq uint64) *viewResultWriter {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-type", "application/json")
+	w.Write([]byte("{"))
+	if totalRows >= 0 {
+		fmt.Fprintf(w, `"total_rows":%v,`, totalRows)
+	}
+	if withUpdateSeq {
+		fmt.Fprintf(w, `"update_seq":%v,`, updateSeq)
+	}
+	w.Write([]byte(`"rows":[`))
+	return &viewResultWriter{w: w}
+}
+
+func (vw *viewResultWriter) row(row *ViewRow) error {
+	j, err := json.Marshal(row)
+	if err != nil {
+		return err
 	}
-	limit := int(p.Limit)
-	if limit > 0 {
-		if limit > len(vr.Rows) {
-			limit = len(vr.Rows)
+	if vw.n > 0 {
+		vw.w.Write([]byte(",\n"))
+	}
+	if _, err = vw.w.Write(j); err != nil {
+		return err
+	}
+	vw.n++
+	return nil
+}
+
+// Ends a view response, where an error that came up after the
+// response started goes into an error field.
+func (vw *viewResultWriter) end(err error) {
+	vw.w.Write([]byte("]"))
+	if err != nil {
+		j, _ := json.Marshal(err.Error())
+		fmt.Fprintf(vw.w, `,"error":%s`, j)
+	}
+	vw.w.Write([]byte("}\n"))
+}
+
+// Returns the (reduced) rows of a view query, in the query's order.
+func queryView(vbs []*VBucket, view *View, viewName string,
+	reduce bool, p *ViewParams) (*ViewResult, error) {
+	if !reduce {
+		return queryViewIndexes(vbs, viewName, p)
+	}
+	return queryViewReductions(vbs, view, viewName, p)
+}
+
+// Returns the rows of a view query with a keys param, as a query per
+// key, with the rows in the requested key order.  Unless grouped, a
+// reduce query reduces the rows of all the keys into one row.
+func queryViewKeys(vbs []*VBucket, view *View, viewName string,
+	reduce bool, p *ViewParams) (*ViewResult, error) {
+	rows := ViewRows{}
+	for _, key := range p.Keys {
+		kp := *p
+		kp.Keys = nil
+		kp.Key = key
+		vr, err := queryView(vbs, view, viewName, reduce, &kp)
+		if err != nil {
+			return nil, err
 		}
-		vr.Rows = vr.Rows[:limit]
+		rows = append(rows, vr.Rows...)
+	}
+	vr := &ViewResult{Rows: rows}
+	if reduce && !p.Group && p.GroupLevel == 0 && len(rows) > 1 {
+		return rereduceViewResult(vr, p, view)
 	}
-	vr.TotalRows = len(vr.Rows)
+	return vr, nil
+}
 
-	jsonEncode(w, vr)
+// Takes the keys param from a POST body, as in {"keys": [...]}.
+func parseViewKeysBody(r *http.Request, p *ViewParams) error {
+	if r.Method != "POST" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(strings.TrimSpace(string(body))) == 0 {
+		return err
+	}
+	var b struct {
+		Keys []interface{} `json:"keys"`
+	}
+	if err = json.Unmarshal(body, &b); err != nil {
+		return err
+	}
+	if b.Keys != nil {
+		p.Keys = b.Keys
+	}
+	return nil
 }
 
 func checkDb(w http.ResponseWriter, r *http.Request) (
@@ -620,180 +780,187 @@ func checkDocId(w http.ResponseWriter, r *http.Request) (
 	return vars, bucketName, bucket, docId
 }
 
-// Originally from github.com/couchbaselabs/walrus, but modified to
-// use ViewParams.
-
-func processViewResult(bucket Bucket, result *ViewResult,
-	p *ViewParams) (*ViewResult, error) {
-	if p.Key != nil {
-		p.StartKey = p.Key
-		p.EndKey = p.Key
-	}
-
-	if p.StartKey != nil {
-		i := sort.Search(len(result.Rows), func(i int) bool {
-			return walrus.CollateJSON(result.Rows[i].Key, p.StartKey) >= 0
-		})
-		if p.Descending {
-			result.Rows = result.Rows[:i+1]
-		} else {
-			result.Rows = result.Rows[i:]
-		}
+func reverseViewRows(r ViewRows) {
+	num := len(r)
+	mid := num / 2
+	for i := 0; i < mid; i++ {
+		r[i], r[num-i-1] = r[num-i-1], r[i]
 	}
+}
 
-	if p.EndKey != nil {
-		i := sort.Search(len(result.Rows), func(i int) bool {
-			if p.InclusiveEnd {
-				return walrus.CollateJSON(result.Rows[i].Key, p.EndKey) > 0
+func docifyViewRow(bucket Bucket, row *ViewRow) {
+	if row.Id != "" {
+		res := GetItem(bucket, []byte(row.Id), VBActive)
+		if res.Status == gomemcached.SUCCESS {
+			var parsedDoc interface{}
+			err := json.Unmarshal(res.Body, &parsedDoc)
+			if err == nil {
+				row.Doc = &ViewDocValue{
+					Meta: map[string]interface{}{
+						"id":  row.Id,
+						"rev": itemRev(res.Cas),
+					},
+					Json: parsedDoc,
+				}
+			} else {
+				// TODO: Is this the right encoding for non-json?
+				// no
+				// row.Doc = Bytes(res.Body)
 			}
-			return walrus.CollateJSON(result.Rows[i].Key, p.EndKey) >= 0
-		})
-		if p.Descending {
-			result.Rows = result.Rows[i:]
-		} else {
-			result.Rows = result.Rows[:i]
-		}
-	}
-
-	if p.Descending {
-		reverseViewRows(result.Rows)
+		} // TODO: Handle else-case when no doc.
 	}
+}
 
-	return result, nil
+// The range of doc ids of an _all_docs query, in visiting order, so
+// start is the greatest doc id when descending.
+type allDocsRange struct {
+	start, end   []byte // Nil when unbounded.
+	inclusiveEnd bool
+	descending   bool
 }
 
-func reduceViewResult(bucket Bucket, result *ViewResult,
-	p *ViewParams, reduceFunction string) (*ViewResult, error) {
-	groupLevel := 0
-	if p.Group {
-		groupLevel = 0x7fffffff
+func parseAllDocsRange(p *ViewParams) (*allDocsRange, error) {
+	r := &allDocsRange{inclusiveEnd: p.InclusiveEnd, descending: p.Descending}
+	startKey, endKey := p.StartKey, p.EndKey
+	if p.Key != nil {
+		startKey, endKey = p.Key, p.Key
+		r.inclusiveEnd = true
 	}
-	if p.GroupLevel > 0 {
-		groupLevel = int(p.GroupLevel)
+	for _, x := range []struct {
+		key interface{}
+		dst *[]byte
+	}{{startKey, &r.start}, {endKey, &r.end}} {
+		if x.key == nil {
+			continue
+		}
+		docId, ok := x.key.(string)
+		if !ok {
+			return nil, fmt.Errorf("_all_docs keys must be doc id strings,"+
+				" got: %v", x.key)
+		}
+		*x.dst = []byte(docId)
 	}
+	return r, nil
+}
 
-	o := newReducer()
-	fnv, err := OttoNewFunction(o, reduceFunction)
-	if err != nil {
-		return result, err
+// Whether a doc id, reached in visiting order, is beyond the range.
+func (r *allDocsRange) past(docId []byte) bool {
+	if r.end == nil {
+		return false
 	}
+	c := bytes.Compare(docId, r.end)
+	if r.descending {
+		c = -c
+	}
+	return c > 0 || (c == 0 && !r.inclusiveEnd)
+}
 
-	initialCapacity := 200
-
-	results := make([]*ViewRow, 0, initialCapacity)
-	groupKeys := make([]interface{}, 0, initialCapacity)
-	groupValues := make([]interface{}, 0, initialCapacity)
-
-	i := 0
-	j := 0
-
-	for i < len(result.Rows) {
-		groupKeys = groupKeys[:0]
-		groupValues = groupValues[:0]
-
-		startRow := result.Rows[i]
-		groupKey := ArrayPrefix(startRow.Key, groupLevel)
-
-		for j = i; j < len(result.Rows); j++ {
-			row := result.Rows[j]
-			rowKey := ArrayPrefix(row.Key, groupLevel)
-			if walrus.CollateJSON(groupKey, rowKey) < 0 {
-				break
-			}
-			groupKeys = append(groupKeys, row.Key)
-			groupValues = append(groupValues, row.Value)
-		}
-		i = j
-
-		okeys, err := OttoFromGoArray(o, groupKeys)
-		if err != nil {
-			return result, err
+// Visits the docs of a vbucket within an _all_docs range, until done
+// is closed, such as when the query's limit has been reached, and
+// returns the visit's error.
+func visitVBucketAllDocs(vb *VBucket, r *allDocsRange, includeDocs bool,
+	ch chan *ViewRow, done chan bool) error {
+	defer close(ch)
+	if vb == nil {
+		return nil
+	}
+	visitor := func(i *item) bool {
+		if r.past(i.key) {
+			return false
 		}
-		ovalues, err := OttoFromGoArray(o, groupValues)
-		if err != nil {
-			return result, err
+		select {
+		case ch <- allDocsRow(string(i.key), i.cas, i.data, includeDocs):
+			return true
+		case <-done:
+			return false
 		}
+	}
+	if r.descending {
+		return vb.ps.visitItemsDescend(r.start, true, visitor)
+	}
+	return vb.ps.visitItems(r.start, true, visitor)
+}
 
-		ores, err := fnv.Call(fnv, okeys, ovalues, otto.FalseValue())
-		if err != nil {
-			return result, fmt.Errorf("call reduce err: %v, reduceFunction: %v, %v, %v",
-				err, reduceFunction, okeys, ovalues)
+// Merges the sorted _all_docs rows of vbuckets by doc id.
+func mergeAllDocsRows(in []chan *ViewRow, out chan *ViewRow, descending bool) {
+	defer close(out)
+	heads := make([]*ViewRow, len(in))
+	for i, ch := range in {
+		heads[i] = <-ch
+	}
+	for {
+		least := -1
+		for i, row := range heads {
+			if row == nil {
+				continue
+			}
+			if least < 0 || (row.Id < heads[least].Id) != descending {
+				least = i
+			}
 		}
-		gres, err := ores.Export()
-		if err != nil {
-			return result, fmt.Errorf("converting reduce result err: %v", err)
+		if least < 0 {
+			return
 		}
-
-		results = append(results, &ViewRow{Key: groupKey, Value: gres})
+		out <- heads[least]
+		heads[least] = <-in[least]
 	}
+}
 
-	result.Rows = results
-	return result, nil
+// Couchbase's rev of an item, derived from its CAS.
+func itemRev(cas uint64) string {
+	return fmt.Sprintf("1-%016x", cas)
 }
 
-func reverseViewRows(r ViewRows) {
-	num := len(r)
-	mid := num / 2
-	for i := 0; i < mid; i++ {
-		r[i], r[num-i-1] = r[num-i-1], r[i]
+// An _all_docs row has the doc's rev as its value, as in CouchDB, and
+// the doc itself only for include_docs=true.
+func allDocsRow(docId string, cas uint64, data []byte,
+	includeDocs bool) *ViewRow {
+	rev := itemRev(cas)
+	row := &ViewRow{
+		Id:    docId,
+		Key:   docId,
+		Value: map[string]interface{}{"rev": rev},
 	}
+	if includeDocs {
+		row.Doc = docViewValue(docId, data)
+		row.Doc.Meta["rev"] = rev
+	}
+	return row
 }
 
-func docifyViewResult(bucket Bucket, result *ViewResult) (
-	*ViewResult, error) {
-	for _, row := range result.Rows {
-		if row.Id != "" {
-			res := GetItem(bucket, []byte(row.Id), VBActive)
-			if res.Status == gomemcached.SUCCESS {
-				var parsedDoc interface{}
-				err := json.Unmarshal(res.Body, &parsedDoc)
-				if err == nil {
-					row.Doc = &ViewDocValue{
-						Meta: map[string]interface{}{
-							"id":  row.Id,
-							"rev": "0",
-						},
-						Json: parsedDoc,
-					}
-				} else {
-					// TODO: Is this the right encoding for non-json?
-					// no
-					// row.Doc = Bytes(res.Body)
-				}
-			} // TODO: Handle else-case when no doc.
-		}
+func docViewValue(docId string, data []byte) *ViewDocValue {
+	docType := "json"
+	var doc interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		doc = base64.StdEncoding.EncodeToString(data)
+		docType = "base64"
+	}
+	return &ViewDocValue{
+		Meta: map[string]interface{}{
+			"id":   docId,
+			"type": docType,
+		},
+		Json: doc,
 	}
-	return result, nil
 }
 
-func visitVBucketAllDocs(vb *VBucket, ch chan *ViewRow) {
-	if vb != nil {
-		vb.Visit(nil, func(key []byte, data []byte) bool {
-			docId := string(key)
-			docType := "json"
-			var doc interface{}
-			err := json.Unmarshal(data, &doc)
-			if err != nil {
-				doc = base64.StdEncoding.EncodeToString(data)
-				docType = "base64"
-			}
-			// TODO: The couchdb spec emits Value instead of Doc.
-			ch <- &ViewRow{
-				Id:  docId,
-				Key: docId,
-				Doc: &ViewDocValue{
-					Meta: map[string]interface{}{
-						"id":   docId,
-						"type": docType,
-						// TODO: rev.
-					},
-					Json: doc,
-				},
+// Returns the _all_docs rows of doc ids, in the requested order, with
+// an error row for each doc that's not found.
+func allDocsKeys(bucket Bucket, keys []interface{}, includeDocs bool) ViewRows {
+	rows := make(ViewRows, 0, len(keys))
+	for _, key := range keys {
+		if docId, ok := key.(string); ok {
+			res := GetItem(bucket, []byte(docId), VBActive)
+			if res.Status == gomemcached.SUCCESS {
+				rows = append(rows,
+					allDocsRow(docId, res.Cas, res.Body, includeDocs))
+				continue
 			}
-			return true
-		})
+		}
+		rows = append(rows, &ViewRow{Key: key, Error: "not_found"})
 	}
-	close(ch)
+	return rows
 }
 
 func couchDbAllDocs(w http.ResponseWriter, r *http.Request) {
@@ -801,35 +968,116 @@ func couchDbAllDocs(w http.ResponseWriter, r *http.Request) {
 	if bucket == nil {
 		return
 	}
-	_, err := ParseViewParams(r) // TODO: Handle params.
+	p, err := ParseViewParams(r)
+	if err == nil {
+		err = parseViewKeysBody(r, p)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("param parsing err: %v", err), 400)
 		return
 	}
-	out := make(chan *ViewRow)
+	dr, err := parseAllDocsRange(p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("param parsing err: %v", err), 400)
+		return
+	}
+
 	np := bucket.GetBucketSettings().NumPartitions
-	in := make([]chan *ViewRow, np)
-	for vbid := 0; vbid < np; vbid++ {
-		in[vbid] = make(chan *ViewRow)
+	vbs := make([]*VBucket, np)
+	totalRows := 0
+	for vbid := range vbs {
+		vbs[vbid], _ = bucket.GetVBucket(uint16(vbid))
+		if vbs[vbid] == nil {
+			continue
+		}
+		numItems, _, err := vbs[vbid].ps.getTotals()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("_all_docs total_rows err: %v", err), 500)
+			return
+		}
+		totalRows += int(numItems)
 	}
-	go MergeViewRows(in, out)
-	for vbid := 0; vbid < np; vbid++ {
-		vb, _ := bucket.GetVBucket(uint16(vbid))
-		go visitVBucketAllDocs(vb, in[vbid])
+
+	out := make(chan *ViewRow)
+	done := make(chan bool)
+	errs := make(chan error, np)
+	if p.Keys != nil {
+		go func() {
+			defer close(out)
+			for _, row := range allDocsKeys(bucket, p.Keys, p.IncludeDocs) {
+				out <- row
+			}
+		}()
+		np = 0 // No vbucket visits to wait for.
+	} else {
+		in := make([]chan *ViewRow, np)
+		for vbid, vb := range vbs {
+			in[vbid] = make(chan *ViewRow)
+			go func(vb *VBucket, ch chan *ViewRow) {
+				errs <- visitVBucketAllDocs(vb, dr, p.IncludeDocs, ch, done)
+			}(vb, in[vbid])
+		}
+		go mergeAllDocsRows(in, out, dr.descending)
 	}
-	w.Write([]byte(`{"rows":[`))
-	i := 0
+
+	vw := startViewResult(w, totalRows, false, 0)
+	skip, limit := p.Skip, p.Limit
 	for vr := range out {
-		j, err := json.Marshal(vr)
-		if err == nil {
-			if i > 0 {
-				w.Write([]byte(",\n"))
-			}
-			_, err = w.Write(j)
-			if err == nil {
-				i++
+		if skip > 0 {
+			skip--
+			continue
+		}
+		vw.row(vr) // TODO: json marshalling and Write error handling.
+		if limit > 0 && uint64(vw.n) >= limit {
+			close(done) // Stops the vbucket visits.
+			for range out {
 			}
-		} // TODO: else, json marshalling and Write error handling.
+			break
+		}
+	}
+	for ; np > 0; np-- {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	vw.end(err)
+}
+
+// Runs an ad-hoc query (see Query), given as the q param or as the
+// POST body, streaming the rows like _all_docs.
+func couchDbQuery(w http.ResponseWriter, r *http.Request) {
+	_, _, bucket := checkDb(w, r)
+	if bucket == nil {
+		return
+	}
+	body := []byte(r.FormValue("q"))
+	if r.Method == "POST" && len(body) == 0 {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
+			return
+		}
+	}
+	q, err := parseQuery(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("query parsing err: %v", err), 400)
+		return
+	}
+	// The response starts with the first row, so that an error before
+	// then is still an error status, and a later one is an error field.
+	var vw *viewResultWriter
+	err = runQuery(bucket, q, func(row *ViewRow) bool {
+		if vw == nil {
+			vw = startViewResult(w, -1, false, 0)
+		}
+		return vw.row(row) == nil
+	})
+	if vw == nil {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("query error: %v", err), 500)
+			return
+		}
+		vw = startViewResult(w, -1, false, 0)
 	}
-	w.Write([]byte(fmt.Sprintf(`],"total_rows":%v}`, i)))
+	vw.end(err)
 }
@@ -251,7 +251,32 @@ func restNSSettingsStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func restNSPoolsDefaultTasks(w http.ResponseWriter, r *http.Request) {
-	jsonEncode(w, map[string]interface{}{})
+	tasks := []map[string]interface{}{}
+	for _, info := range compactTasks.list() {
+		if info.Status != compactQueued && info.Status != compactRunning &&
+			info.Status != compactPaused {
+			continue
+		}
+		progress := 0
+		if info.CollsTotal > 0 {
+			progress = int(100 * info.CollsCopied / info.CollsTotal)
+		}
+		tasks = append(tasks, map[string]interface{}{
+			"type":     "bucket_compaction",
+			"taskId":   info.Id,
+			"bucket":   info.Bucket,
+			"status":   info.Status,
+			"progress": progress,
+			"cancelURI": "/pools/default/buckets/" + info.Bucket +
+				"/controller/cancelBucketCompaction",
+			"itemsCopied": info.ItemsCopied,
+		})
+	}
+	jsonEncode(w, tasks)
+}
+
+func restNSCancelBucketCompaction(w http.ResponseWriter, r *http.Request) {
+	compactTasks.cancelBucket(mux.Vars(r)["bucketname"])
 }
 
 func restNSLocalRandomKey(w http.ResponseWriter, r *http.Request) {
@@ -293,6 +318,8 @@ func restNSAPI(r *mux.Router) {
 
 	r.HandleFunc("/pools/default/tasks",
 		restNSPoolsDefaultTasks)
+	r.HandleFunc("/pools/default/buckets/{bucketname}/controller/cancelBucketCompaction",
+		withBucketAccess(restNSCancelBucketCompaction)).Methods("POST")
 	r.HandleFunc("/settings/stats", restNSSettingsStats)
 }
 
@@ -1161,6 +1161,71 @@ func TestCouchAllDocs(t *testing.T) {
 	}
 }
 
+func TestCouchAllDocsParams(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		SetItem(bucket, []byte(k), []byte(`{"k":"`+k+`"}`), VBActive)
+	}
+
+	tests := []struct {
+		params string
+		exp    string
+	}{
+		{"", "abcdef"},
+		{"?descending=true", "fedcba"},
+		{`?startkey="b"&endkey="d"`, "bcd"},
+		{`?startkey="b"&endkey="d"&inclusive_end=false`, "bc"},
+		{`?startkey="d"&endkey="b"&descending=true`, "dcb"},
+		{`?startkey="d"&endkey="b"&descending=true&inclusive_end=false`, "dc"},
+		{`?key="c"`, "c"},
+		{`?key="c"&inclusive_end=false`, "c"},
+		{"?limit=2", "ab"},
+		{"?skip=2&limit=3", "cde"},
+		{"?descending=true&limit=2", "fe"},
+		{`?startkey="bb"`, "cdef"},
+		{`?keys=["e","a"]`, "ea"},
+	}
+	for _, test := range tests {
+		vr := testGetViewRows(t, mr, "http://127.0.0.1/default/_all_docs"+test.params)
+		got := ""
+		for _, row := range vr.Rows {
+			got += row.Id
+			if row.Doc != nil {
+				t.Errorf("expected no docs without include_docs, got: %#v", row)
+			}
+			if v, ok := row.Value.(map[string]interface{}); !ok || v["rev"] == "" {
+				t.Errorf("expected a rev value, got: %#v", row)
+			}
+		}
+		if got != test.exp {
+			t.Errorf("expected %v for %v, got: %v", test.exp, test.params, got)
+		}
+		if vr.TotalRows != 6 {
+			t.Errorf("expected total_rows of %v to count all docs, got: %#v",
+				test.params, vr)
+		}
+	}
+
+	vr := testGetViewRows(t, mr, `http://127.0.0.1/default/_all_docs?key="b"&include_docs=true`)
+	if len(vr.Rows) != 1 || vr.Rows[0].Doc == nil ||
+		vr.Rows[0].Doc.Json.(map[string]interface{})["k"] != "b" ||
+		vr.Rows[0].Doc.Meta["rev"] != vr.Rows[0].Value.(map[string]interface{})["rev"] {
+		t.Errorf("expected the doc with include_docs, got: %#v", vr.Rows)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/default/_all_docs?startkey=1", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected a non-string startkey to 400, got: %#v", rr)
+	}
+}
+
 func jsonFindParse(t *testing.T, b []byte, path string) (interface{}, error) {
 	d, err := jsonpointer.Find(b, path)
 	if err != nil {
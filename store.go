@@ -1,18 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
-	"strconv"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/couchbaselabs/cbgb/storefile"
 	"github.com/steveyen/gkvlite"
 )
 
@@ -25,15 +26,47 @@ var persistRunner = newPeriodically(10*time.Second, 5)
 
 const compact_every = 10000
 
+// A failed flush is retried a few times, backing off in between.
+var flushRetries = 2
+var flushRetryDelay = 100 * time.Millisecond
+
+// After this many failed flushes in a row, or on a full disk, a
+// bucketstore becomes read-only until a flush succeeds again.
+const flushFailuresReadOnly = 3
+
+var bucketStoreReadOnly = errors.New("bucket store is read-only after flush errors")
+
 type bucketstore struct {
 	bsf           unsafe.Pointer // *bucketstorefile
 	bsfMemoryOnly *bucketstorefile
 	endch         chan bool
 	dirtiness     int64 // To track when we need flush to storage.
+	dirtyBytes    int64 // Approximate bytes mutated since last flush.
+	flushKicked   int32 // Non-zero while an activity-driven flush runs.
+	compacting    int32 // The number of compactions queued or running.
+	flushFailures int64 // Number of failed flushes in a row.
+	durability    string
 	partitions    map[uint16]*partitionstore
 	stats         *BucketStoreStats
+	encryptionKey []byte // When non-nil, store files are encrypted.
+
+	flushDirtyItems      int64
+	flushDirtyBytes      int64
+	compactFragmentation int
+	compactWindow        *timeWindow // Nil means any time.
+	lastCompactFileSize  int64
+
+	commitLock    sync.Mutex // Covers the group commit fields below.
+	commitWaiters []chan error
+	committing    bool
 
-	diskLock sync.Mutex
+	diskLock    sync.Mutex
+	compactLock sync.Mutex // Serializes compactions.
+
+	// Mutations of a partition's keys and changes hold a read lock,
+	// and a flush holds the write lock, so that a flush commits
+	// either all or none of any mutation in one gkvlite root.
+	mutationLock sync.RWMutex
 }
 
 type BucketStoreStats struct {
@@ -45,12 +78,23 @@ type BucketStoreStats struct {
 	Stats         int64 `json:"stats"`
 	Compacts      int64 `json:"compacts"`
 	LastCompactAt int64 `json:"lastCompactAt"`
+	FilesRetired  int64 `json:"filesRetired"`
+	Syncs         int64 `json:"syncs"`
+	DirtyFlushes  int64 `json:"dirtyFlushes"` // Flushes due to activity.
+	FlushRetries  int64 `json:"flushRetries"`
+	ReadOnly      int64 `json:"readOnly"` // Non-zero when read-only.
+
+	FlushUsecs    int64 `json:"flushUsecs"` // Cumulative flush latency.
+	SyncUsecs     int64 `json:"syncUsecs"`  // Cumulative fsync latency.
+	GroupCommits  int64 `json:"groupCommits"`
+	CommitWaiters int64 `json:"commitWaiters"` // Mutations released by group commits.
 
 	FlushErrors   int64 `json:"flushErrors"`
 	ReadErrors    int64 `json:"readErrors"`
 	WriteErrors   int64 `json:"writeErrors"`
 	StatErrors    int64 `json:"statErrors"`
 	CompactErrors int64 `json:"compactErrors"`
+	SyncErrors    int64 `json:"syncErrors"`
 
 	ReadBytes  int64 `json:"readBytes"`
 	WriteBytes int64 `json:"writeBytes"`
@@ -60,9 +104,21 @@ type BucketStoreStats struct {
 }
 
 func newBucketStore(path string, settings BucketSettings) (res *bucketstore, err error) {
+	if err = checkDurability(settings.Durability); err != nil {
+		return nil, err
+	}
+	compactWindow, err := parseTimeWindow(settings.CompactWindow)
+	if err != nil {
+		return nil, err
+	}
 	var file FileLike
+	var encryptionKey []byte
 	if settings.MemoryOnly < MemoryOnly_LEVEL_PERSIST_NOTHING {
-		file, err = fileService.OpenFile(path, os.O_RDWR|os.O_CREATE)
+		encryptionKey, err = settings.loadEncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		file, err = openStoreFile(path, os.O_RDWR|os.O_CREATE, encryptionKey)
 		if err != nil {
 			fmt.Printf("!!!! %v\n", err)
 			return nil, err
@@ -79,6 +135,7 @@ func newBucketStore(path string, settings BucketSettings) (res *bucketstore, err
 	if err != nil {
 		return nil, err
 	}
+	setCollKeyCompares(store)
 	bsf.store = store
 
 	var bsfMemoryOnly *bucketstorefile
@@ -96,9 +153,34 @@ func newBucketStore(path string, settings BucketSettings) (res *bucketstore, err
 		endch:         make(chan bool),
 		partitions:    make(map[uint16]*partitionstore),
 		stats:         bsf.stats,
+		encryptionKey: encryptionKey,
+		durability:    settings.Durability,
+
+		flushDirtyItems:      settings.FlushDirtyItems,
+		flushDirtyBytes:      settings.FlushDirtyBytes,
+		compactFragmentation: settings.CompactFragmentation,
+		compactWindow:        compactWindow,
 	}, nil
 }
 
+// Opens a store file, layering on encryption when there's a key.
+func openStoreFile(path string, mode int, encryptionKey []byte) (FileLike, error) {
+	file, err := fileService.OpenFile(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	file = newFaultInjectingFileLike(path, file)
+	if encryptionKey == nil {
+		return file, nil
+	}
+	cfile, err := NewCryptFileLike(file, encryptionKey)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("store file: %v, err: %v", path, err)
+	}
+	return cfile, nil
+}
+
 func (s *bucketstore) BSF() *bucketstorefile {
 	return (*bucketstorefile)(atomic.LoadPointer(&s.bsf))
 }
@@ -121,6 +203,17 @@ func (s *bucketstore) Close() {
 	}
 }
 
+// Closes the bucketstore and deletes its file, once any in-flight
+// readers are done.
+func (s *bucketstore) destroy() {
+	s.Close()
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	s.apply(func() {
+		s.BSF().supersede()
+	})
+}
+
 func (s *bucketstore) Stats() *BucketStoreStats {
 	bss := &BucketStoreStats{}
 	bss.Add(s.stats)
@@ -146,22 +239,140 @@ func (s *bucketstore) Flush() (int64, error) {
 
 func (s *bucketstore) flush_unlocked() (int64, error) {
 	d := atomic.LoadInt64(&s.dirtiness)
+	db := atomic.LoadInt64(&s.dirtyBytes)
 	bsf := s.BSF()
 	if bsf.file != nil {
-		if err := bsf.store.Flush(); err != nil {
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&s.stats.FlushUsecs,
+				int64(time.Since(start)/time.Microsecond))
+		}()
+
+		var err error
+		for attempt := 0; attempt <= flushRetries; attempt++ {
+			if attempt > 0 {
+				atomic.AddInt64(&s.stats.FlushRetries, 1)
+				time.Sleep(time.Duration(attempt) * flushRetryDelay)
+			}
+			if err = s.flushFile(bsf); err == nil {
+				break
+			}
+		}
+		if err != nil {
 			atomic.AddInt64(&s.stats.FlushErrors, 1)
+			s.flushFailed(bsf, err)
 			return atomic.LoadInt64(&s.dirtiness), err
 		}
+		s.flushSucceeded(bsf)
 	} // else, we're in memory-only mode.
 	atomic.AddInt64(&s.stats.Flushes, 1)
+	atomic.AddInt64(&s.dirtyBytes, -db)
 	return atomic.AddInt64(&s.dirtiness, -d), nil
 }
 
+func (s *bucketstore) flushFile(bsf *bucketstorefile) error {
+	s.mutationLock.Lock()
+	err := bsf.store.Flush()
+	s.mutationLock.Unlock()
+	if err != nil || !s.syncFlushes() {
+		return err
+	}
+	start := time.Now()
+	err = bsf.Sync()
+	atomic.AddInt64(&s.stats.SyncUsecs,
+		int64(time.Since(start)/time.Microsecond))
+	return err
+}
+
+// Whether flushes fsync, which only the durability modes that ask for
+// it do, so buckets without a durability setting (like those from
+// before there were durability modes) keep leaving it to the OS.
+func (s *bucketstore) syncFlushes() bool {
+	return s.durability == Durability_FSYNC_ON_FLUSH ||
+		s.durability == Durability_FSYNC_PER_BATCH
+}
+
+// Whether mutations need to waitCommitted() before being acknowledged.
+func (s *bucketstore) syncMutations() bool {
+	return s.durability == Durability_FSYNC_PER_BATCH && s.bsfMemoryOnly == nil
+}
+
+// Blocks until everything mutated before the call is flushed and
+// fsync'ed.  Concurrent callers are batched into a group commit, so
+// that they're all released after a single flush.
+func (s *bucketstore) waitCommitted() error {
+	ch := make(chan error, 1)
+	s.commitLock.Lock()
+	s.commitWaiters = append(s.commitWaiters, ch)
+	if !s.committing {
+		s.committing = true
+		go s.groupCommitter()
+	}
+	s.commitLock.Unlock()
+	return <-ch
+}
+
+func (s *bucketstore) groupCommitter() {
+	for {
+		s.commitLock.Lock()
+		waiters := s.commitWaiters
+		s.commitWaiters = nil
+		if len(waiters) == 0 {
+			s.committing = false
+			s.commitLock.Unlock()
+			return
+		}
+		s.commitLock.Unlock()
+
+		// Callers who show up during this flush wait for the next one,
+		// as their mutations might have missed this one.
+		_, err := s.Flush()
+		atomic.AddInt64(&s.stats.GroupCommits, 1)
+		atomic.AddInt64(&s.stats.CommitWaiters, int64(len(waiters)))
+		for _, ch := range waiters {
+			ch <- err
+		}
+	}
+}
+
+func (s *bucketstore) flushFailed(bsf *bucketstorefile, err error) {
+	n := atomic.AddInt64(&s.flushFailures, 1)
+	if n >= flushFailuresReadOnly || isNoSpaceErr(err) {
+		if atomic.SwapInt64(&s.stats.ReadOnly, 1) == 0 {
+			log.Printf("bucketstore: %v, now read-only, flush failures: %v,"+
+				" err: %v", bsf.path, n, err)
+		}
+	}
+}
+
+func (s *bucketstore) flushSucceeded(bsf *bucketstorefile) {
+	atomic.StoreInt64(&s.flushFailures, 0)
+	if atomic.SwapInt64(&s.stats.ReadOnly, 0) != 0 {
+		log.Printf("bucketstore: %v, writable again", bsf.path)
+	}
+}
+
+func (s *bucketstore) readOnly() bool {
+	return atomic.LoadInt64(&s.stats.ReadOnly) != 0
+}
+
 func (s *bucketstore) periodicPersist(time.Time) bool {
+	if atomic.LoadInt32(&s.compacting) != 0 {
+		// A compaction can hold the diskLock for a long while, so
+		// flush on the side instead of holding up the persistRunner,
+		// which all buckets share, and try again next time.
+		s.kickFlush()
+		return true
+	}
 	d, _ := s.Flush()
-	if s.stats.Writes-s.stats.LastCompactAt > compact_every {
+	if !s.readOnly() && s.needsCompaction(time.Now()) &&
+		atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
 		s.stats.LastCompactAt = s.stats.Writes
-		s.Compact()
+		go func() {
+			if s.compactCounted() == nil {
+				atomic.StoreInt64(&s.lastCompactFileSize, s.Stats().FileSize)
+			}
+		}()
 	}
 	if d > 0 {
 		log.Printf("Flushed all but %v items (retrying)", d)
@@ -179,13 +390,35 @@ func (s *bucketstore) dirty(force bool) {
 	if force || s.bsfMemoryOnly == nil {
 		newval := atomic.AddInt64(&s.dirtiness, 1)
 		if newval == 1 {
-			// TODO: Might want to kick off a persistence right now
-			// rather than only schedule a periodic persistence.
 			persistRunner.Register(s.endch, s.mkPersistFun())
 		}
+		if (s.flushDirtyItems > 0 && newval >= s.flushDirtyItems) ||
+			(s.flushDirtyBytes > 0 &&
+				atomic.LoadInt64(&s.dirtyBytes) >= s.flushDirtyBytes) {
+			s.kickFlush()
+		}
 	}
 }
 
+// Starts a flush right away, rather than waiting for the periodic
+// persistence, unless one's already running.
+func (s *bucketstore) kickFlush() {
+	select {
+	case <-s.endch:
+		return
+	default:
+	}
+	if !atomic.CompareAndSwapInt32(&s.flushKicked, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.flushKicked, 0)
+		if _, err := s.Flush(); err == nil {
+			atomic.AddInt64(&s.stats.DirtyFlushes, 1)
+		}
+	}()
+}
+
 func (s *bucketstore) collMeta(collName string) *gkvlite.Collection {
 	c := s.BSF().store.GetCollection(collName)
 	if c == nil {
@@ -197,7 +430,7 @@ func (s *bucketstore) collMeta(collName string) *gkvlite.Collection {
 func (s *bucketstore) coll(collName string) *gkvlite.Collection {
 	c := s.BSFData().store.GetCollection(collName)
 	if c == nil {
-		c = s.BSFData().store.SetCollection(collName, nil)
+		c = s.BSFData().store.SetCollection(collName, collKeyCompare(collName))
 	}
 	return c
 }
@@ -239,28 +472,71 @@ type bucketstorefile struct {
 	file  FileLike
 	store *gkvlite.Store
 	lock  sync.Mutex
-	purge bool // When true, purge file when GC finalized.
+	purge bool // When true, purge file when the last ref is released.
 	stats *BucketStoreStats
+
+	// The owning bucketstore holds one ref while this is its current
+	// file, and readers hold a ref while they're using collections
+	// from this file.  When the refs drop to zero, the file's closed,
+	// and deleted if it was purgable.
+	refs int32
 }
 
 func NewBucketStoreFile(path string, file FileLike,
 	stats *BucketStoreStats) *bucketstorefile {
-	res := &bucketstorefile{
+	return &bucketstorefile{
 		path:  path,
 		file:  file,
 		stats: stats,
+		refs:  1,
+	}
+}
+
+// Returns false if the file was already retired.
+func (bsf *bucketstorefile) addRef() bool {
+	for {
+		refs := atomic.LoadInt32(&bsf.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&bsf.refs, refs, refs+1) {
+			return true
+		}
 	}
-	runtime.SetFinalizer(res, finalizeBucketStoreFile)
-	return res
 }
 
-func finalizeBucketStoreFile(bsf *bucketstorefile) {
-	if bsf.purge {
-		bsf.purge = false
-		os.Remove(bsf.path)
+func (bsf *bucketstorefile) release() {
+	if atomic.AddInt32(&bsf.refs, -1) == 0 {
+		bsf.retire()
 	}
 }
 
+// Marks the file as superseded (such as by compaction), so that it's
+// deleted once its last reader is done, and drops the owner's ref.
+func (bsf *bucketstorefile) supersede() {
+	bsf.apply(func() {
+		bsf.purge = true
+	})
+	bsf.release()
+}
+
+func (bsf *bucketstorefile) retire() {
+	bsf.apply(func() {
+		if bsf.file == nil {
+			return // We're in memory-only mode.
+		}
+		bsf.file.Close()
+		if bsf.purge {
+			if err := os.Remove(bsf.path); err != nil {
+				log.Printf("could not remove retired store file: %v, err: %v",
+					bsf.path, err)
+				return
+			}
+			atomic.AddInt64(&bsf.stats.FilesRetired, 1)
+		}
+	})
+}
+
 func (bsf *bucketstorefile) apply(fun func()) {
 	bsf.lock.Lock()
 	defer bsf.lock.Unlock()
@@ -310,6 +586,17 @@ func (bsf *bucketstorefile) Stat() (fi os.FileInfo, err error) {
 	return fi, err
 }
 
+func (bsf *bucketstorefile) Sync() (err error) {
+	bsf.apply(func() {
+		atomic.AddInt64(&bsf.stats.Syncs, 1)
+		err = bsf.file.Sync()
+		if err != nil {
+			atomic.AddInt64(&bsf.stats.SyncErrors, 1)
+		}
+	})
+	return err
+}
+
 func (bss *BucketStoreStats) Add(in *BucketStoreStats) {
 	bss.Op(in, addInt64)
 }
@@ -324,11 +611,21 @@ func (bss *BucketStoreStats) Op(in *BucketStoreStats, op func(int64, int64) int6
 	bss.Writes = op(bss.Writes, atomic.LoadInt64(&in.Writes))
 	bss.Stats = op(bss.Stats, atomic.LoadInt64(&in.Stats))
 	bss.Compacts = op(bss.Compacts, atomic.LoadInt64(&in.Compacts))
+	bss.Syncs = op(bss.Syncs, atomic.LoadInt64(&in.Syncs))
+	bss.DirtyFlushes = op(bss.DirtyFlushes, atomic.LoadInt64(&in.DirtyFlushes))
+	bss.FlushRetries = op(bss.FlushRetries, atomic.LoadInt64(&in.FlushRetries))
+	bss.ReadOnly = op(bss.ReadOnly, atomic.LoadInt64(&in.ReadOnly))
+	bss.FilesRetired = op(bss.FilesRetired, atomic.LoadInt64(&in.FilesRetired))
+	bss.FlushUsecs = op(bss.FlushUsecs, atomic.LoadInt64(&in.FlushUsecs))
+	bss.SyncUsecs = op(bss.SyncUsecs, atomic.LoadInt64(&in.SyncUsecs))
+	bss.GroupCommits = op(bss.GroupCommits, atomic.LoadInt64(&in.GroupCommits))
+	bss.CommitWaiters = op(bss.CommitWaiters, atomic.LoadInt64(&in.CommitWaiters))
 	bss.FlushErrors = op(bss.FlushErrors, atomic.LoadInt64(&in.FlushErrors))
 	bss.ReadErrors = op(bss.ReadErrors, atomic.LoadInt64(&in.ReadErrors))
 	bss.WriteErrors = op(bss.WriteErrors, atomic.LoadInt64(&in.WriteErrors))
 	bss.StatErrors = op(bss.StatErrors, atomic.LoadInt64(&in.StatErrors))
 	bss.CompactErrors = op(bss.CompactErrors, atomic.LoadInt64(&in.CompactErrors))
+	bss.SyncErrors = op(bss.SyncErrors, atomic.LoadInt64(&in.SyncErrors))
 	bss.ReadBytes = op(bss.ReadBytes, atomic.LoadInt64(&in.ReadBytes))
 	bss.WriteBytes = op(bss.WriteBytes, atomic.LoadInt64(&in.WriteBytes))
 	bss.FileSize = op(bss.FileSize, atomic.LoadInt64(&in.FileSize))
@@ -348,11 +645,21 @@ func (bss *BucketStoreStats) Equal(in *BucketStoreStats) bool {
 		bss.Writes == atomic.LoadInt64(&in.Writes) &&
 		bss.Stats == atomic.LoadInt64(&in.Stats) &&
 		bss.Compacts == atomic.LoadInt64(&in.Compacts) &&
+		bss.Syncs == atomic.LoadInt64(&in.Syncs) &&
+		bss.DirtyFlushes == atomic.LoadInt64(&in.DirtyFlushes) &&
+		bss.FlushRetries == atomic.LoadInt64(&in.FlushRetries) &&
+		bss.ReadOnly == atomic.LoadInt64(&in.ReadOnly) &&
+		bss.FilesRetired == atomic.LoadInt64(&in.FilesRetired) &&
+		bss.FlushUsecs == atomic.LoadInt64(&in.FlushUsecs) &&
+		bss.SyncUsecs == atomic.LoadInt64(&in.SyncUsecs) &&
+		bss.GroupCommits == atomic.LoadInt64(&in.GroupCommits) &&
+		bss.CommitWaiters == atomic.LoadInt64(&in.CommitWaiters) &&
 		bss.FlushErrors == atomic.LoadInt64(&in.FlushErrors) &&
 		bss.ReadErrors == atomic.LoadInt64(&in.ReadErrors) &&
 		bss.WriteErrors == atomic.LoadInt64(&in.WriteErrors) &&
 		bss.StatErrors == atomic.LoadInt64(&in.StatErrors) &&
 		bss.CompactErrors == atomic.LoadInt64(&in.CompactErrors) &&
+		bss.SyncErrors == atomic.LoadInt64(&in.SyncErrors) &&
 		bss.ReadBytes == atomic.LoadInt64(&in.ReadBytes) &&
 		bss.WriteBytes == atomic.LoadInt64(&in.WriteBytes) &&
 		bss.FileSize == atomic.LoadInt64(&in.FileSize) &&
@@ -391,30 +698,136 @@ func latestStoreFileNames(dirForBucket string, storesPerBucket int,
 	return res, err
 }
 
-// The store files follow a "IDX-VER.SUFFIX" naming pattern,
-// such as "0-0.store".
-func makeStoreFileName(idx int, ver int, storeFileSuffix string) string {
-	return fmt.Sprintf("%v-%v.%v", idx, ver, storeFileSuffix)
+// Returns the highest index of the store files in a bucket
+// directory, or -1 when there are none.
+func maxStoreFileIdx(dirForBucket string, storeFileSuffix string) (int, error) {
+	fileInfos, err := ioutil.ReadDir(dirForBucket)
+	if err != nil {
+		return -1, err
+	}
+	maxIdx := -1
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		idx, _, err := parseStoreFileName(fileInfo.Name(), storeFileSuffix)
+		if err == nil && idx > maxIdx {
+			maxIdx = idx
+		}
+	}
+	return maxIdx, nil
 }
 
-func parseStoreFileName(fileName string, storeFileSuffix string) (idx int, ver int,
-	err error) {
-	if !strings.HasSuffix(fileName, "."+storeFileSuffix) {
-		return -1, -1, fmt.Errorf("missing suffix: %v in filename: %v",
-			storeFileSuffix, fileName)
+// Removes leftovers in a bucket directory from before a restart:
+// "*.compact" files of unfinished compactions, and store files that
+// were superseded by a later version but never deleted.  Returns the
+// names of the removed files.
+func sweepStoreFiles(dirForBucket string, storesPerBucket int,
+	storeFileSuffix string) ([]string, error) {
+	latestNames, err := latestStoreFileNames(dirForBucket,
+		storesPerBucket, storeFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(dirForBucket)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() ||
+			storeFileKind(fileInfo.Name(), latestNames, storeFileSuffix) !=
+				storeFileStale {
+			continue
+		}
+		p := path.Join(dirForBucket, fileInfo.Name())
+		if err = os.Remove(p); err != nil {
+			return removed, err
+		}
+		removed = append(removed, fileInfo.Name())
 	}
-	base := fileName[0 : len(fileName)-(1+len(storeFileSuffix))]
-	parts := strings.Split(base, "-")
-	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
-		return -1, -1, fmt.Errorf("not a store filename: %v", fileName)
+	return removed, nil
+}
+
+const (
+	storeFileCurrent = "current"
+	storeFileStale   = "stale" // Superseded versions and compaction leftovers.
+	storeFileOther   = "other"
+)
+
+func storeFileKind(fileName string, latestNames []string,
+	storeFileSuffix string) string {
+	if strings.HasSuffix(fileName, "."+storeFileSuffix+".compact") {
+		return storeFileStale
 	}
-	idx, err = strconv.Atoi(parts[0])
+	idx, ver, err := parseStoreFileName(fileName, storeFileSuffix)
+	if err != nil {
+		return storeFileOther
+	}
+	if idx >= len(latestNames) {
+		return storeFileOther // Not one of ours, so leave it alone.
+	}
+	_, latestVer, err := parseStoreFileName(latestNames[idx], storeFileSuffix)
+	if err == nil && ver < latestVer {
+		return storeFileStale
+	}
+	return storeFileCurrent
+}
+
+type DiskUsageFile struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+}
+
+type DiskUsage struct {
+	Files        []DiskUsageFile `json:"files"`
+	TotalBytes   int64           `json:"totalBytes"`
+	CurrentBytes int64           `json:"currentBytes"`
+	StaleBytes   int64           `json:"staleBytes"`
+}
+
+// Reports the disk space used by the files in a bucket directory.
+func diskUsage(dirForBucket string, storesPerBucket int,
+	storeFileSuffix string) (*DiskUsage, error) {
+	latestNames, err := latestStoreFileNames(dirForBucket,
+		storesPerBucket, storeFileSuffix)
 	if err != nil {
-		return -1, -1, err
+		return nil, err
 	}
-	ver, err = strconv.Atoi(parts[1])
+	fileInfos, err := ioutil.ReadDir(dirForBucket)
 	if err != nil {
-		return -1, -1, err
+		return nil, err
 	}
-	return idx, ver, nil
+	rv := &DiskUsage{Files: []DiskUsageFile{}}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		kind := storeFileKind(fileInfo.Name(), latestNames, storeFileSuffix)
+		rv.Files = append(rv.Files, DiskUsageFile{
+			Name: fileInfo.Name(),
+			Kind: kind,
+			Size: fileInfo.Size(),
+		})
+		rv.TotalBytes += fileInfo.Size()
+		switch kind {
+		case storeFileCurrent:
+			rv.CurrentBytes += fileInfo.Size()
+		case storeFileStale:
+			rv.StaleBytes += fileInfo.Size()
+		}
+	}
+	return rv, nil
+}
+
+// The store files follow a "IDX-VER.SUFFIX" naming pattern,
+// such as "0-0.store".
+func makeStoreFileName(idx int, ver int, storeFileSuffix string) string {
+	return storefile.FileName(idx, ver, storeFileSuffix)
+}
+
+func parseStoreFileName(fileName string, storeFileSuffix string) (idx int, ver int,
+	err error) {
+	return storefile.ParseFileName(fileName, storeFileSuffix)
 }
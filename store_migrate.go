@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/steveyen/gkvlite"
+)
+
+// Items copied between writes while migrating.
+var migrateWriteEvery = 1000
+
+// The store file index that holds a vbucket, given the bucket's
+// number of store files.  The design doc vbucket is always in the
+// first store file.
+func storeIdxForVBucket(vbid uint16, numStores int) int {
+	if vbid == VBID_DDOC {
+		return 0
+	}
+	return int(vbid) % numStores
+}
+
+// Parses the vbid out of a "<vbid>.k" or "<vbid>.s" collection name.
+func vbidFromCollName(collName string) (uint16, bool) {
+	var s string
+	switch {
+	case strings.HasSuffix(collName, COLL_SUFFIX_KEYS):
+		s = collName[0 : len(collName)-len(COLL_SUFFIX_KEYS)]
+	case strings.HasSuffix(collName, COLL_SUFFIX_CHANGES):
+		s = collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)]
+	default:
+		return 0, false
+	}
+	vbid, err := strconv.Atoi(s)
+	if err != nil || vbid < 0 || vbid > 0xffff {
+		return 0, false
+	}
+	return uint16(vbid), true
+}
+
+// Offline migration of a bucket directory to a different number of
+// store files, redistributing the vbuckets.  The bucket must not be
+// open while this runs.  The new store files are built in a sibling
+// directory, which then replaces the bucket directory, so that a
+// failed migration leaves the bucket as it was.
+func migrateBucketStores(dirForBucket string, numStores int) error {
+	if numStores <= 0 {
+		return fmt.Errorf("migrate needs a positive numStores, got: %v",
+			numStores)
+	}
+	if err := checkNumStores(numStores); err != nil {
+		return err
+	}
+	settings := &BucketSettings{}
+	exists, err := settings.load(dirForBucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no bucket settings in: %v", dirForBucket)
+	}
+	encryptionKey, err := settings.loadEncryptionKey()
+	if err != nil {
+		return err
+	}
+
+	// Any store files beyond the currently configured count are
+	// migrated too, so this also repairs a bucket whose numStores
+	// setting was changed without a migration.
+	maxIdx, err := maxStoreFileIdx(dirForBucket, STORE_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	srcNames, err := latestStoreFileNames(dirForBucket, maxIdx+1,
+		STORE_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+
+	migrateDir := dirForBucket + ".migrate"
+	os.RemoveAll(migrateDir) // Clean up any previous attempts.
+	if err = os.MkdirAll(migrateDir, 0777); err != nil {
+		return err
+	}
+	migrated := false
+	defer func() {
+		if !migrated {
+			os.RemoveAll(migrateDir)
+		}
+	}()
+
+	dstFiles := make([]FileLike, numStores)
+	dstStores := make([]*gkvlite.Store, numStores)
+	defer func() {
+		for _, f := range dstFiles {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := 0; i < numStores; i++ {
+		p := path.Join(migrateDir, makeStoreFileName(i, 0, STORE_FILE_SUFFIX))
+		dstFiles[i], err = openStoreFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL,
+			encryptionKey)
+		if err != nil {
+			return err
+		}
+		dstStores[i], err = gkvlite.NewStore(dstFiles[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, srcName := range srcNames {
+		err = migrateStoreFile(path.Join(dirForBucket, srcName),
+			encryptionKey, dstStores)
+		if err != nil {
+			return fmt.Errorf("migrating store file: %v, err: %v", srcName, err)
+		}
+	}
+	for i, dstStore := range dstStores {
+		if err = dstStore.Flush(); err != nil {
+			return err
+		}
+		if err = dstFiles[i].Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Carry over everything else, like views files, except for the
+	// old store files and settings, which are rewritten.
+	fileInfos, err := ioutil.ReadDir(dirForBucket)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() ||
+			strings.HasPrefix(name, "settings.json") ||
+			strings.HasSuffix(name, "."+STORE_FILE_SUFFIX) ||
+			strings.HasSuffix(name, "."+STORE_FILE_SUFFIX+".compact") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dirForBucket, name))
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path.Join(migrateDir, name), b, fileInfo.Mode())
+		if err != nil {
+			return err
+		}
+	}
+	settings.NumStores = numStores
+	if err = settings.save(migrateDir); err != nil {
+		return err
+	}
+
+	prevDir := dirForBucket + ".premigrate"
+	os.RemoveAll(prevDir)
+	if err = os.Rename(dirForBucket, prevDir); err != nil {
+		return err
+	}
+	if err = os.Rename(migrateDir, dirForBucket); err != nil {
+		os.Rename(prevDir, dirForBucket)
+		return err
+	}
+	migrated = true
+	if err = os.RemoveAll(prevDir); err != nil {
+		log.Printf("migrate could not remove previous bucket dir: %v, err: %v",
+			prevDir, err)
+	}
+	return nil
+}
+
+// Copies the collections of a store file into the destination
+// stores, placing each vbucket by its vbid.
+func migrateStoreFile(srcPath string, encryptionKey []byte,
+	dstStores []*gkvlite.Store) error {
+	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return nil // The bucket never had this store file.
+	}
+	srcFile, err := openStoreFile(srcPath, os.O_RDONLY, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	srcStore, err := gkvlite.NewStore(srcFile)
+	if err != nil {
+		return err
+	}
+
+	dstColl := func(dstStore *gkvlite.Store, collName string) *gkvlite.Collection {
+		c := dstStore.GetCollection(collName)
+		if c == nil {
+			c = dstStore.SetCollection(collName, nil)
+		}
+		return c
+	}
+
+	for _, collName := range srcStore.GetCollectionNames() {
+		srcColl := srcStore.GetCollection(collName)
+		if collName == COLL_VBMETA {
+			var errVisit error
+			err = srcColl.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+				vbid, err := strconv.Atoi(string(i.Key))
+				if err != nil || vbid < 0 || vbid > 0xffff {
+					errVisit = fmt.Errorf("bad vbid in vbmeta: %q", i.Key)
+					return false
+				}
+				dstStore := dstStores[storeIdxForVBucket(uint16(vbid), len(dstStores))]
+				errVisit = dstColl(dstStore, COLL_VBMETA).SetItem(i)
+				return errVisit == nil
+			})
+			if err == nil {
+				err = errVisit
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		dstStore := dstStores[0]
+		if vbid, ok := vbidFromCollName(collName); ok {
+			dstStore = dstStores[storeIdxForVBucket(vbid, len(dstStores))]
+		}
+		_, _, err = copyColl(srcColl, dstColl(dstStore, collName),
+			migrateWriteEvery, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
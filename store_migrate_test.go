@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func testLoadVBuckets(t *testing.T, b Bucket, numVBuckets int) {
+	r := &reqHandler{currentBucket: b}
+	for vbid := 0; vbid < numVBuckets; vbid++ {
+		b.CreateVBucket(uint16(vbid))
+		b.SetVBState(uint16(vbid), VBActive)
+		testLoadInts(t, r, vbid, vbid+1)
+	}
+	if err := b.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+}
+
+func testExpectVBuckets(t *testing.T, b Bucket, numVBuckets int,
+	numStores int, desc string) {
+	r := &reqHandler{currentBucket: b}
+	for vbid := 0; vbid < numVBuckets; vbid++ {
+		expected := []int{}
+		for i := 0; i <= vbid; i++ {
+			expected = append(expected, i)
+		}
+		testExpectInts(t, r, vbid, expected, desc)
+
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb == nil {
+			t.Errorf("%v: expected vbucket: %v", desc, vbid)
+			continue
+		}
+		if vb.bs != b.GetBucketStore(vbid%numStores) {
+			t.Errorf("%v: expected vbucket: %v in store: %v",
+				desc, vbid, vbid%numStores)
+		}
+	}
+}
+
+func TestMultipleStores(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	settings := &BucketSettings{NumPartitions: MAX_VBUCKETS, NumStores: 4}
+	b0, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	testLoadVBuckets(t, b0, 8)
+	testExpectVBuckets(t, b0, 8, 4, "before compaction")
+	if err = b0.Compact(); err != nil {
+		t.Errorf("expected Compact to work, got: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if b0.GetBucketStore(i).Stats().Compacts != 1 {
+			t.Errorf("expected store: %v to be compacted", i)
+		}
+	}
+	testExpectVBuckets(t, b0, 8, 4, "after compaction")
+	b0.Close()
+
+	b1, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected reopening the bucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	testExpectVBuckets(t, b1, 8, 4, "after reload")
+
+	if _, err = NewBucket(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS, NumStores: -1}); err == nil {
+		t.Errorf("expected NewBucket to reject a negative numStores")
+	}
+}
+
+func TestMigrateBucketStores(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS, NumStores: 1})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	testLoadVBuckets(t, b0, 6)
+	b0.Close()
+
+	for _, numStores := range []int{3, 2, 1} {
+		if err = migrateBucketStores(testBucketDir, numStores); err != nil {
+			t.Fatalf("expected migrate to %v stores to work, got: %v",
+				numStores, err)
+		}
+		for i := 0; i < numStores; i++ {
+			fname := path.Join(testBucketDir,
+				makeStoreFileName(i, 0, STORE_FILE_SUFFIX))
+			if _, err = os.Stat(fname); err != nil {
+				t.Errorf("expected store file: %v, got: %v", fname, err)
+			}
+		}
+		maxIdx, _ := maxStoreFileIdx(testBucketDir, STORE_FILE_SUFFIX)
+		if maxIdx != numStores-1 {
+			t.Errorf("expected only %v store files, got max idx: %v",
+				numStores, maxIdx)
+		}
+
+		settings := &BucketSettings{}
+		if _, err = settings.load(testBucketDir); err != nil ||
+			settings.numStores() != numStores {
+			t.Errorf("expected migrated settings, got: %#v, %v", settings, err)
+		}
+		b1, err := NewBucket(testBucketDir, settings)
+		if err != nil {
+			t.Fatalf("expected NewBucket after migrate to work, got: %v", err)
+		}
+		if err = b1.Load(); err != nil {
+			t.Fatalf("expected Load after migrate to work, got: %v", err)
+		}
+		testExpectVBuckets(t, b1, 6, numStores, "after migrate")
+		b1.Close()
+	}
+
+	// Opening with more store files than settings ask for is an error.
+	if err = migrateBucketStores(testBucketDir, 2); err != nil {
+		t.Fatalf("expected migrate to work, got: %v", err)
+	}
+	_, err = NewBucket(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS, NumStores: 1})
+	if err == nil {
+		t.Errorf("expected NewBucket to fail with unmigrated store files")
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/couchbaselabs/cbgb/storefile"
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 type brokenFile struct {
@@ -31,6 +36,10 @@ func (b brokenFile) Stat() (os.FileInfo, error) {
 	return nil, b.error
 }
 
+func (b brokenFile) Sync() error {
+	return b.error
+}
+
 func testLoadInts(t *testing.T, rh *reqHandler, vbid int, numItems int) {
 	for i := 0; i < numItems; i++ {
 		req := &gomemcached.MCRequest{
@@ -679,3 +688,290 @@ func TestReadAtError(t *testing.T) {
 		t.Errorf("expected readerrors to be higher")
 	}
 }
+
+func TestDurabilityModes(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	_, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			Durability:    "whenever",
+		})
+	if err == nil {
+		t.Errorf("expected NewBucket to fail on an unknown durability")
+	}
+
+	for _, test := range []struct {
+		durability string
+		expSyncs   bool
+	}{
+		{"", false},
+		{Durability_NONE, false},
+		{Durability_FSYNC_ON_FLUSH, true},
+	} {
+		bdir, _ := ioutil.TempDir("./tmp", "test")
+		b0, err := NewBucket(bdir,
+			&BucketSettings{
+				NumPartitions: MAX_VBUCKETS,
+				Durability:    test.durability,
+			})
+		if err != nil {
+			t.Fatalf("expected NewBucket to work, got: %v", err)
+		}
+		r0 := &reqHandler{currentBucket: b0}
+		v0, _ := b0.CreateVBucket(2)
+		b0.SetVBState(2, VBActive)
+		testLoadInts(t, r0, 2, 5)
+		if err = b0.Flush(); err != nil {
+			t.Errorf("expected Flush to work, got: %v", err)
+		}
+		st := v0.bs.Stats()
+		if (st.Syncs > 0) != test.expSyncs {
+			t.Errorf("expected syncs %v for durability %q, got: %v",
+				test.expSyncs, test.durability, st.Syncs)
+		}
+		if st.GroupCommits != 0 {
+			t.Errorf("expected no group commits, got: %v", st.GroupCommits)
+		}
+		b0.Close()
+		os.RemoveAll(bdir)
+	}
+}
+
+// A FileLike whose syncs signal that they've started, and then wait
+// until released.
+type slowSyncFileLike struct {
+	FileLike
+	started chan bool
+	release chan bool
+}
+
+func (f *slowSyncFileLike) Sync() error {
+	select {
+	case f.started <- true:
+	default:
+	}
+	<-f.release
+	return f.FileLike.Sync()
+}
+
+func TestGroupCommit(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			Durability:    Durability_FSYNC_PER_BATCH,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	bsf := v0.bs.BSF()
+	slow := &slowSyncFileLike{
+		started: make(chan bool, 1),
+		release: make(chan bool),
+	}
+	bsf.apply(func() {
+		slow.FileLike = bsf.file
+		bsf.file = slow
+	})
+
+	set := func(wg *sync.WaitGroup, i int) {
+		defer wg.Done()
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			Key:     []byte(strconv.Itoa(i)),
+			Body:    []byte(strconv.Itoa(i)),
+			VBucket: 2,
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Errorf("expected SET to work, got: %v", res)
+		}
+	}
+
+	// The first mutation's commit gets stuck in its sync, while the
+	// other writers pile up behind it.
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go set(&wg, 0)
+	<-slow.started
+
+	numWriters := 20
+	for i := 1; i <= numWriters; i++ {
+		wg.Add(1)
+		go set(&wg, i)
+	}
+	for waiting := 0; waiting < numWriters; time.Sleep(time.Millisecond) {
+		v0.bs.commitLock.Lock()
+		waiting = len(v0.bs.commitWaiters)
+		v0.bs.commitLock.Unlock()
+	}
+	close(slow.release)
+	wg.Wait()
+
+	st := v0.bs.Stats()
+	if st.CommitWaiters != int64(numWriters+1) {
+		t.Errorf("expected %v commit waiters, got: %v",
+			numWriters+1, st.CommitWaiters)
+	}
+	if st.GroupCommits != 2 {
+		t.Errorf("expected the waiters to share 2 group commits, got: %v",
+			st.GroupCommits)
+	}
+	if st.Syncs < st.GroupCommits {
+		t.Errorf("expected a sync per group commit, got: %#v", st)
+	}
+	if st.FlushUsecs <= 0 {
+		t.Errorf("expected flush latency to be tracked, got: %#v", st)
+	}
+}
+
+func TestActivityFlush(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions:   MAX_VBUCKETS,
+			FlushDirtyItems: 10,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 5)
+	if v0.bs.Stats().DirtyFlushes != 0 {
+		t.Errorf("expected no flushes below the dirty threshold")
+	}
+
+	testLoadInts(t, r0, 2, 20)
+	for i := 0; i < 100 && v0.bs.Stats().DirtyFlushes == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v0.bs.Stats().DirtyFlushes == 0 {
+		t.Errorf("expected a flush once over the dirty threshold")
+	}
+}
+
+// Checks store files written by the server with the storefile
+// checker that cbgb-fsck uses, before and after damaging them.
+func TestFsckStoreFiles(t *testing.T) {
+	os.Setenv("CBGB_TEST_FSCK_KEY", "0123456789abcdef0123456789abcdef")
+	defer os.Setenv("CBGB_TEST_FSCK_KEY", "")
+
+	for _, keyEnv := range []string{"", "CBGB_TEST_FSCK_KEY"} {
+		testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(testBucketDir)
+
+		settings := &BucketSettings{
+			NumPartitions:    MAX_VBUCKETS,
+			EncryptionKeyEnv: keyEnv,
+		}
+		b0, err := NewBucket(testBucketDir, settings)
+		if err != nil {
+			t.Fatalf("expected NewBucket to work, got: %v", err)
+		}
+		r0 := &reqHandler{currentBucket: b0}
+		b0.CreateVBucket(2)
+		b0.SetVBState(2, VBActive)
+		testLoadInts(t, r0, 2, 5)
+		if err = b0.Flush(); err != nil {
+			t.Errorf("expected Flush to work, got: %v", err)
+		}
+		b0.Close()
+
+		key, err := storefile.LoadKey("", keyEnv)
+		if err != nil {
+			t.Fatalf("expected LoadKey to work, got: %v", err)
+		}
+		checker := &storefile.Checker{Key: key}
+		r := testFsck(t, checker, testBucketDir)
+		if r.Problems() != 0 || r.Keys != 5 || r.VBuckets != 1 {
+			t.Errorf("expected a clean store file, got: %#v", r)
+		}
+
+		// Drop the change that key "0" points at.
+		names, err := storefile.LatestFileNames(testBucketDir, STORE_FILE_SUFFIX)
+		if err != nil || len(names) != 1 {
+			t.Fatalf("expected one store file, got: %v, err: %v", names, err)
+		}
+		f, err := os.OpenFile(path.Join(testBucketDir, names[0]), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("expected store file open to work, got: %v", err)
+		}
+		sf := storefile.File(f)
+		if key != nil {
+			if sf, err = storefile.NewCryptFile(f, key); err != nil {
+				t.Fatalf("expected NewCryptFile to work, got: %v", err)
+			}
+		}
+		store, err := gkvlite.NewStore(sf)
+		if err != nil {
+			t.Fatalf("expected NewStore to work, got: %v", err)
+		}
+		keys := store.GetCollection("2" + COLL_SUFFIX_KEYS)
+		changes := store.GetCollection("2" + COLL_SUFFIX_CHANGES)
+		cas, err := keys.Get([]byte("0"))
+		if err != nil || cas == nil {
+			t.Fatalf("expected key 0 in key index, got: %v, err: %v", cas, err)
+		}
+		if _, err = changes.Delete(cas); err != nil {
+			t.Fatalf("expected change delete to work, got: %v", err)
+		}
+		if err = store.Flush(); err != nil {
+			t.Fatalf("expected store flush to work, got: %v", err)
+		}
+		store.Close()
+		f.Close()
+
+		r = testFsck(t, checker, testBucketDir)
+		if r.Problems() != 1 || r.DanglingKeys != 1 {
+			t.Errorf("expected a dangling key, got: %#v", r)
+		}
+
+		checker.Repair = true
+		r = testFsck(t, checker, testBucketDir)
+		if r.Repaired == "" {
+			t.Errorf("expected a repaired store file, got: %#v", r)
+		}
+		checker.Repair = false
+		r = testFsck(t, checker, testBucketDir)
+		if r.Problems() != 0 || r.Keys != 4 {
+			t.Errorf("expected a clean repaired store file, got: %#v", r)
+		}
+
+		b1, err := NewBucket(testBucketDir, settings)
+		if err != nil {
+			t.Fatalf("expected NewBucket re-open to work, err: %v", err)
+		}
+		if err = b1.Load(); err != nil {
+			t.Errorf("expected Load to work, err: %v", err)
+		}
+		testExpectInts(t, &reqHandler{currentBucket: b1}, 2,
+			[]int{1, 2, 3, 4}, "after repair")
+		b1.Close()
+	}
+}
+
+// Returns the report of checking a single store file bucket dir.
+func testFsck(t *testing.T, checker *storefile.Checker,
+	dir string) *storefile.Report {
+	reports, err := checker.CheckDir(dir)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected CheckDir of one file to work, got: %v, err: %v",
+			reports, err)
+	}
+	return reports[0]
+}
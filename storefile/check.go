@@ -0,0 +1,478 @@
+package storefile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/steveyen/gkvlite"
+)
+
+// Checks, and optionally repairs, the store files of a bucket dir,
+// which the cbgb server must not be running against.
+//
+// Store files have no checksums of their own (gkvlite doesn't keep
+// any), so a check is of what the format lets us verify: that every
+// change decodes and is keyed by its CAS, that every key index entry
+// points at the latest change of its key, and that COLL_VBMETA
+// covers every vbucket.
+type Checker struct {
+	Key    []byte // For encrypted store files.
+	Repair bool   // Write a repaired store file (as the next version).
+
+	// Optional, for logging each problem found.
+	Logf func(format string, args ...interface{})
+}
+
+// Problem counts for a single vbucket, or summed, a whole file.
+type Report struct {
+	File     string `json:"file,omitempty"`
+	Repaired string `json:"repaired,omitempty"` // The repaired file, if any.
+
+	VBuckets       int `json:"vbuckets"`
+	Keys           int `json:"keys"`
+	Changes        int `json:"changes"`
+	BadChanges     int `json:"badChanges"`     // Undecodable, or CAS mismatch.
+	DanglingKeys   int `json:"danglingKeys"`   // Key entry without a change.
+	MismatchedKeys int `json:"mismatchedKeys"` // Key entry at a change of another key.
+	DeletedKeys    int `json:"deletedKeys"`    // Key entry at a deletion.
+	StaleKeys      int `json:"staleKeys"`      // Key entry older than latest change.
+	MissingKeys    int `json:"missingKeys"`    // Latest change not in key index.
+	OrphanChanges  int `json:"orphanChanges"`  // Superseded, un-de-duplicated changes.
+	MetaMissing    int `json:"metaMissing"`
+	MetaBehind     int `json:"metaBehind"` // COLL_VBMETA lastCas below max CAS.
+}
+
+func (r *Report) add(o *Report) {
+	r.VBuckets += o.VBuckets
+	r.Keys += o.Keys
+	r.Changes += o.Changes
+	r.BadChanges += o.BadChanges
+	r.DanglingKeys += o.DanglingKeys
+	r.MismatchedKeys += o.MismatchedKeys
+	r.DeletedKeys += o.DeletedKeys
+	r.StaleKeys += o.StaleKeys
+	r.MissingKeys += o.MissingKeys
+	r.OrphanChanges += o.OrphanChanges
+	r.MetaMissing += o.MetaMissing
+	r.MetaBehind += o.MetaBehind
+}
+
+// Orphan changes are not errors, just wasted space until compaction.
+// A COLL_VBMETA lastCas that's behind is also benign, as the server
+// catches it up from the changes stream at load time.
+func (r *Report) Problems() int {
+	return r.BadChanges + r.DanglingKeys + r.MismatchedKeys +
+		r.DeletedKeys + r.StaleKeys + r.MissingKeys + r.MetaMissing
+}
+
+// The fields of the server's VBMeta that a check needs.
+type vbMeta struct {
+	Id      uint16 `json:"id"`
+	LastCas uint64 `json:"lastCas"`
+	MetaCas uint64 `json:"metaCas"`
+	State   string `json:"state"`
+}
+
+func (c *Checker) problem(vbid int, format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf("vbucket %v: %v", vbid, fmt.Sprintf(format, args...))
+	}
+}
+
+// Checks the latest store file of each store index of a bucket dir.
+func (c *Checker) CheckDir(dir string) ([]*Report, error) {
+	fileNames, err := LatestFileNames(dir, Suffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileNames) == 0 {
+		return nil, fmt.Errorf("no store files in: %v", dir)
+	}
+	rv := []*Report{}
+	for _, fileName := range fileNames {
+		r, err := c.CheckFile(dir, fileName)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, r)
+	}
+	return rv, nil
+}
+
+// Returns the highest versioned file name for each store index.
+func LatestFileNames(dir, suffix string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	latestVers := map[int]int{}
+	latestNames := map[int]string{}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		idx, ver, err := ParseFileName(fileInfo.Name(), suffix)
+		if err != nil {
+			continue
+		}
+		if v, ok := latestVers[idx]; !ok || v < ver {
+			latestVers[idx] = ver
+			latestNames[idx] = fileInfo.Name()
+		}
+	}
+	idxs := []int{}
+	for idx := range latestNames {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	rv := []string{}
+	for _, idx := range idxs {
+		rv = append(rv, latestNames[idx])
+	}
+	return rv, nil
+}
+
+// Opens a store file for gkvlite, decrypting it if there's a key.
+func openFile(p string, flag int, key []byte) (File, error) {
+	f, err := os.OpenFile(p, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		hdr := make([]byte, CryptHeaderLen)
+		n, _ := f.ReadAt(hdr, 0)
+		if IsEncrypted(hdr[:n]) {
+			f.Close()
+			return nil, fmt.Errorf("%v: store file is encrypted, needs a key", p)
+		}
+		return f, nil
+	}
+	cf, err := NewCryptFile(f, key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", p, err)
+	}
+	return cf, nil
+}
+
+func (c *Checker) CheckFile(dir, fileName string) (*Report, error) {
+	p := path.Join(dir, fileName)
+	f, err := openFile(p, os.O_RDONLY, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	store, err := gkvlite.NewStore(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", p, err)
+	}
+	defer store.Close()
+
+	metas := map[int]*vbMeta{}
+	var errVisit error
+	if coll := store.GetCollection(CollVBMeta); coll != nil {
+		err = coll.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+			var vbid int
+			vbid, errVisit = strconv.Atoi(string(i.Key))
+			if errVisit != nil {
+				return false
+			}
+			m := &vbMeta{}
+			if errVisit = json.Unmarshal(i.Val, m); errVisit != nil {
+				return false
+			}
+			metas[vbid] = m
+			return true
+		})
+		if err == nil {
+			err = errVisit
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v: %v", p, CollVBMeta, err)
+		}
+	}
+
+	vbids := []int{}
+	for _, collName := range store.GetCollectionNames() {
+		if !strings.HasSuffix(collName, CollSuffixChanges) {
+			continue
+		}
+		vbid, err := strconv.Atoi(collName[0 : len(collName)-len(CollSuffixChanges)])
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad collection name: %v", p, collName)
+		}
+		vbids = append(vbids, vbid)
+	}
+	sort.Ints(vbids)
+
+	rv := &Report{File: fileName}
+	maxCases := map[int]uint64{}
+	for _, vbid := range vbids {
+		r, maxCas, err := c.checkVBucket(store, vbid, metas[vbid])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+		maxCases[vbid] = maxCas
+		rv.add(r)
+	}
+	if rv.Problems() == 0 || !c.Repair {
+		return rv, nil
+	}
+	rv.Repaired, err = c.writeRepaired(dir, fileName, store, vbids, metas, maxCases)
+	return rv, err
+}
+
+// The latest change of each key, as found in a changes collection.
+type latest struct {
+	cas     uint64
+	deleted bool
+}
+
+// Decodes a changes collection entry, which must be keyed by its CAS.
+func decodeChange(c *gkvlite.Item) (Item, error) {
+	i, err := DecodeItem(c.Val)
+	if err != nil {
+		return i, err
+	}
+	if len(c.Key) != 8 || binary.BigEndian.Uint64(c.Key) != i.Cas {
+		return i, fmt.Errorf("change key: %x, but cas: %v", c.Key, i.Cas)
+	}
+	return i, nil
+}
+
+func (c *Checker) checkVBucket(store *gkvlite.Store, vbid int, meta *vbMeta) (
+	*Report, uint64, error) {
+	r := &Report{VBuckets: 1}
+	changes := store.GetCollection(strconv.Itoa(vbid) + CollSuffixChanges)
+	keys := store.GetCollection(strconv.Itoa(vbid) + CollSuffixKeys)
+	if changes == nil || keys == nil {
+		return nil, 0, fmt.Errorf("vbucket %v: missing keys or changes collection",
+			vbid)
+	}
+
+	var maxCas uint64
+	latests := map[string]latest{}
+	err := changes.VisitItemsAscend(nil, true, func(ci *gkvlite.Item) bool {
+		r.Changes++
+		i, err := decodeChange(ci)
+		if err != nil {
+			r.BadChanges++
+			c.problem(vbid, "bad change at %x, err: %v", ci.Key, err)
+			return true
+		}
+		if maxCas < i.Cas {
+			maxCas = i.Cas
+		}
+		if len(i.Key) == 0 {
+			return true // A metadata change.
+		}
+		if prev, ok := latests[string(i.Key)]; ok && prev.cas < i.Cas {
+			r.OrphanChanges++
+		}
+		latests[string(i.Key)] = latest{i.Cas, i.IsDeletion()}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	indexed := map[string]bool{}
+	var errVisit error
+	err = keys.VisitItemsAscend(nil, true, func(k *gkvlite.Item) bool {
+		r.Keys++
+		indexed[string(k.Key)] = true
+		var ci *gkvlite.Item
+		ci, errVisit = changes.GetItem(k.Val, true)
+		if errVisit != nil {
+			return false
+		}
+		if ci == nil {
+			r.DanglingKeys++
+			c.problem(vbid, "dangling key: %q", k.Key)
+			return true
+		}
+		i, err := decodeChange(ci)
+		if err != nil {
+			return true // Already counted as a bad change.
+		}
+		if !bytes.Equal(i.Key, k.Key) {
+			r.MismatchedKeys++
+			c.problem(vbid, "key: %q points at change of key: %q", k.Key, i.Key)
+			return true
+		}
+		if i.IsDeletion() {
+			r.DeletedKeys++
+			c.problem(vbid, "key: %q points at a deletion", k.Key)
+			return true
+		}
+		if l, ok := latests[string(k.Key)]; ok && l.cas > i.Cas {
+			r.StaleKeys++
+			c.problem(vbid, "key: %q at cas: %v, but latest change is cas: %v",
+				k.Key, i.Cas, l.cas)
+		}
+		return true
+	})
+	if err == nil {
+		err = errVisit
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for k, l := range latests {
+		if !l.deleted && !indexed[k] {
+			r.MissingKeys++
+			c.problem(vbid, "key: %q at cas: %v missing from key index", k, l.cas)
+		}
+	}
+
+	if meta == nil {
+		r.MetaMissing++
+		c.problem(vbid, "missing %v entry", CollVBMeta)
+	} else if meta.LastCas < maxCas {
+		r.MetaBehind++
+		c.problem(vbid, "%v lastCas: %v, but max cas: %v",
+			CollVBMeta, meta.LastCas, maxCas)
+	}
+	return r, maxCas, nil
+}
+
+// Rebuilds a vbucket's collections into dst from its changes stream,
+// keeping only the latest, decodable change for each key.
+func repairVBucket(src, dst *gkvlite.Store, vbid int) error {
+	cName := strconv.Itoa(vbid) + CollSuffixChanges
+	kName := strconv.Itoa(vbid) + CollSuffixKeys
+	cSrc := src.GetCollection(cName)
+	cDst := dst.SetCollection(cName, nil)
+	kDst := dst.SetCollection(kName, nil)
+
+	metaChanges := []*gkvlite.Item{}
+	latests := map[string]*gkvlite.Item{}
+	err := cSrc.VisitItemsAscend(nil, true, func(ci *gkvlite.Item) bool {
+		i, err := decodeChange(ci)
+		if err != nil {
+			return true
+		}
+		if len(i.Key) == 0 {
+			metaChanges = append(metaChanges, ci)
+			return true
+		}
+		latests[string(i.Key)] = ci
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, ci := range metaChanges {
+		if err = cDst.Set(ci.Key, ci.Val); err != nil {
+			return err
+		}
+	}
+	for _, ci := range latests {
+		if err = cDst.Set(ci.Key, ci.Val); err != nil {
+			return err
+		}
+		i, _ := DecodeItem(ci.Val)
+		if !i.IsDeletion() {
+			if err = kDst.Set(i.Key, ci.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes a repaired copy of a store file as its next version, which
+// the server loads instead of the damaged one.
+func (c *Checker) writeRepaired(dir, fileName string, store *gkvlite.Store,
+	vbids []int, metas map[int]*vbMeta, maxCases map[int]uint64) (string, error) {
+	idx, ver, err := ParseFileName(fileName, Suffix)
+	if err != nil {
+		return "", err
+	}
+	nextPath := path.Join(dir, FileName(idx, ver+1, Suffix))
+	tmpPath := nextPath + ".fsck"
+	os.Remove(tmpPath)
+	f, err := openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, c.Key)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	dst, err := gkvlite.NewStore(f)
+	if err != nil {
+		return "", err
+	}
+
+	isVBColl := map[string]bool{CollVBMeta: true}
+	for _, vbid := range vbids {
+		isVBColl[strconv.Itoa(vbid)+CollSuffixChanges] = true
+		isVBColl[strconv.Itoa(vbid)+CollSuffixKeys] = true
+		if err = repairVBucket(store, dst, vbid); err != nil {
+			return "", err
+		}
+	}
+	for _, collName := range store.GetCollectionNames() {
+		if isVBColl[collName] {
+			continue
+		}
+		src := store.GetCollection(collName)
+		cDst := dst.SetCollection(collName, nil)
+		err = src.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+			return cDst.Set(i.Key, i.Val) == nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	mDst := dst.SetCollection(CollVBMeta, nil)
+	for vbid, m := range metas {
+		if m.LastCas < maxCases[vbid] {
+			m.LastCas = maxCases[vbid]
+		}
+		j, err := json.Marshal(m)
+		if err != nil {
+			return "", err
+		}
+		if err = mDst.Set([]byte(strconv.Itoa(vbid)), j); err != nil {
+			return "", err
+		}
+	}
+	// A vbucket without COLL_VBMETA can't be loaded by the server, so
+	// the repaired file records it as a dead vbucket.
+	for _, vbid := range vbids {
+		if metas[vbid] == nil {
+			j, _ := json.Marshal(&vbMeta{Id: uint16(vbid),
+				LastCas: maxCases[vbid], State: "dead"})
+			if err = mDst.Set([]byte(strconv.Itoa(vbid)), j); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err = dst.Flush(); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	dst.Close()
+	f.Close()
+	f = nil
+	if err = os.Rename(tmpPath, nextPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return nextPath, nil
+}
@@ -0,0 +1,269 @@
+package storefile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encrypted files start with a small plaintext header, holding a
+// magic marker, a random per-file nonce and a key check.  The rest
+// of the file is AES-CTR encrypted, where the counter block for any
+// offset is derived from the nonce and the offset, so that pages can
+// be read and written independently (as gkvlite needs).
+//
+// As the key stream only depends on the offset, writing different
+// data at the same offset twice would give away the XOR of the two
+// plaintexts, so encrypted files are append-only: a write may not
+// overlap anything in the file when it was opened or written since,
+// which gkvlite, that only ever appends, keeps to.  Nothing
+// authenticates the data, so the encryption keeps it confidential,
+// but does not detect tampering.
+const (
+	CryptMagic     = "cbgbaes1"
+	CryptHeaderLen = len(CryptMagic) + cryptNonceLen + aes.BlockSize
+
+	cryptNonceLen       = 8
+	cryptKeyCheckDomain = "cbgb key check"
+)
+
+var ErrWrongKey = errors.New("encrypted file does not match key")
+var ErrNotEncrypted = errors.New("file is not encrypted")
+var ErrOverwrite = errors.New("encrypted file is append-only," +
+	" so may not overwrite written data")
+
+// The file operations that a store file needs, which *os.File and
+// the cbgb server's FileLike both have.
+type File interface {
+	io.Closer
+	io.ReaderAt
+	io.WriterAt
+
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+type cryptFile struct {
+	file  File
+	key   []byte
+	block cipher.Block
+	nonce []byte
+
+	m       sync.Mutex
+	written []cryptExtent // Sorted and merged, from [0, size at open).
+}
+
+// A [beg, end) range of data offsets.
+type cryptExtent struct {
+	beg, end int64
+}
+
+// Wraps a File so that everything written through it is encrypted
+// with the given key.  A new (empty) file gets a fresh header; an
+// existing file must have been written with the same key.
+func NewCryptFile(file File, key []byte) (File, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	rv := &cryptFile{file: file, key: key, block: block}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		rv.nonce = make([]byte, cryptNonceLen)
+		if _, err = rand.Read(rv.nonce); err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, 0, CryptHeaderLen)
+		hdr = append(hdr, CryptMagic...)
+		hdr = append(hdr, rv.nonce...)
+		hdr = append(hdr, rv.keyCheck()...)
+		if _, err = file.WriteAt(hdr, 0); err != nil {
+			return nil, err
+		}
+		return rv, nil
+	}
+	// Even the tail of a torn write may not be written again.
+	rv.written = []cryptExtent{{0, cryptFileInfo{fi}.Size()}}
+
+	hdr := make([]byte, CryptHeaderLen)
+	if _, err = file.ReadAt(hdr, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !IsEncrypted(hdr) {
+		return nil, ErrNotEncrypted
+	}
+	rv.nonce = hdr[len(CryptMagic) : len(CryptMagic)+cryptNonceLen]
+	if !hmac.Equal(hdr[len(CryptMagic)+cryptNonceLen:], rv.keyCheck()) {
+		return nil, ErrWrongKey
+	}
+	return rv, nil
+}
+
+// Whether the start of a file is the header of an encrypted file.
+func IsEncrypted(hdr []byte) bool {
+	return len(hdr) >= CryptHeaderLen &&
+		bytes.Equal(hdr[:len(CryptMagic)], []byte(CryptMagic))
+}
+
+// The key check is an HMAC of the nonce rather than anything
+// encrypted with the data key, as an encrypted block of the nonce is
+// also the key stream at some data offset, and would give away the
+// plaintext there.
+func (f *cryptFile) keyCheck() []byte {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(cryptKeyCheckDomain))
+	mac.Write(f.nonce)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// XOR's src into dst with the key stream for the given (data) offset.
+func (f *cryptFile) xorKeyStream(dst, src []byte, off int64) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, f.nonce)
+	binary.BigEndian.PutUint64(iv[cryptNonceLen:], uint64(off/aes.BlockSize))
+	stream := cipher.NewCTR(f.block, iv)
+	if skip := int(off % aes.BlockSize); skip > 0 {
+		pad := make([]byte, skip)
+		stream.XORKeyStream(pad, pad)
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+func (f *cryptFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *cryptFile) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return cryptFileInfo{fi}, nil
+}
+
+func (f *cryptFile) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = f.file.ReadAt(p, off+int64(CryptHeaderLen))
+	f.xorKeyStream(p[:n], p[:n], off)
+	return n, err
+}
+
+func (f *cryptFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if err = f.reserve(off, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, len(p))
+	f.xorKeyStream(buf, p, off)
+	return f.file.WriteAt(buf, off+int64(CryptHeaderLen))
+}
+
+// Adds the [beg, end) range to the written extents, unless it
+// overlaps any of them.  A range stays reserved even if its write
+// fails, as part of it may have made it to the file.  Writes come
+// mostly in order, so there's usually just the one extent.
+func (f *cryptFile) reserve(beg, end int64) error {
+	if beg >= end {
+		return nil
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	i := sort.Search(len(f.written), func(i int) bool {
+		return f.written[i].end > beg
+	})
+	if i < len(f.written) && f.written[i].beg < end {
+		return ErrOverwrite
+	}
+	if i > 0 && f.written[i-1].end == beg {
+		f.written[i-1].end = end
+		if i < len(f.written) && f.written[i].beg == end {
+			f.written[i-1].end = f.written[i].end
+			f.written = append(f.written[:i], f.written[i+1:]...)
+		}
+		return nil
+	}
+	if i < len(f.written) && f.written[i].beg == end {
+		f.written[i].beg = beg
+		return nil
+	}
+	f.written = append(f.written, cryptExtent{})
+	copy(f.written[i+1:], f.written[i:])
+	f.written[i] = cryptExtent{beg, end}
+	return nil
+}
+
+// Hides the header from the reported file size.
+type cryptFileInfo struct {
+	os.FileInfo
+}
+
+func (fi cryptFileInfo) Size() int64 {
+	s := fi.FileInfo.Size() - int64(CryptHeaderLen)
+	if s < 0 {
+		return 0
+	}
+	return s
+}
+
+// Returns an encryption key from a key file or, if there's no key
+// file, from an environment variable, or nil if there's neither.
+func LoadKey(keyFile, keyEnv string) ([]byte, error) {
+	var raw []byte
+	switch {
+	case keyFile != "":
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	case keyEnv != "":
+		v := os.Getenv(keyEnv)
+		if v == "" {
+			return nil, fmt.Errorf("missing encryption key env var: %v", keyEnv)
+		}
+		raw = []byte(v)
+	default:
+		return nil, nil
+	}
+	return ParseKey(raw)
+}
+
+// Parses an encryption key, which is either hex encoded (tried
+// first) or raw bytes, for AES-128, AES-192 or AES-256.
+func ParseKey(raw []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(raw))
+	switch len(s) {
+	case 32, 48, 64:
+		if k, err := hex.DecodeString(s); err == nil {
+			return k, nil
+		}
+	}
+	switch len(raw) {
+	case 16, 24, 32:
+		return raw, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes,"+
+		" or hex encoded, got length: %v", len(raw))
+}
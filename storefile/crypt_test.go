@@ -0,0 +1,108 @@
+package storefile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testCryptKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestCryptKeyCheckNotKeyStream(t *testing.T) {
+	fn := ",crypt-file-check"
+	defer os.Remove(fn)
+
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer f.Close()
+	cf, err := NewCryptFile(f, testCryptKey)
+	if err != nil {
+		t.Fatalf("Error wrapping file: %v", err)
+	}
+	// Encrypting zeros leaves the raw key stream in the file.
+	if _, err = cf.WriteAt(make([]byte, 4*aes.BlockSize), 0); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	raw, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading raw file: %v", err)
+	}
+	check := raw[CryptHeaderLen-aes.BlockSize : CryptHeaderLen]
+	stream := raw[CryptHeaderLen:]
+	for off := 0; off+aes.BlockSize <= len(stream); off += aes.BlockSize {
+		if bytes.Equal(check, stream[off:off+aes.BlockSize]) {
+			t.Errorf("Expected key check not to be key stream at: %v", off)
+		}
+	}
+}
+
+func TestCryptFileAppendOnly(t *testing.T) {
+	fn := ",crypt-file-append"
+	defer os.Remove(fn)
+
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	cf, err := NewCryptFile(f, testCryptKey)
+	if err != nil {
+		t.Fatalf("Error wrapping file: %v", err)
+	}
+	// Out of order, as long as nothing overlaps.
+	for _, off := range []int64{10, 0, 30, 20} {
+		if _, err = cf.WriteAt(make([]byte, 10), off); err != nil {
+			t.Errorf("Expected write at %v to work, got: %v", off, err)
+		}
+	}
+	for _, off := range []int64{0, 5, 35} {
+		if _, err = cf.WriteAt(make([]byte, 10), off); err != ErrOverwrite {
+			t.Errorf("Expected ErrOverwrite at %v, got: %v", off, err)
+		}
+	}
+	f.Close()
+
+	f, err = os.OpenFile(fn, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("Error reopening file: %v", err)
+	}
+	defer f.Close()
+	if cf, err = NewCryptFile(f, testCryptKey); err != nil {
+		t.Fatalf("Error wrapping reopened file: %v", err)
+	}
+	if _, err = cf.WriteAt(make([]byte, 10), 20); err != ErrOverwrite {
+		t.Errorf("Expected ErrOverwrite after reopen, got: %v", err)
+	}
+	if _, err = cf.WriteAt(make([]byte, 10), 40); err != nil {
+		t.Errorf("Expected append after reopen to work, got: %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in     string
+		expLen int
+	}{
+		{"0123456789abcdef", 16},
+		{"0123456789abcdef01234567", 24},
+		{"0123456789abcdef0123456789abcdef", 16}, // Hex.
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n", 32},
+		{"too short", -1},
+	}
+	for _, test := range tests {
+		k, err := ParseKey([]byte(test.in))
+		if test.expLen < 0 {
+			if err == nil {
+				t.Errorf("Expected error for key: %q", test.in)
+			}
+			continue
+		}
+		if err != nil || len(k) != test.expLen {
+			t.Errorf("Expected key len %v for %q, got: %v, err: %v",
+				test.expLen, test.in, len(k), err)
+		}
+	}
+}
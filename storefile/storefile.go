@@ -0,0 +1,101 @@
+// Package storefile has the on-disk format of cbgb's *.store files,
+// shared by the cbgb server and its offline tools, like cbgb-fsck.
+//
+// A store file is a gkvlite store, optionally encrypted, holding per
+// vbucket a changes collection (keyed by CAS, holding items) and a
+// keys collection (keyed by item key, holding the CAS of the item's
+// latest change), along with a vbucket metadata collection.
+package storefile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	Suffix            = "store"
+	CollSuffixKeys    = ".k" // This suffix sorts before CHANGES suffix.
+	CollSuffixChanges = ".s" // The changes is like a "sequence" stream.
+	CollVBMeta        = "vbm"
+
+	DeletionExp  = 0x80000000 // Deletion sentinel exp.
+	DeletionFlag = 0xffffffff // Deletion sentinel flag.
+
+	ItemHdrLen = 4 + 4 + 8 + 2 + 4
+)
+
+// An item as stored in a changes collection.
+type Item struct {
+	Key       []byte
+	Exp, Flag uint32
+	Cas       uint64
+	Data      []byte
+}
+
+func (i *Item) IsDeletion() bool {
+	return i.Exp == DeletionExp && i.Flag == DeletionFlag && len(i.Data) == 0
+}
+
+// Serializes an item as the value of a changes collection entry.
+func (i *Item) Bytes() []byte {
+	rv := make([]byte, ItemHdrLen+len(i.Key)+len(i.Data))
+	binary.BigEndian.PutUint32(rv[0:], i.Exp)
+	binary.BigEndian.PutUint32(rv[4:], i.Flag)
+	binary.BigEndian.PutUint64(rv[8:], i.Cas)
+	binary.BigEndian.PutUint16(rv[16:], uint16(len(i.Key)))
+	binary.BigEndian.PutUint32(rv[18:], uint32(len(i.Data)))
+	n := copy(rv[ItemHdrLen:], i.Key)
+	copy(rv[ItemHdrLen+n:], i.Data)
+	return rv
+}
+
+// Decodes the value of a changes collection entry, where the key and
+// data of the item share the given bytes.
+func DecodeItem(b []byte) (Item, error) {
+	if len(b) < ItemHdrLen {
+		return Item{}, fmt.Errorf("item too short: %v, minimum: %v",
+			len(b), ItemHdrLen)
+	}
+	keylen := int(binary.BigEndian.Uint16(b[16:]))
+	datalen := int(binary.BigEndian.Uint32(b[18:]))
+	if len(b) < ItemHdrLen+keylen+datalen {
+		return Item{}, fmt.Errorf("item too short: %v, wanted: %v",
+			len(b), ItemHdrLen+keylen+datalen)
+	}
+	return Item{
+		Key:  b[ItemHdrLen : ItemHdrLen+keylen],
+		Exp:  binary.BigEndian.Uint32(b[0:]),
+		Flag: binary.BigEndian.Uint32(b[4:]),
+		Cas:  binary.BigEndian.Uint64(b[8:]),
+		Data: b[ItemHdrLen+keylen : ItemHdrLen+keylen+datalen],
+	}, nil
+}
+
+// The store files follow a "IDX-VER.SUFFIX" naming pattern,
+// such as "0-0.store".
+func FileName(idx int, ver int, suffix string) string {
+	return fmt.Sprintf("%v-%v.%v", idx, ver, suffix)
+}
+
+func ParseFileName(fileName string, suffix string) (idx int, ver int, err error) {
+	if !strings.HasSuffix(fileName, "."+suffix) {
+		return -1, -1, fmt.Errorf("missing suffix: %v in filename: %v",
+			suffix, fileName)
+	}
+	base := fileName[0 : len(fileName)-(1+len(suffix))]
+	parts := strings.Split(base, "-")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return -1, -1, fmt.Errorf("not a store filename: %v", fileName)
+	}
+	idx, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return -1, -1, err
+	}
+	ver, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return -1, -1, err
+	}
+	return idx, ver, nil
+}
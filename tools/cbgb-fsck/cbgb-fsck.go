@@ -0,0 +1,63 @@
+// Offline integrity checker (and optional repairer) for the *.store
+// files of a cbgb bucket directory.  The cbgb server should not be
+// running against the bucket directory while this tool runs.
+//
+// Usage: cbgb-fsck [flags] <bucket-dir>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/couchbaselabs/cbgb/storefile"
+)
+
+var repair = flag.Bool("repair", false,
+	"write a repaired store file (as the next store file version)")
+var keyFile = flag.String("encryption-key-file", "",
+	"key file, for buckets with encrypted store files")
+var keyEnv = flag.String("encryption-key-env", "",
+	"env var holding the key, for buckets with encrypted store files")
+var verbose = flag.Bool("v", false, "log each problem found")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <bucket-dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nflags:\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+
+	key, err := storefile.LoadKey(*keyFile, *keyEnv)
+	if err != nil {
+		log.Fatalf("FATAL: loading encryption key: %v", err)
+	}
+	checker := &storefile.Checker{Key: key, Repair: *repair}
+	if *verbose {
+		checker.Logf = log.Printf
+	}
+
+	reports, err := checker.CheckDir(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	problems := 0
+	for _, r := range reports {
+		j, _ := json.Marshal(r)
+		log.Printf("%s", j)
+		if r.Repaired != "" {
+			log.Printf("%v: wrote repaired store file: %v", r.File, r.Repaired)
+		}
+		problems += r.Problems()
+	}
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
@@ -14,23 +14,25 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/couchbaselabs/cbgb/storefile"
 	"github.com/dustin/go-broadcast"
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 const (
 	CHANGES_SINCE        = gomemcached.CommandCode(0x60)
 	GET_VBMETA           = gomemcached.CommandCode(0x61)
 	SET_VBMETA           = gomemcached.CommandCode(0x62)
-	COLL_SUFFIX_KEYS     = ".k" // This suffix sorts before CHANGES suffix.
-	COLL_SUFFIX_CHANGES  = ".s" // The changes is like a "sequence" stream.
-	COLL_VBMETA          = "vbm"
+	COLL_SUFFIX_KEYS     = storefile.CollSuffixKeys
+	COLL_SUFFIX_CHANGES  = storefile.CollSuffixChanges
+	COLL_VBMETA          = storefile.CollVBMeta
 	MAX_VBID             = 0x0000ffff // Due to uint16.
 	MAX_ITEM_KEY_LENGTH  = 250
 	MAX_ITEM_DATA_LENGTH = 1024 * 1024
 	MAX_ITEM_EXP         = 0x7fffffff
-	DELETION_EXP         = 0x80000000 // Deletion sentinel exp.
-	DELETION_FLAG        = 0xffffffff // Deletion sentinel flag.
+	DELETION_EXP         = storefile.DeletionExp
+	DELETION_FLAG        = storefile.DeletionFlag
 )
 
 var ignore = errors.New("not-an-error/sentinel")
@@ -55,8 +57,9 @@ type VBucket struct {
 	bucketItemBytes *int64
 	staleness       int64 // To track view freshness.
 
-	viewsStore *bucketstore
-	viewsLock  sync.Mutex
+	viewsStore   *bucketstore
+	viewsLock    sync.Mutex
+	viewsFullSet map[string]bool // Dev views indexed outside the dev subset.
 }
 
 func (v VBucket) String() string {
@@ -127,6 +130,9 @@ func (v *VBucket) Close() error {
 		return nil
 	}
 	close(v.available)
+	if vs := v.openedViewsStore(); vs != nil {
+		vs.Close()
+	}
 	return v.observer.Close()
 }
 
@@ -224,7 +230,8 @@ func (v *VBucket) load() (err error) {
 	v.Apply(func() {
 		meta := v.Meta().Copy()
 
-		x, err := v.bs.collMeta(COLL_VBMETA).GetItem(
+		var x *gkvlite.Item
+		x, err = v.bs.collMeta(COLL_VBMETA).GetItem(
 			[]byte(fmt.Sprintf("%v", v.vbid)), true)
 		if err != nil {
 			return
@@ -237,13 +244,30 @@ func (v *VBucket) load() (err error) {
 			return
 		}
 
-		_, changes := v.ps.colls()
-		i, err := changes.MaxItem(true)
+		var fixup *partitionFixup
+		fixup, err = v.ps.loadFixup()
+		if err != nil {
+			return
+		}
+		if fixup.repaired() {
+			log.Printf("vbucket %v: load fixup repaired key-index: %+v",
+				v.vbid, *fixup)
+		}
+
+		var changes *gkvlite.Collection
+		var release func()
+		_, changes, release, err = v.ps.collsRef()
 		if err != nil {
 			return
 		}
+		var i *gkvlite.Item
+		i, err = changes.MaxItem(true)
+		release()
+		if err != nil {
+			return
+		}
+		var lastCas uint64
 		if i != nil {
-			var lastCas uint64
 			lastCas, err = casBytesParse(i.Key)
 			if err != nil {
 				return
@@ -255,13 +279,19 @@ func (v *VBucket) load() (err error) {
 
 		atomic.StorePointer(&v.meta, unsafe.Pointer(meta))
 
-		numItems, numItemBytes, err := v.ps.getTotals()
+		// Totals come after the fixup, so they reflect the repairs.
+		var numItems, numItemBytes uint64
+		numItems, numItemBytes, err = v.ps.getTotals()
 		if err == nil {
 			atomic.StoreInt64(&v.stats.Items, int64(numItems))
 			atomic.StoreInt64(&v.stats.ItemBytes, int64(numItemBytes))
 			atomic.AddInt64(v.bucketItemBytes, int64(numItemBytes))
 		}
 
+		if err == nil {
+			err = v.loadViewsStore(lastCas)
+		}
+
 		// TODO: What if we're loading something out of allowed range?
 	})
 
@@ -115,11 +115,28 @@ func vbMutate(v *VBucket, w io.Writer,
 	if err == nil {
 		v.markStale()
 		v.observer.Submit(mutation{v.vbid, req.Key, itemCas, false})
+		res = vbWaitCommitted(v, res)
 	}
 
 	return res
 }
 
+// In the fsync-per-batch durability mode, a mutation is acknowledged
+// only after it's been group committed.
+func vbWaitCommitted(v *VBucket,
+	res *gomemcached.MCResponse) *gomemcached.MCResponse {
+	if !v.bs.syncMutations() {
+		return res
+	}
+	if err := v.bs.waitCommitted(); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store commit error %v", err)),
+		}
+	}
+	return res
+}
+
 func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 	cmd gomemcached.CommandCode, itemOld *item) (*gomemcached.MCResponse, error) {
 	if cmd == gomemcached.ADD && itemOld != nil {
@@ -288,6 +305,7 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 	if err == nil && prevItem != nil {
 		v.markStale()
 		v.observer.Submit(mutation{v.vbid, req.Key, cas, true})
+		res = vbWaitCommitted(v, res)
 	}
 
 	return res
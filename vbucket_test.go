@@ -6,6 +6,8 @@ import (
 
 	"testing"
 	"time"
+
+	"github.com/steveyen/gkvlite"
 )
 
 func TestVBucketHash(t *testing.T) {
@@ -105,6 +107,73 @@ func TestItemBytesPersists(t *testing.T) {
 	}
 }
 
+func TestLoadFixup(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 5)
+
+	// Simulate flushes that happened in the middle of mutations,
+	// leaving the key-index out of sync with the changes-stream.
+	vb0.ps.mutate(func(keys, changes *gkvlite.Collection) {
+		// A set whose key-index update didn't make it.
+		i5 := &item{key: []byte("5"), cas: 1000, data: []byte("5")}
+		changes.Set(casBytes(i5.cas), i5.toValueBytes())
+		// A delete whose key-index update didn't make it.
+		d0 := &item{key: []byte("0"), cas: 1001}
+		changes.Set(casBytes(d0.cas), d0.markAsDeletion().toValueBytes())
+		// A key whose change is missing.
+		keys.Set([]byte("6"), casBytes(999))
+	})
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	b0.Close()
+
+	b1, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Errorf("expected Load to work, got: %v", err)
+	}
+
+	r1 := &reqHandler{currentBucket: b1}
+	testExpectInts(t, r1, 2, []int{1, 2, 3, 4, 5}, "after load fixup")
+
+	vb1, _ := b1.GetVBucket(2)
+	if vb1.stats.Items != 5 {
+		t.Errorf("expected 5 items after load fixup, got: %v",
+			vb1.stats.Items)
+	}
+	if vb1.Meta().LastCas < 1001 {
+		t.Errorf("expected lastCas to cover replayed changes, got: %v",
+			vb1.Meta().LastCas)
+	}
+
+	fixup, err := vb1.ps.loadFixup()
+	if err != nil {
+		t.Errorf("expected loadFixup to work, got: %v", err)
+	}
+	if fixup.repaired() || fixup.KeysScanned != 5 {
+		t.Errorf("expected nothing more to repair, got: %+v", fixup)
+	}
+}
+
 func TestExpirationComputin(t *testing.T) {
 	current, err := time.Parse(time.RFC3339, "2013-03-05T18:01:00Z")
 	if err != nil {
@@ -30,6 +30,7 @@ type Form interface {
 
 type ViewResult struct {
 	TotalRows int      `json:"total_rows"`
+	UpdateSeq uint64   `json:"update_seq,omitempty"`
 	Rows      ViewRows `json:"rows"`
 }
 
@@ -45,6 +46,7 @@ type ViewRow struct {
 	Key   interface{}   `json:"key,omitempty"`
 	Value interface{}   `json:"value,omitempty"`
 	Doc   *ViewDocValue `json:"doc,omitempty"`
+	Error string        `json:"error,omitempty"`
 }
 
 func (rows ViewRows) Len() int {
@@ -61,22 +63,23 @@ func (rows ViewRows) Less(i, j int) bool {
 
 // From http://wiki.apache.org/couchdb/HTTP_view_API
 type ViewParams struct {
-	Key           interface{} `json:"key"`
-	Keys          string      `json:"keys"` // TODO: should be []interface{}.
-	StartKey      interface{} `json:"startkey" alias:"start_key"`
-	StartKeyDocId string      `json:"startkey_docid"`
-	EndKey        interface{} `json:"endkey" alias:"end_key"`
-	EndKeyDocId   string      `json:"endkey_docid"`
-	Stale         string      `json:"stale"`
-	Descending    bool        `json:"descending"`
-	Group         bool        `json:"group"`
-	GroupLevel    uint64      `json:"group_level"`
-	IncludeDocs   bool        `json:"include_docs"`
-	InclusiveEnd  bool        `json:"inclusive_end"`
-	Limit         uint64      `json:"limit"`
-	Reduce        bool        `json:"reduce"`
-	Skip          uint64      `json:"skip"`
-	UpdateSeq     bool        `json:"update_seq"`
+	Key           interface{}   `json:"key"`
+	Keys          []interface{} `json:"keys"`
+	StartKey      interface{}   `json:"startkey" alias:"start_key"`
+	StartKeyDocId string        `json:"startkey_docid"`
+	EndKey        interface{}   `json:"endkey" alias:"end_key"`
+	EndKeyDocId   string        `json:"endkey_docid"`
+	Stale         string        `json:"stale"`
+	Descending    bool          `json:"descending"`
+	Group         bool          `json:"group"`
+	GroupLevel    uint64        `json:"group_level"`
+	IncludeDocs   bool          `json:"include_docs"`
+	InclusiveEnd  bool          `json:"inclusive_end"`
+	Limit         uint64        `json:"limit"`
+	Reduce        bool          `json:"reduce"`
+	Skip          uint64        `json:"skip"`
+	UpdateSeq     bool          `json:"update_seq"`
+	FullSet       bool          `json:"full_set"`
 }
 
 func NewViewParams() *ViewParams {
@@ -131,6 +134,13 @@ func ParseViewParams(params Form) (p *ViewParams, err error) {
 			val.Field(i).SetUint(v)
 		case sf.Type.Kind() == reflect.Bool:
 			val.Field(i).SetBool(paramVal == "true")
+		case sf.Type.Kind() == reflect.Slice:
+			ob := reflect.New(sf.Type)
+			err := json.Unmarshal([]byte(paramVal), ob.Interface())
+			if err != nil {
+				return p, err
+			}
+			val.Field(i).Set(ob.Elem())
 		case sf.Type.Kind() == reflect.Interface:
 			var ob interface{}
 			err := json.Unmarshal([]byte(paramVal), &ob)
@@ -146,8 +156,18 @@ func ParseViewParams(params Form) (p *ViewParams, err error) {
 	return p, nil
 }
 
-// Merge incoming, sorted ViewRows by Key.
+// Merge incoming, sorted ViewRows by Key, then by doc Id.
 func MergeViewRows(inSorted []chan *ViewRow, out chan *ViewRow) {
+	mergeViewRows(inSorted, out, false)
+}
+
+// Merge incoming, reverse sorted ViewRows by Key, then by doc Id.
+func MergeViewRowsDescending(inSorted []chan *ViewRow, out chan *ViewRow) {
+	mergeViewRows(inSorted, out, true)
+}
+
+func mergeViewRows(inSorted []chan *ViewRow, out chan *ViewRow,
+	descending bool) {
 	end := &ViewRow{} // Sentinel.
 	arr := make([]*ViewRow, len(inSorted))
 
@@ -173,7 +193,8 @@ func MergeViewRows(inSorted []chan *ViewRow, out chan *ViewRow) {
 				ileast = i
 				vleast = v
 			} else if v != end {
-				if walrus.CollateJSON(vleast.Key, v.Key) > 0 {
+				c := walrus.CollateJSON(vleast.Key, v.Key)
+				if (c > 0 || (c == 0 && vleast.Id > v.Id)) != descending {
 					ileast = i
 					vleast = v
 				}
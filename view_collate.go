@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/couchbaselabs/walrus"
+)
+
+// The view indexes keep view keys in a binary encoding rather than as
+// JSON, so that the index collections' key comparisons walk the bytes
+// instead of decoding JSON.  Each value starts with a tag, and the
+// tags are in view collation order (see walrus.CollateJSON), so only
+// strings and objects that differ need to be collated by walrus.
+const (
+	viewKeyEnd    = 0x00 // Ends an array or object.
+	viewKeyNull   = 0x01
+	viewKeyFalse  = 0x02
+	viewKeyTrue   = 0x03
+	viewKeyNumber = 0x04 // Then the 8 bytes of viewKeyNumberBits().
+	viewKeyString = 0x05 // Then the string, 0x00's escaped as 0x00 0xff, then 0x00 0x01.
+	viewKeyArray  = 0x06 // Then the items, then viewKeyEnd.
+	viewKeyObject = 0x07 // Then each member's name (a string) and value, then viewKeyEnd.
+)
+
+var viewKeyShort = errors.New("view key encoding is too short")
+
+func encodeViewKey(key interface{}) ([]byte, error) {
+	return appendViewKey(nil, key)
+}
+
+func encodeViewKeyJson(keyJson []byte) ([]byte, error) {
+	var key interface{}
+	if err := json.Unmarshal(keyJson, &key); err != nil {
+		return nil, err
+	}
+	return encodeViewKey(key)
+}
+
+func appendViewKey(b []byte, key interface{}) ([]byte, error) {
+	switch k := key.(type) {
+	case nil:
+		return append(b, viewKeyNull), nil
+	case bool:
+		if k {
+			return append(b, viewKeyTrue), nil
+		}
+		return append(b, viewKeyFalse), nil
+	case float64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], viewKeyNumberBits(k))
+		return append(append(b, viewKeyNumber), buf[:]...), nil
+	case string:
+		return appendViewKeyString(b, k), nil
+	case []interface{}:
+		b = append(b, viewKeyArray)
+		for _, x := range k {
+			var err error
+			if b, err = appendViewKey(b, x); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, viewKeyEnd), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(k))
+		for name := range k {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b = append(b, viewKeyObject)
+		for _, name := range names {
+			b = appendViewKeyString(b, name)
+			var err error
+			if b, err = appendViewKey(b, k[name]); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, viewKeyEnd), nil
+	}
+	// Like the ints of a view's params, so go through JSON to get
+	// the types that JSON decodes to.
+	j, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	var x interface{}
+	if err = json.Unmarshal(j, &x); err != nil {
+		return nil, err
+	}
+	return appendViewKey(b, x)
+}
+
+func appendViewKeyString(b []byte, s string) []byte {
+	b = append(b, viewKeyString)
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			b = append(b, 0, 0xff)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// Maps a number to bits that sort like the number, by flipping the
+// sign bit of positive numbers and all the bits of negative ones.
+func viewKeyNumberBits(f float64) uint64 {
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		return ^u
+	}
+	return u | 1<<63
+}
+
+func decodeViewKeyNumber(b []byte) float64 {
+	u := binary.BigEndian.Uint64(b)
+	if u&(1<<63) != 0 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+// Returns the string at the start of b, after its tag, and the length
+// of its encoding.
+func decodeViewKeyString(b []byte) (string, int, error) {
+	var s []byte // Only used for strings with escapes.
+	start := 1
+	for i := 1; i+1 < len(b); i++ {
+		if b[i] != 0 {
+			continue
+		}
+		switch b[i+1] {
+		case 1:
+			if s == nil {
+				return string(b[start:i]), i + 2, nil
+			}
+			return string(append(s, b[start:i]...)), i + 2, nil
+		case 0xff:
+			s = append(append(s, b[start:i]...), 0)
+			i++
+			start = i + 1
+		default:
+			return "", 0, fmt.Errorf("bad view key string escape: %x", b[i+1])
+		}
+	}
+	return "", 0, viewKeyShort
+}
+
+// Returns the length of the encoding of the view key at the start of
+// b, without decoding it.
+func viewKeyLen(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, viewKeyShort
+	}
+	switch b[0] {
+	case viewKeyNull, viewKeyFalse, viewKeyTrue:
+		return 1, nil
+	case viewKeyNumber:
+		if len(b) < 9 {
+			return 0, viewKeyShort
+		}
+		return 9, nil
+	case viewKeyString:
+		for i := 1; i+1 < len(b); i++ {
+			if b[i] == 0 {
+				if b[i+1] == 1 {
+					return i + 2, nil
+				}
+				i++
+			}
+		}
+		return 0, viewKeyShort
+	case viewKeyArray, viewKeyObject:
+		// An object's members are a name and a value, in a row.
+		for n := 1; n < len(b); {
+			if b[n] == viewKeyEnd {
+				return n + 1, nil
+			}
+			xn, err := viewKeyLen(b[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += xn
+		}
+		return 0, viewKeyShort
+	}
+	return 0, fmt.Errorf("bad view key tag: %x", b[0])
+}
+
+// Decodes the view key at the start of b, returning also the length
+// of its encoding.
+func decodeViewKey(b []byte) (key interface{}, n int, err error) {
+	if len(b) == 0 {
+		return nil, 0, viewKeyShort
+	}
+	switch b[0] {
+	case viewKeyNull:
+		return nil, 1, nil
+	case viewKeyFalse:
+		return false, 1, nil
+	case viewKeyTrue:
+		return true, 1, nil
+	case viewKeyNumber:
+		if len(b) < 9 {
+			return nil, 0, viewKeyShort
+		}
+		return decodeViewKeyNumber(b[1:9]), 9, nil
+	case viewKeyString:
+		return decodeViewKeyString(b)
+	case viewKeyArray:
+		rv := []interface{}{}
+		for n = 1; n < len(b) && b[n] != viewKeyEnd; {
+			x, xn, err := decodeViewKey(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			rv = append(rv, x)
+			n += xn
+		}
+		if n >= len(b) {
+			return nil, 0, viewKeyShort
+		}
+		return rv, n + 1, nil
+	case viewKeyObject:
+		rv := map[string]interface{}{}
+		for n = 1; n < len(b) && b[n] != viewKeyEnd; {
+			if b[n] != viewKeyString {
+				return nil, 0, fmt.Errorf("bad view key object member: %x", b[n])
+			}
+			name, nameLen, err := decodeViewKeyString(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			n += nameLen
+			x, xn, err := decodeViewKey(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			rv[name] = x
+			n += xn
+		}
+		if n >= len(b) {
+			return nil, 0, viewKeyShort
+		}
+		return rv, n + 1, nil
+	}
+	return nil, 0, fmt.Errorf("bad view key tag: %x", b[0])
+}
+
+// Collates the encoded view keys at the start of a and b, like
+// walrus.CollateJSON does their decoded keys.  When they collate the
+// same, it also returns the lengths of their encodings.
+func collateViewKeys(a, b []byte) (c, an, bn int, err error) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, 0, 0, viewKeyShort
+	}
+	if a[0] != b[0] { // Of different types, or one array ended first.
+		if a[0] < b[0] {
+			return -1, 0, 0, nil
+		}
+		return 1, 0, 0, nil
+	}
+	switch a[0] {
+	case viewKeyNull, viewKeyFalse, viewKeyTrue:
+		return 0, 1, 1, nil
+	case viewKeyNumber:
+		if len(a) < 9 || len(b) < 9 {
+			return 0, 0, 0, viewKeyShort
+		}
+		af, bf := decodeViewKeyNumber(a[1:9]), decodeViewKeyNumber(b[1:9])
+		if af < bf {
+			return -1, 0, 0, nil
+		}
+		if af > bf {
+			return 1, 0, 0, nil
+		}
+		return 0, 9, 9, nil
+	case viewKeyArray:
+		for an, bn = 1, 1; an < len(a) && bn < len(b); {
+			if a[an] == viewKeyEnd && b[bn] == viewKeyEnd {
+				return 0, an + 1, bn + 1, nil
+			}
+			c, xn, yn, err := collateViewKeys(a[an:], b[bn:])
+			if err != nil || c != 0 {
+				return c, 0, 0, err
+			}
+			an, bn = an+xn, bn+yn
+		}
+		return 0, 0, 0, viewKeyShort
+	}
+	// Strings and objects, which walrus collates unless they're the
+	// same.
+	if an, err = viewKeyLen(a); err != nil {
+		return 0, 0, 0, err
+	}
+	if bn, err = viewKeyLen(b); err != nil {
+		return 0, 0, 0, err
+	}
+	if bytes.Equal(a[:an], b[:bn]) {
+		return 0, an, bn, nil
+	}
+	aKey, _, err := decodeViewKey(a[:an])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bKey, _, err := decodeViewKey(b[:bn])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if c = walrus.CollateJSON(aKey, bKey); c != 0 {
+		return c, 0, 0, nil
+	}
+	return 0, an, bn, nil
+}
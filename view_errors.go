@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// The number of recent errors that a view's error log keeps.
+const VIEW_ERROR_LOG_SIZE = 100
+
+// An error from a view's function on a doc, as kept in the view's
+// error log so that design doc authors can see why docs are missing
+// from the view.
+type ViewError struct {
+	DocId   string    `json:"id"`
+	VBucket uint16    `json:"vbucket"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+// Adds to the error log of a view (by view hash), dropping the
+// oldest errors beyond VIEW_ERROR_LOG_SIZE.
+func (b *livebucket) AddViewError(viewName string, e *ViewError) {
+	b.viewErrorsLock.Lock()
+	defer b.viewErrorsLock.Unlock()
+	if b.viewErrors == nil {
+		b.viewErrors = map[string][]*ViewError{}
+	}
+	errs := append(b.viewErrors[viewName], e)
+	if len(errs) > VIEW_ERROR_LOG_SIZE {
+		errs = append([]*ViewError(nil), errs[len(errs)-VIEW_ERROR_LOG_SIZE:]...)
+	}
+	b.viewErrors[viewName] = errs
+}
+
+// Returns the recent errors of a view (by view hash), oldest first.
+func (b *livebucket) GetViewErrors(viewName string) []*ViewError {
+	b.viewErrorsLock.Lock()
+	defer b.viewErrorsLock.Unlock()
+	return append([]*ViewError{}, b.viewErrors[viewName]...)
+}
+
+// Forgets the error logs of views that no design doc has anymore.
+func (b *livebucket) pruneViewErrors(prod, dev map[string]*indexedView) {
+	b.viewErrorsLock.Lock()
+	defer b.viewErrorsLock.Unlock()
+	for viewName := range b.viewErrors {
+		if prod[viewName] == nil && dev[viewName] == nil {
+			delete(b.viewErrors, viewName)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+)
+
+// The prepared functions of a view, pooled as each has its own otto
+// VM, which only one goroutine may use at a time, so that several
+// vbuckets can index a view at once.  A nil pool pools nothing.
+type viewFunctions struct {
+	m       sync.Mutex
+	maps    []*ViewMapFunction
+	reduces []*ViewReduceFunction
+}
+
+func (p *viewFunctions) getMap() (f *ViewMapFunction) {
+	if p == nil {
+		return nil
+	}
+	p.m.Lock()
+	if n := len(p.maps); n > 0 {
+		f, p.maps = p.maps[n-1], p.maps[:n-1]
+	}
+	p.m.Unlock()
+	return f
+}
+
+func (p *viewFunctions) putMap(f *ViewMapFunction) {
+	if p == nil || f == nil {
+		return
+	}
+	p.m.Lock()
+	p.maps = append(p.maps, f)
+	p.m.Unlock()
+}
+
+func (p *viewFunctions) getReduce() (f *ViewReduceFunction) {
+	if p == nil {
+		return nil
+	}
+	p.m.Lock()
+	if n := len(p.reduces); n > 0 {
+		f, p.reduces = p.reduces[n-1], p.reduces[:n-1]
+	}
+	p.m.Unlock()
+	return f
+}
+
+func (p *viewFunctions) putReduce(f *ViewReduceFunction) {
+	if p == nil || f == nil {
+		return
+	}
+	p.m.Lock()
+	p.reduces = append(p.reduces, f)
+	p.m.Unlock()
+}
+
+// Returns the pool of the prepared functions of a view (by view
+// hash), so the pool outlives reparses of the design docs as long as
+// the view doesn't change.
+func (b *livebucket) viewFunctions(viewName string) *viewFunctions {
+	b.viewFunctionsLock.Lock()
+	defer b.viewFunctionsLock.Unlock()
+	if b.viewFunctionPools == nil {
+		b.viewFunctionPools = map[string]*viewFunctions{}
+	}
+	p := b.viewFunctionPools[viewName]
+	if p == nil {
+		p = &viewFunctions{}
+		b.viewFunctionPools[viewName] = p
+	}
+	return p
+}
+
+// Drops the pools of views that no design doc has anymore.
+func (b *livebucket) pruneViewFunctions(prod, dev map[string]*indexedView) {
+	b.viewFunctionsLock.Lock()
+	defer b.viewFunctionsLock.Unlock()
+	for viewName := range b.viewFunctionPools {
+		if prod[viewName] == nil && dev[viewName] == nil {
+			delete(b.viewFunctionPools, viewName)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/steveyen/gkvlite"
+)
+
+// Forward view indexes map emitted view keys to doc ids and values.
+// There's one per view per vbucket, kept in the vbucket's views store
+// next to the back-index, which maps doc ids to the view keys each
+// doc emitted, so that stale forward index entries can be removed.
+
+const (
+	COLL_VIEWS_META     = "vim"
+	VIEWS_INDEX_VERSION = "5" // Bumped when the views file format changes.
+)
+
+// Views are named by their hash (see View.hash()), so that identical
+// views share an index.  Forward index collections are named
+// "<vbid>.v[<viewHash>]", and the reductions of a view (see
+// view_reduce.go) are kept in "<vbid>.r[<viewHash>]", so they never
+// end with the keys or changes suffixes.
+func viewIndexCollName(vbid uint16, viewName string) string {
+	return fmt.Sprintf("%d.v[%s]", vbid, viewName)
+}
+
+// The number of rows in each view's forward index of a vbucket, by
+// view hash, as the index has an item per doc per distinct key, which
+// may hold several rows.
+func viewRowCountsCollName(vbid uint16) string {
+	return fmt.Sprintf("%d.vn", vbid)
+}
+
+func isViewIndexCollName(collName string) bool {
+	return (strings.Contains(collName, ".v[") ||
+		strings.Contains(collName, ".r[")) && strings.HasSuffix(collName, "]")
+}
+
+// Returns the key ordering of a collection, where nil means the
+// default bytes.Compare.
+func collKeyCompare(collName string) gkvlite.KeyCompare {
+	if isViewReduceCollName(collName) {
+		return viewReduceKeyCompare
+	}
+	if isViewIndexCollName(collName) {
+		return viewIndexKeyCompare
+	}
+	return nil
+}
+
+// Only the items of collections are persisted, so key orderings need
+// to be reapplied to the collections of a just opened store.
+func setCollKeyCompares(store *gkvlite.Store) {
+	for _, collName := range store.GetCollectionNames() {
+		if compare := collKeyCompare(collName); compare != nil {
+			store.SetCollection(collName, compare)
+		}
+	}
+}
+
+// A forward index key is the encoded view key (see view_collate.go),
+// then the doc id.
+func viewIndexKey(viewKey []byte, docId []byte) []byte {
+	rv := make([]byte, 0, len(viewKey)+len(docId))
+	rv = append(rv, viewKey...)
+	return append(rv, docId...)
+}
+
+func splitViewIndexKey(k []byte) (key interface{}, docId []byte, err error) {
+	key, n, err := decodeViewKey(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, k[n:], nil
+}
+
+// Orders forward index keys by view key collation, then by doc id.
+func viewIndexKeyCompare(a, b []byte) int {
+	c, an, bn, err := collateViewKeys(a, b)
+	if err != nil {
+		return bytes.Compare(a, b)
+	}
+	if c != 0 {
+		return c
+	}
+	if c = bytes.Compare(a[an:], b[bn:]); c != 0 {
+		return c
+	}
+	return bytes.Compare(a[:an], b[:bn]) // Like -0 versus 0.
+}
+
+// Views files record the version of their format, so that files in
+// an older format are rebuilt rather than misread.
+func viewsIndexVersion(vs *bucketstore) string {
+	ver, err := vs.collMeta(COLL_VIEWS_META).Get([]byte("version"))
+	if err != nil {
+		return ""
+	}
+	return string(ver)
+}
+
+func setViewsIndexVersion(vs *bucketstore) error {
+	return vs.collMeta(COLL_VIEWS_META).Set([]byte("version"),
+		[]byte(VIEWS_INDEX_VERSION))
+}
+
+// The back-index entry of a doc, keyed by view hash, holding the JSON
+// encoded view keys the doc emitted.
+type backIndexEntry map[string][]string
+
+// Replaces a doc's entries in the forward indexes of a vbucket, given
+// its previous back-index entry and its new emits, which has an entry
+// (maybe empty) for every current view, and returns its new
+// back-index entry.  Then, for the views that have reducers, the
+// reductions around the entries that changed are recomputed.
+func updateViewIndexes(backIndexStore *partitionstore, docId []byte,
+	prev backIndexEntry, viewEmits map[string]ViewRows,
+	reducers map[string]*ViewReduceFunction) (backIndexEntry, error) {
+	next := backIndexEntry{}
+	nextVals := map[string]map[string][]interface{}{}
+	for viewName, emits := range viewEmits {
+		keys := []string{}
+		vals := map[string][]interface{}{}
+		for _, emit := range emits {
+			j, err := json.Marshal(emit.Key)
+			if err != nil {
+				return nil, err
+			}
+			k := string(j)
+			if _, exists := vals[k]; !exists {
+				keys = append(keys, k)
+			}
+			vals[k] = append(vals[k], emit.Value)
+		}
+		if len(keys) > 0 {
+			next[viewName] = keys
+		}
+		nextVals[viewName] = vals
+	}
+
+	s := backIndexStore.parent
+	vbid := backIndexStore.vbid
+	changed := map[string][][]byte{} // Forward index keys, by view.
+	var err error
+	backIndexStore.mutate(func(keys, changes *gkvlite.Collection) {
+		rows := map[string]int64{} // Change in row count, by view.
+		for viewName, prevKeys := range prev {
+			if _, current := viewEmits[viewName]; !current {
+				continue // The view's index was dropped.
+			}
+			coll := s.coll(viewIndexCollName(vbid, viewName))
+			for _, k := range prevKeys {
+				if _, exists := nextVals[viewName][k]; exists {
+					continue // It'll be overwritten.
+				}
+				var viewKey []byte
+				if viewKey, err = encodeViewKeyJson([]byte(k)); err != nil {
+					return
+				}
+				indexKey := viewIndexKey(viewKey, docId)
+				var n int64
+				if n, err = viewIndexItemRows(coll, indexKey); err != nil {
+					return
+				}
+				rows[viewName] -= n
+				if _, err = coll.Delete(indexKey); err != nil {
+					return
+				}
+				changed[viewName] = append(changed[viewName], indexKey)
+			}
+		}
+		for viewName, vals := range nextVals {
+			coll := s.coll(viewIndexCollName(vbid, viewName))
+			for k, v := range vals {
+				var j, viewKey []byte
+				if j, err = json.Marshal(v); err != nil {
+					return
+				}
+				if viewKey, err = encodeViewKeyJson([]byte(k)); err != nil {
+					return
+				}
+				indexKey := viewIndexKey(viewKey, docId)
+				var n int64
+				if n, err = viewIndexItemRows(coll, indexKey); err != nil {
+					return
+				}
+				rows[viewName] += int64(len(v)) - n
+				if err = coll.Set(indexKey, j); err != nil {
+					return
+				}
+				changed[viewName] = append(changed[viewName], indexKey)
+			}
+		}
+		for viewName, delta := range rows {
+			if err = addViewRowCount(s, vbid, viewName, delta); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for viewName, r := range reducers {
+		err = updateViewReductions(backIndexStore, viewName, r, changed[viewName])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// A range of view keys in visiting order, so start is the greatest
+// key when descending.  When not "", the doc ids bound the rows of
+// the start and end keys, as with startkey_docid and endkey_docid.
+type viewKeyRange struct {
+	start, end           interface{} // Nil when unbounded.
+	startDocId, endDocId string
+	inclusiveEnd         bool
+	descending           bool
+}
+
+func viewQueryKeyRange(p *ViewParams) *viewKeyRange {
+	r := &viewKeyRange{
+		start:        p.StartKey,
+		end:          p.EndKey,
+		startDocId:   p.StartKeyDocId,
+		endDocId:     p.EndKeyDocId,
+		inclusiveEnd: p.InclusiveEnd,
+		descending:   p.Descending,
+	}
+	if p.Key != nil {
+		r.start, r.end, r.inclusiveEnd = p.Key, p.Key, true
+	}
+	return r
+}
+
+// Compares a row with a bound of the range, in visiting order.
+func (r *viewKeyRange) compare(key interface{}, docId []byte,
+	bound interface{}, boundDocId string) int {
+	c := walrus.CollateJSON(key, bound)
+	if c == 0 && boundDocId != "" {
+		c = bytes.Compare(docId, []byte(boundDocId))
+	}
+	if r.descending {
+		return -c
+	}
+	return c
+}
+
+func (r *viewKeyRange) before(key interface{}, docId []byte) bool {
+	return r.start != nil && r.compare(key, docId, r.start, r.startDocId) < 0
+}
+
+func (r *viewKeyRange) past(key interface{}, docId []byte) bool {
+	if r.end == nil {
+		return false
+	}
+	c := r.compare(key, docId, r.end, r.endDocId)
+	return c > 0 || (c == 0 && !r.inclusiveEnd)
+}
+
+// Visits the items of one of a vbucket's view index collections
+// within a range, in view collation order (or in reverse).
+func (v *VBucket) visitViewColl(collName string, r *viewKeyRange,
+	visitor func(key interface{}, docId []byte, val []byte) (bool, error)) error {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return nil // Not indexed yet.
+	}
+	ps := vs.getPartitionStore(v.vbid)
+	coll, release, err := ps.collRef(collName)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if coll == nil {
+		return nil
+	}
+	var start []byte
+	if r.start != nil {
+		viewKey, err := encodeViewKey(r.start)
+		if err != nil {
+			return err
+		}
+		start = viewIndexKey(viewKey, []byte(r.startDocId))
+	}
+	var vErr error
+	visit := func(i *gkvlite.Item) bool {
+		var key interface{}
+		var docId []byte
+		if key, docId, vErr = splitViewIndexKey(i.Key); vErr != nil {
+			return false
+		}
+		if r.past(key, docId) {
+			return false
+		}
+		if r.before(key, docId) {
+			return true
+		}
+		var ok bool
+		ok, vErr = visitor(key, docId, i.Val)
+		return ok && vErr == nil
+	}
+	switch {
+	case !r.descending:
+		err = ps.visit(coll, start, true, visit)
+	case r.start == nil || r.startDocId != "":
+		err = ps.visitDescend(coll, start, true, visit)
+	default:
+		// The rows of the start key sort after start, by their doc
+		// ids, so the descent begins below the next greater view key.
+		var next []byte
+		err = coll.VisitItemsAscend(start, false, func(i *gkvlite.Item) bool {
+			if c, _, _, _ := collateViewKeys(i.Key, start); c > 0 {
+				next = i.Key
+				return false
+			}
+			return true
+		})
+		if err == nil && next == nil {
+			err = ps.visitDescend(coll, nil, true, visit)
+		} else if err == nil {
+			err = coll.VisitItemsDescend(next, true, visit)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return vErr
+}
+
+// Visits the rows of a vbucket's forward index of a view.
+func (v *VBucket) visitViewIndex(viewName string, r *viewKeyRange,
+	visitor func(*ViewRow) bool) error {
+	return v.visitViewColl(viewIndexCollName(v.vbid, viewName), r,
+		func(key interface{}, docId []byte, val []byte) (bool, error) {
+			var vals []interface{}
+			if err := json.Unmarshal(val, &vals); err != nil {
+				return false, err
+			}
+			for _, val := range vals {
+				if !visitor(&ViewRow{Id: string(docId), Key: key, Value: val}) {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+}
+
+// Streams the rows of a view query from the forward indexes of
+// vbuckets, merged into the query's order, until the visitor returns
+// false.
+func streamViewIndexes(vbs []*VBucket, viewName string, p *ViewParams,
+	visitor func(*ViewRow) bool) error {
+	r := viewQueryKeyRange(p)
+	return visitMergedViewRows(vbs, r.descending,
+		func(vb *VBucket, visitor func(*ViewRow) bool) error {
+			return vb.visitViewIndex(viewName, r, visitor)
+		}, visitor)
+}
+
+// Answers a view query with range scans over the forward indexes of
+// vbuckets, merged into the query's order.
+func queryViewIndexes(vbs []*VBucket, viewName string,
+	p *ViewParams) (*ViewResult, error) {
+	rows := ViewRows{}
+	err := streamViewIndexes(vbs, viewName, p, func(row *ViewRow) bool {
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ViewResult{Rows: rows}, nil
+}
+
+// Returns the number of rows that a forward index item holds.
+func viewIndexItemRows(coll *gkvlite.Collection, indexKey []byte) (int64, error) {
+	j, err := coll.Get(indexKey)
+	if err != nil || j == nil {
+		return 0, err
+	}
+	var vals []json.RawMessage
+	if err = json.Unmarshal(j, &vals); err != nil {
+		return 0, err
+	}
+	return int64(len(vals)), nil
+}
+
+// Adds to the row count of a vbucket's view.  Must be invoked while
+// mutating the vbucket's back-index partition.
+func addViewRowCount(s *bucketstore, vbid uint16, viewName string,
+	delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	coll := s.coll(viewRowCountsCollName(vbid))
+	var n int64
+	j, err := coll.Get([]byte(viewName))
+	if err != nil {
+		return err
+	}
+	if j != nil {
+		if n, err = strconv.ParseInt(string(j), 10, 64); err != nil {
+			return err
+		}
+	}
+	if n += delta; n <= 0 {
+		_, err = coll.Delete([]byte(viewName))
+		return err
+	}
+	return coll.Set([]byte(viewName), []byte(strconv.FormatInt(n, 10)))
+}
+
+// Returns the number of rows in a vbucket's forward index of a view.
+func (v *VBucket) viewRowCount(viewName string) (int64, error) {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return 0, nil // Not indexed yet.
+	}
+	coll, release, err := vs.getPartitionStore(v.vbid).collRef(
+		viewRowCountsCollName(v.vbid))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if coll == nil {
+		return 0, nil
+	}
+	j, err := coll.Get([]byte(viewName))
+	if err != nil || j == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(j), 10, 64)
+}
+
+// Returns the number of rows in the forward indexes of a view.
+func viewIndexTotalRows(vbs []*VBucket, viewName string) (int, error) {
+	total := 0
+	for _, vb := range vbs {
+		n, err := vb.viewRowCount(viewName)
+		if err != nil {
+			return 0, err
+		}
+		total += int(n)
+	}
+	return total, nil
+}
+
+// Returns the number of items and their bytes in one of a vbucket's
+// view index collections.
+func (v *VBucket) viewCollTotals(collName string) (uint64, uint64, error) {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return 0, 0, nil
+	}
+	coll, release, err := vs.getPartitionStore(v.vbid).collRef(collName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	if coll == nil {
+		return 0, 0, nil
+	}
+	return coll.GetTotals()
+}
+
+// Returns the sequence (CAS) of the last change that a vbucket's
+// views index caught up with.
+func (v *VBucket) viewsIndexedSeq() (uint64, error) {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return 0, nil
+	}
+	_, changes, release, err := vs.getPartitionStore(v.vbid).collsRef()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	i, err := changes.MaxItem(false)
+	if err != nil || i == nil {
+		return 0, err
+	}
+	return casBytesParse(i.Key)
+}
+
+// The update_seq of a view query, which is the sum of the indexed
+// sequences of the vbuckets, so it grows whenever any of them
+// catches up.
+func viewsUpdateSeq(vbs []*VBucket) (uint64, error) {
+	var rv uint64
+	for _, vb := range vbs {
+		seq, err := vb.viewsIndexedSeq()
+		if err != nil {
+			return 0, err
+		}
+		rv += seq
+	}
+	return rv, nil
+}
+
+// Returns the vbuckets that a view query covers.  Depending on the
+// stale param, their indexes are first caught up (stale=false, the
+// default), used as is (stale=ok), or caught up after the query
+// (stale=update_after, see viewQueryDone()).
+func viewQueryVBuckets(bucket Bucket, devSubset bool,
+	p *ViewParams) ([]*VBucket, error) {
+	switch p.Stale {
+	case "", "false", "ok", "update_after":
+	default:
+		return nil, fmt.Errorf("unknown stale param: %v", p.Stale)
+	}
+
+	vbs := []*VBucket{}
+	settings := bucket.GetBucketSettings()
+	np := settings.NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		if devSubset &&
+			!inDevSubset(uint16(vbid), np, settings.devSubsetPartitions()) {
+			continue
+		}
+		if vb, _ := bucket.GetVBucket(uint16(vbid)); vb != nil {
+			vbs = append(vbs, vb)
+		}
+	}
+
+	if p.Stale == "" || p.Stale == "false" {
+		if err := viewsRefreshVBuckets(vbs); err != nil {
+			return nil, err
+		}
+	}
+	return vbs, nil
+}
+
+func viewQueryDone(vbs []*VBucket, p *ViewParams) {
+	if p.Stale == "update_after" {
+		go viewsRefreshVBuckets(vbs)
+	}
+}
+
+// Returns the ascending range of view keys that a query covers.
+func viewQueryRange(p *ViewParams) (low, high interface{}) {
+	low, high = p.StartKey, p.EndKey
+	if p.Key != nil {
+		low, high = p.Key, p.Key
+	}
+	if p.Descending {
+		low, high = high, low
+	}
+	return low, high
+}
+
+// Visits every vbucket concurrently, merging their rows, which are
+// sorted in ascending or descending order, until the visitor returns
+// false.
+func visitMergedViewRows(vbs []*VBucket, descending bool,
+	visit func(*VBucket, func(*ViewRow) bool) error,
+	visitor func(*ViewRow) bool) error {
+	ins := make([]chan *ViewRow, len(vbs))
+	errs := make(chan error, len(vbs))
+	done := make(chan bool)
+	for i, vb := range vbs {
+		ins[i] = make(chan *ViewRow, 100)
+		go func(vb *VBucket, in chan *ViewRow) {
+			defer close(in)
+			errs <- visit(vb, func(row *ViewRow) bool {
+				select {
+				case in <- row:
+					return true
+				case <-done:
+					return false
+				}
+			})
+		}(vb, ins[i])
+	}
+	out := make(chan *ViewRow, 100)
+	if descending {
+		go MergeViewRowsDescending(ins, out)
+	} else {
+		go MergeViewRows(ins, out)
+	}
+
+	for row := range out {
+		if !visitor(row) {
+			close(done) // Stops the vbucket visits.
+			for range out {
+			}
+			break
+		}
+	}
+	for range vbs {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Catches up the views indexes of vbuckets, up to viewsRefreshWorkers
+// of them at once, each with its own pooled view functions.
+func viewsRefreshVBuckets(vbs []*VBucket) error {
+	workers := viewsRefreshWorkers
+	if workers > len(vbs) {
+		workers = len(vbs)
+	}
+	ch := make(chan *VBucket)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			var rv error
+			for vb := range ch {
+				if _, err := vb.viewsRefresh(); err != nil && rv == nil {
+					rv = err
+				}
+			}
+			errs <- rv
+		}()
+	}
+	for _, vb := range vbs {
+		ch <- vb
+	}
+	close(ch)
+	var rv error
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
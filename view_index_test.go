@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testViewIndexKey(t *testing.T, keyJson string, docId string) []byte {
+	viewKey, err := encodeViewKeyJson([]byte(keyJson))
+	if err != nil {
+		t.Fatalf("expected encodeViewKeyJson of %v to work, got: %v", keyJson, err)
+	}
+	return viewIndexKey(viewKey, []byte(docId))
+}
+
+func TestViewIndexKeyCompare(t *testing.T) {
+	keys := []string{`null`, `false`, `true`, `-10`, `-0.5`, `1`, `2.5`, `10`,
+		`"a"`, `"b"`, `[]`, `[1]`, `[1,"a"]`, `[1,["a"]]`, `[2]`, `{"a":1}`}
+	for i := range keys {
+		for j := range keys {
+			c := viewIndexKeyCompare(testViewIndexKey(t, keys[i], "x"),
+				testViewIndexKey(t, keys[j], "x"))
+			if (i < j && c >= 0) || (i == j && c != 0) || (i > j && c <= 0) {
+				t.Errorf("expected %v vs %v to collate like %v vs %v, got: %v",
+					keys[i], keys[j], i, j, c)
+			}
+		}
+	}
+	if viewIndexKeyCompare(testViewIndexKey(t, `1`, "a"),
+		testViewIndexKey(t, `1`, "b")) >= 0 {
+		t.Errorf("expected equal view keys to be ordered by doc id")
+	}
+	if viewIndexKeyCompare(testViewIndexKey(t, `"a"`, "b"),
+		testViewIndexKey(t, `"ab"`, "a")) >= 0 {
+		t.Errorf("expected the doc id to not be mistaken for part of a key")
+	}
+}
+
+func TestViewKeyEncoding(t *testing.T) {
+	keys := []string{`null`, `false`, `true`, `0`, `-1.5`, `1e300`, `""`,
+		`"a\u0000b\u0000"`, `"\u00e9"`, `[]`, `[null,[true,"x"],{}]`,
+		`{"b":[1,2],"a":{"c":"d"}}`}
+	for _, keyJson := range keys {
+		var key interface{}
+		json.Unmarshal([]byte(keyJson), &key)
+		k := testViewIndexKey(t, keyJson, "doc")
+		n, err := viewKeyLen(k)
+		if err != nil || string(k[n:]) != "doc" {
+			t.Errorf("expected viewKeyLen of %v to work, got: %v, %v", keyJson, n, err)
+		}
+		decoded, docId, err := splitViewIndexKey(k)
+		if err != nil || string(docId) != "doc" {
+			t.Errorf("expected splitViewIndexKey of %v to work, got: %q, %v",
+				keyJson, docId, err)
+		}
+		j, _ := json.Marshal(decoded)
+		jExp, _ := json.Marshal(key)
+		if !bytes.Equal(j, jExp) {
+			t.Errorf("expected %v to round trip, got: %s", keyJson, j)
+		}
+	}
+	if _, _, err := splitViewIndexKey([]byte{viewKeyArray, viewKeyNull}); err == nil {
+		t.Errorf("expected a truncated view key to fail decoding")
+	}
+}
+
+func testViewHash(t *testing.T, bucket Bucket, ddocId, viewId string) string {
+	ddocs := bucket.GetDDocs()
+	if ddocs == nil || (*ddocs)[ddocId] == nil ||
+		(*ddocs)[ddocId].Views[viewId] == nil {
+		t.Fatalf("expected view: %v/%v", ddocId, viewId)
+	}
+	return (*ddocs)[ddocId].Views[viewId].hash()
+}
+
+func testViewIndexRows(t *testing.T, vb *VBucket, viewName string,
+	low, high interface{}) []*ViewRow {
+	rows := []*ViewRow{}
+	r := &viewKeyRange{start: low, end: high, inclusiveEnd: true}
+	err := vb.visitViewIndex(viewName, r, func(row *ViewRow) bool {
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		t.Errorf("expected visitViewIndex to work, got: %v", err)
+	}
+	return rows
+}
+
+func testExpectViewRows(t *testing.T, rows []*ViewRow, ids []string,
+	keys []int, desc string) {
+	if len(rows) != len(ids) {
+		t.Errorf("%v: expected %v rows, got: %#v", desc, len(ids), rows)
+		return
+	}
+	for i, row := range rows {
+		if row.Id != ids[i] || int(row.Key.(float64)) != keys[i] {
+			t.Errorf("%v: expected row %v to be %v/%v, got: %#v",
+				desc, i, ids[i], keys[i], row)
+		}
+	}
+}
+
+func TestViewIndexMaintenance(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{"map":"function(doc) { emit(doc.amount, null); }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"amount":3}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"amount":1}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"amount":2}`), VBActive)
+
+	viewName := testViewHash(t, bucket, "_design/d0", "v0")
+	vb, _ := bucket.GetVBucket(0)
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	rows := testViewIndexRows(t, vb, viewName, nil, nil)
+	testExpectViewRows(t, rows, []string{"b", "c", "a"}, []int{1, 2, 3},
+		"after refresh")
+	rows = testViewIndexRows(t, vb, viewName, 2.0, 3.0)
+	testExpectViewRows(t, rows, []string{"c", "a"}, []int{2, 3}, "range")
+
+	SetItem(bucket, []byte("a"), []byte(`{"amount":0}`), VBActive)
+	res := vbMutate(vb, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: 0,
+		Key:     []byte("b"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected delete to work, got: %v", res)
+	}
+	rows = testViewIndexRows(t, vb, viewName, nil, nil)
+	testExpectViewRows(t, rows, []string{"b", "c", "a"}, []int{1, 2, 3},
+		"before catching up")
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	rows = testViewIndexRows(t, vb, viewName, nil, nil)
+	testExpectViewRows(t, rows, []string{"a", "c"}, []int{0, 2},
+		"after update and delete")
+}
+
+func TestViewIndexTotalRows(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{"map":`+
+			`"function(doc) { for (var i = 0; i < doc.n; i++) emit(doc.k, i); }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	viewName := testViewHash(t, bucket, "_design/d0", "v0")
+	vb, _ := bucket.GetVBucket(0)
+	vbs := []*VBucket{vb}
+
+	tests := []struct {
+		doc string
+		exp int
+	}{
+		{`{"k":1,"n":2}`, 3}, // Doc "b" has one row, too.
+		{`{"k":1,"n":3}`, 4},
+		{`{"k":2,"n":1}`, 2},
+		{"", 1},
+	}
+	SetItem(bucket, []byte("b"), []byte(`{"k":1,"n":1}`), VBActive)
+	for i, test := range tests {
+		if test.doc == "" {
+			vbMutate(vb, nil, &gomemcached.MCRequest{
+				Opcode:  gomemcached.DELETE,
+				VBucket: 0,
+				Key:     []byte("a"),
+			})
+		} else {
+			SetItem(bucket, []byte("a"), []byte(test.doc), VBActive)
+		}
+		if _, err = vb.viewsRefresh(); err != nil {
+			t.Errorf("test %v: expected viewsRefresh to work, got: %v", i, err)
+		}
+		n, err := viewIndexTotalRows(vbs, viewName)
+		rows := testViewIndexRows(t, vb, viewName, nil, nil)
+		if err != nil || n != test.exp || len(rows) != test.exp {
+			t.Errorf("test %v: expected %v total rows, got: %v, rows: %v, err: %v",
+				i, test.exp, n, len(rows), err)
+		}
+	}
+}
+
+func testGetViewRows(t *testing.T, mr http.Handler, url string) *ViewResult {
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", url, nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected req to 200, got: %#v, %v", rr, rr.Body.String())
+		return &ViewResult{}
+	}
+	vr := &ViewResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), vr); err != nil {
+		t.Errorf("expected good view result, got: %v", err)
+	}
+	return vr
+}
+
+func TestCouchViewStale(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	testSetupDDoc(t, bucket, `{
+		"_id":"_design/d0",
+		"language": "javascript",
+		"views": {
+			"v0": {
+				"map": "function(doc) { emit(doc.amount, null) }"
+			}
+		}
+    }`, nil)
+
+	url := "http://127.0.0.1/default/_design/d0/_view/v0"
+	if vr := testGetViewRows(t, mr, url+"?stale=ok"); len(vr.Rows) != 0 {
+		t.Errorf("expected no rows before indexing, got: %#v", vr)
+	}
+	if vr := testGetViewRows(t, mr, url+"?stale=false"); len(vr.Rows) != 4 {
+		t.Errorf("expected indexed rows, got: %#v", vr)
+	}
+
+	SetItem(bucket, []byte("e"), []byte(`{"amount":5}`), VBActive)
+	if vr := testGetViewRows(t, mr, url+"?stale=ok"); len(vr.Rows) != 4 {
+		t.Errorf("expected stale rows, got: %#v", vr)
+	}
+	if vr := testGetViewRows(t, mr, url+"?stale=update_after"); len(vr.Rows) != 4 {
+		t.Errorf("expected stale rows before the update, got: %#v", vr)
+	}
+	n := 0
+	for i := 0; i < 100 && n != 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = len(testGetViewRows(t, mr, url+"?stale=ok").Rows)
+	}
+	if n != 5 {
+		t.Errorf("expected update_after to catch up the index, got: %v", n)
+	}
+	if vr := testGetViewRows(t, mr, url); len(vr.Rows) != 5 {
+		t.Errorf("expected fresh rows by default, got: %#v", vr)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", url+"?stale=whenever", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected bad stale param to 400, got: %#v", rr)
+	}
+}
+
+func TestCouchViewKeys(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{`+
+			`"map":"function(doc) { emit(doc.c, doc.n); }",`+
+			`"reduce":"_sum"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"c":"x","n":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"c":"y","n":2}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"c":"z","n":4}`), VBActive)
+	SetItem(bucket, []byte("d"), []byte(`{"c":"x","n":8}`), VBActive)
+
+	post := func(url, body string) *ViewResult {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		mr.ServeHTTP(rr, r)
+		if rr.Code != 200 {
+			t.Errorf("expected POST to 200, got: %#v, %v", rr, rr.Body.String())
+		}
+		vr := &ViewResult{}
+		if err := json.Unmarshal(rr.Body.Bytes(), vr); err != nil {
+			t.Errorf("expected good view result, got: %v", err)
+		}
+		return vr
+	}
+	ids := func(vr *ViewResult) string {
+		s := ""
+		for _, row := range vr.Rows {
+			s += row.Id
+		}
+		return s
+	}
+
+	url := "http://127.0.0.1/default/_design/d0/_view/v0"
+	vr := testGetViewRows(t, mr, url+`?reduce=false&keys=["z","x","none"]`)
+	if got := ids(vr); got != "cad" {
+		t.Errorf("expected rows in the requested key order, got: %v", got)
+	}
+	vr = post(url+"?reduce=false&include_docs=true", `{"keys":["y","z"]}`)
+	if got := ids(vr); got != "bc" || vr.Rows[0].Doc == nil {
+		t.Errorf("expected POSTed keys with docs, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+`?group=true&keys=["x","z"]`)
+	if len(vr.Rows) != 2 || vr.Rows[0].Key != "x" ||
+		vr.Rows[0].Value.(float64) != 9 || vr.Rows[1].Value.(float64) != 4 {
+		t.Errorf("expected a reduction per key, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+`?keys=["x","z"]`)
+	if len(vr.Rows) != 1 || vr.Rows[0].Value.(float64) != 13 {
+		t.Errorf("expected one reduction of the keys, got: %#v", vr.Rows)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", url+"?keys=x", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected keys that aren't a JSON array to 400, got: %#v", rr)
+	}
+
+	allDocs := "http://127.0.0.1/default/_all_docs"
+	vr = testGetViewRows(t, mr, allDocs+`?include_docs=true&keys=["d","none","a"]`)
+	if got := ids(vr); got != "da" || len(vr.Rows) != 3 ||
+		vr.Rows[1].Error != "not_found" || vr.Rows[0].Doc == nil {
+		t.Errorf("expected _all_docs rows of the keys, got: %#v", vr.Rows)
+	}
+	vr = post(allDocs, `{"keys":["b"]}`)
+	if got := ids(vr); got != "b" {
+		t.Errorf("expected _all_docs rows of POSTed keys, got: %#v", vr.Rows)
+	}
+}
+
+func TestCouchViewPaging(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{"map":"function(doc) { emit(doc.c, null); }"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	for _, docId := range []string{"a", "b", "c", "d", "e"} {
+		c := "x"
+		if docId > "c" {
+			c = "y"
+		}
+		SetItem(bucket, []byte(docId), []byte(`{"c":"`+c+`"}`), VBActive)
+	}
+	ids := func(vr *ViewResult) string {
+		s := ""
+		for _, row := range vr.Rows {
+			s += row.Id
+		}
+		return s
+	}
+
+	url := "http://127.0.0.1/default/_design/d0/_view/v0"
+	tests := []struct {
+		params string
+		exp    string
+	}{
+		{"", "abcde"},
+		{"?limit=2", "ab"},
+		{"?limit=2&skip=1", "bc"},
+		{`?startkey="x"&startkey_docid=b&limit=2`, "bc"},
+		{`?startkey="x"&startkey_docid=c&limit=2`, "cd"},
+		{`?startkey="x"&startkey_docid=bb`, "cde"},
+		{`?endkey="y"&endkey_docid=d`, "abcd"},
+		{`?endkey="y"&endkey_docid=d&inclusive_end=false`, "abc"},
+		{`?key="x"`, "abc"},
+		{"?descending=true", "edcba"},
+		{`?descending=true&startkey="x"`, "cba"},
+		{`?descending=true&startkey="y"&startkey_docid=d`, "dcba"},
+		{`?descending=true&endkey="x"&endkey_docid=b`, "edcb"},
+		{`?descending=true&startkey="x"&endkey="x"&endkey_docid=b`, "cb"},
+	}
+	for _, test := range tests {
+		vr := testGetViewRows(t, mr, url+test.params)
+		if got := ids(vr); got != test.exp {
+			t.Errorf("expected %v to be %v, got: %v", test.params, test.exp, got)
+		}
+		if vr.TotalRows != 5 {
+			t.Errorf("expected %v total_rows of the whole view, got: %v",
+				test.params, vr.TotalRows)
+		}
+	}
+
+	vr := testGetViewRows(t, mr, url+"?update_seq=true")
+	if vr.UpdateSeq == 0 {
+		t.Errorf("expected an update_seq, got: %#v", vr)
+	}
+	SetItem(bucket, []byte("f"), []byte(`{"c":"z"}`), VBActive)
+	vr2 := testGetViewRows(t, mr, url+"?update_seq=true")
+	if vr2.UpdateSeq <= vr.UpdateSeq || vr2.TotalRows != 6 {
+		t.Errorf("expected update_seq to grow, got: %v then %v",
+			vr.UpdateSeq, vr2.UpdateSeq)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-jsonpointer"
+)
+
+// Declarative views emit the values at JSON pointers (RFC 6901) into
+// docs, instead of running a javascript map function, so they're
+// evaluated natively without otto.  For example, in a design doc...
+//
+//	"by_type": {"pointers": {"key": "/type"}},
+//	"by_day":  {"pointers": {"key": ["/type", "/date"], "value": "/amount"},
+//	            "reduce": "_sum"}
+//
+// A doc that's not JSON or that's missing any of the key pointers
+// emits nothing, and a missing value pointer emits a null value.
+type ViewPointers struct {
+	// A JSON pointer, or an array of them for a composite array key.
+	Key interface{} `json:"key"`
+
+	// An optional JSON pointer to the emitted value.
+	Value string `json:"value,omitempty"`
+}
+
+// Returns the key pointers, and whether they make a composite key.
+func (p *ViewPointers) keyPointers() (ptrs []string, composite bool, err error) {
+	switch k := p.Key.(type) {
+	case string:
+		ptrs = []string{k}
+	case []interface{}:
+		for _, x := range k {
+			ptr, ok := x.(string)
+			if !ok {
+				return nil, false, fmt.Errorf("view key pointer not a string: %v", x)
+			}
+			ptrs = append(ptrs, ptr)
+		}
+		composite = true
+	}
+	if len(ptrs) == 0 {
+		return nil, false, fmt.Errorf("view key pointers missing")
+	}
+	for _, ptr := range append(ptrs, p.Value) {
+		if ptr != "" && !strings.HasPrefix(ptr, "/") {
+			return nil, false, fmt.Errorf("bad view pointer: %q", ptr)
+		}
+	}
+	return ptrs, composite, nil
+}
+
+func (p *ViewPointers) emits(docId string, data []byte) (ViewRows, error) {
+	ptrs, composite, err := p.keyPointers()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, len(ptrs))
+	for i, ptr := range ptrs {
+		v, found := findJSONPointer(data, ptr)
+		if !found {
+			return nil, nil
+		}
+		keys[i] = v
+	}
+	var key interface{} = keys
+	if !composite {
+		key = keys[0]
+	}
+	var value interface{}
+	if p.Value != "" {
+		value, _ = findJSONPointer(data, p.Value)
+	}
+	return ViewRows{&ViewRow{Id: docId, Key: key, Value: value}}, nil
+}
+
+// Returns the value at a JSON pointer into a JSON doc, without
+// parsing the rest of the doc.
+func findJSONPointer(data []byte, ptr string) (interface{}, bool) {
+	raw, err := jsonpointer.Find(data, ptr)
+	if err != nil || raw == nil {
+		return nil, false
+	}
+	var v interface{}
+	if err = json.Unmarshal(raw, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestViewPointersEmits(t *testing.T) {
+	doc := []byte(`{"type":"order","date":"2013-03-01",` +
+		`"amount":3,"address":{"city":"sf"}}`)
+	tests := []struct {
+		pointers *ViewPointers
+		expected string // Of the emitted key and value, or "" for none.
+	}{
+		{&ViewPointers{Key: "/type"}, "order <nil>"},
+		{&ViewPointers{Key: "/address/city", Value: "/amount"}, "sf 3"},
+		{&ViewPointers{Key: []interface{}{"/type", "/date"}, Value: "/amount"},
+			"[order 2013-03-01] 3"},
+		{&ViewPointers{Key: "/missing"}, ""},
+		{&ViewPointers{Key: []interface{}{"/type", "/missing"}}, ""},
+		{&ViewPointers{Key: "/type", Value: "/missing"}, "order <nil>"},
+	}
+	for _, test := range tests {
+		rows, err := test.pointers.emits("doc", doc)
+		if err != nil {
+			t.Errorf("expected emits to work for %#v, got: %v", test.pointers, err)
+			continue
+		}
+		got := ""
+		if len(rows) > 0 {
+			got = fmt.Sprintf("%v %v", rows[0].Key, rows[0].Value)
+			if len(rows) != 1 || rows[0].Id != "doc" {
+				t.Errorf("expected one row of the doc, got: %#v", rows)
+			}
+		}
+		if got != test.expected {
+			t.Errorf("expected %q for %#v, got: %q", test.expected, test.pointers, got)
+		}
+	}
+
+	if rows, err := (&ViewPointers{Key: "/type"}).emits("doc",
+		[]byte("not json")); err != nil || len(rows) != 0 {
+		t.Errorf("expected no emits for a non-JSON doc, got: %#v, %v", rows, err)
+	}
+	for _, bad := range []*ViewPointers{
+		{},
+		{Key: "type"},
+		{Key: []interface{}{"/type", 1}},
+		{Key: "/type", Value: "amount"},
+	} {
+		if _, err := bad.emits("doc", doc); err == nil {
+			t.Errorf("expected an error for bad pointers: %#v", bad)
+		}
+	}
+}
+
+func TestCouchViewPointers(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{`+
+			`"by_type":{"pointers":{"key":"/type"}},`+
+			`"by_day":{"pointers":{"key":["/type","/day"],"value":"/amount"},`+
+			`"reduce":"_sum"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"type":"x","day":1,"amount":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"type":"y","day":1,"amount":2}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"type":"x","day":2,"amount":4}`), VBActive)
+	SetItem(bucket, []byte("d"), []byte(`{"day":2,"amount":8}`), VBActive)
+
+	url := "http://127.0.0.1/default/_design/d0/_view/"
+	vr := testGetViewRows(t, mr, url+"by_type?key=%22x%22")
+	if len(vr.Rows) != 2 || vr.Rows[0].Id != "a" || vr.Rows[1].Id != "c" {
+		t.Errorf("expected the x docs, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"by_type")
+	if len(vr.Rows) != 3 {
+		t.Errorf("expected docs without a type to be left out, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"by_day?group_level=1")
+	if len(vr.Rows) != 2 ||
+		vr.Rows[0].Value.(float64) != 5 || vr.Rows[1].Value.(float64) != 2 {
+		t.Errorf("expected sums by type, got: %#v", vr.Rows)
+	}
+
+	if testViewHash(t, bucket, "_design/d0", "by_type") ==
+		testViewHash(t, bucket, "_design/d0", "by_day") {
+		t.Errorf("expected views with different pointers to differ")
+	}
+}
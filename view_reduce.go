@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/steveyen/gkvlite"
+)
+
+// Partial reductions of views that have reduce functions.  Per view,
+// each vbucket keeps a tree of partial reductions over its forward
+// index, where a node reduces the rows of a run of forward index
+// items, and a node of a higher level rereduces a run of nodes of the
+// level below.  The runs are cut at items whose hashed index key has
+// enough trailing zero bits for the level, so a node has about
+// 1<<viewReduceFanoutBits children, and a node's bounds don't depend
+// on the order that docs came in.
+//
+// A doc change then only recomputes the few nodes around the index
+// items it changed, one level at a time, outside of the back-index
+// mutation, so a reduce function doesn't run while the views store is
+// locked.  Reduce queries rereduce the nodes that lie within their key
+// range and a group, and reduce the rows only at the edges.
+
+const (
+	viewReduceFanoutBits = 4
+	viewReduceLevels     = 4
+)
+
+// The nodes of a vbucket's tree are kept in "<vbid>.r[<viewHash>]",
+// keyed by their level, then by the forward index key of their first
+// item, which is empty for the first node of a level.
+func viewReduceCollName(vbid uint16, viewName string) string {
+	return fmt.Sprintf("%d.r[%s]", vbid, viewName)
+}
+
+func isViewReduceCollName(collName string) bool {
+	return strings.Contains(collName, ".r[") && strings.HasSuffix(collName, "]")
+}
+
+func viewReduceNodeKey(level int, start []byte) []byte {
+	rv := make([]byte, 0, 1+len(start))
+	rv = append(rv, byte(level))
+	return append(rv, start...)
+}
+
+// Orders the nodes by level, then like their first items.
+func viewReduceKeyCompare(a, b []byte) int {
+	if len(a) == 0 || len(b) == 0 || a[0] != b[0] {
+		return bytes.Compare(a, b)
+	}
+	if len(a) == 1 || len(b) == 1 { // The first node of the level.
+		return bytes.Compare(a, b)
+	}
+	return viewIndexKeyCompare(a[1:], b[1:])
+}
+
+// Returns the highest level of the nodes that a forward index item
+// starts.
+func viewReduceItemLevel(indexKey []byte) int {
+	h := fnv.New64a()
+	h.Write(indexKey)
+	x := h.Sum64()
+	level := 0
+	for level < viewReduceLevels && x&(1<<viewReduceFanoutBits-1) == 0 {
+		x >>= viewReduceFanoutBits
+		level++
+	}
+	return level
+}
+
+// Recomputes the nodes of a vbucket's reduction tree of a view around
+// the given forward index keys, which a doc change just set or
+// deleted, from the lowest level up.  Each level's nodes are reduced
+// without holding the back-index partition's lock, which is only
+// taken to store them, as the views refresh is the only writer.
+func updateViewReductions(backIndexStore *partitionstore, viewName string,
+	r *ViewReduceFunction, changed [][]byte) error {
+	if len(changed) == 0 {
+		return nil
+	}
+	s := backIndexStore.parent
+	vbid := backIndexStore.vbid
+	for level := 1; level <= viewReduceLevels; level++ {
+		nodes := map[string][]byte{} // Nil values are deleted.
+		err := viewReduceColls(backIndexStore, viewName,
+			func(index, reductions *gkvlite.Collection) error {
+				starts := map[string]bool{}
+				for _, indexKey := range changed {
+					if viewReduceItemLevel(indexKey) >= level {
+						starts[string(indexKey)] = true
+					}
+					start, err := viewReduceNodeBefore(index, reductions,
+						level, indexKey)
+					if err != nil {
+						return err
+					}
+					starts[string(start)] = true
+				}
+				for start := range starts {
+					j, err := reduceViewNode(index, reductions, r,
+						level, []byte(start))
+					if err != nil {
+						return err
+					}
+					nodes[start] = j
+				}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+		backIndexStore.mutate(func(keys, changes *gkvlite.Collection) {
+			reductions := s.coll(viewReduceCollName(vbid, viewName))
+			for start, j := range nodes {
+				k := viewReduceNodeKey(level, []byte(start))
+				if j == nil {
+					_, err = reductions.Delete(k)
+				} else {
+					err = reductions.Set(k, j)
+				}
+				if err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invokes cb with a vbucket's forward index and reduction tree of a
+// view, either of which is nil when it doesn't exist yet.
+func viewReduceColls(ps *partitionstore, viewName string,
+	cb func(index, reductions *gkvlite.Collection) error) error {
+	index, releaseIndex, err := ps.collRef(viewIndexCollName(ps.vbid, viewName))
+	if err != nil {
+		return err
+	}
+	defer releaseIndex()
+	reductions, releaseReductions, err :=
+		ps.collRef(viewReduceCollName(ps.vbid, viewName))
+	if err != nil {
+		return err
+	}
+	defer releaseReductions()
+	return cb(index, reductions)
+}
+
+// Returns the first item of the node of a level that holds the
+// position just before an index key, skipping nodes whose first item
+// is gone.
+func viewReduceNodeBefore(index, reductions *gkvlite.Collection,
+	level int, indexKey []byte) ([]byte, error) {
+	if reductions == nil || index == nil {
+		return nil, nil
+	}
+	var start []byte
+	var vErr error
+	err := reductions.VisitItemsDescend(viewReduceNodeKey(level, indexKey), false,
+		func(i *gkvlite.Item) bool {
+			if int(i.Key[0]) != level || len(i.Key) == 1 {
+				return false // Before the level's first node.
+			}
+			var j []byte
+			if j, vErr = index.Get(i.Key[1:]); vErr != nil {
+				return false
+			}
+			if j != nil {
+				start = i.Key[1:]
+				return false
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return start, vErr
+}
+
+// Returns the reduction of a node, as JSON, or nil when the node
+// doesn't exist (anymore).
+func reduceViewNode(index, reductions *gkvlite.Collection,
+	r *ViewReduceFunction, level int, start []byte) ([]byte, error) {
+	if index == nil {
+		return nil, nil
+	}
+	if len(start) > 0 {
+		j, err := index.Get(start)
+		if err != nil || j == nil {
+			return nil, err
+		}
+	}
+	ends := func(k []byte) bool {
+		return !bytes.Equal(k, start) && viewReduceItemLevel(k) >= level
+	}
+	if level == 1 {
+		keys := []interface{}{}
+		values := []interface{}{}
+		var vErr error
+		err := visitColl(index, start, func(i *gkvlite.Item) bool {
+			if ends(i.Key) {
+				return false
+			}
+			var key interface{}
+			if key, _, vErr = splitViewIndexKey(i.Key); vErr != nil {
+				return false
+			}
+			var vals []interface{}
+			if vErr = json.Unmarshal(i.Val, &vals); vErr != nil {
+				return false
+			}
+			for _, val := range vals {
+				keys = append(keys, key)
+				values = append(values, val)
+			}
+			return true
+		})
+		if err == nil {
+			err = vErr
+		}
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		res, err := r.reduce(keys, values, false)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(res)
+	}
+
+	if reductions == nil {
+		return nil, nil
+	}
+	var children [][]byte
+	err := reductions.VisitItemsAscend(viewReduceNodeKey(level-1, start), true,
+		func(i *gkvlite.Item) bool {
+			if int(i.Key[0]) != level-1 || ends(i.Key[1:]) {
+				return false
+			}
+			children = append(children, i.Val)
+			return true
+		})
+	if err != nil || len(children) == 0 {
+		return nil, err
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	values := make([]interface{}, len(children))
+	for i, j := range children {
+		if err = json.Unmarshal(j, &values[i]); err != nil {
+			return nil, err
+		}
+	}
+	res, err := r.reduce(nil, values, true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+// Visits the items of a collection from start, or from the first
+// item when start is empty.
+func visitColl(coll *gkvlite.Collection, start []byte,
+	visitor func(*gkvlite.Item) bool) error {
+	if len(start) == 0 {
+		i, err := coll.MinItem(false)
+		if err != nil || i == nil {
+			return err
+		}
+		start = i.Key
+	}
+	return coll.VisitItemsAscend(start, true, visitor)
+}
+
+// How a reduce query groups view keys: all into one group (level 0),
+// by array prefix, or by exact key.
+type viewGrouping struct {
+	level int
+}
+
+const viewGroupExact = 0x7fffffff
+
+func viewQueryGrouping(p *ViewParams) viewGrouping {
+	g := viewGrouping{}
+	if p.Group {
+		g.level = viewGroupExact
+	}
+	if p.GroupLevel > 0 {
+		g.level = int(p.GroupLevel)
+	}
+	return g
+}
+
+func (g viewGrouping) key(key interface{}) interface{} {
+	if g.level == viewGroupExact {
+		return key // Exact, even for keys that aren't arrays.
+	}
+	return ArrayPrefix(key, g.level)
+}
+
+// Whether every key from a to b, in collation order, is in the same
+// group.  That's not so for keys that aren't arrays when grouping by
+// prefixes longer than one, as those all group as null, yet sort on
+// both sides of the arrays.
+func (g viewGrouping) spans(a, b interface{}) bool {
+	if walrus.CollateJSON(g.key(a), g.key(b)) != 0 {
+		return false
+	}
+	if g.level <= 1 || g.level == viewGroupExact {
+		return true
+	}
+	_, isArray := a.([]interface{})
+	return isArray
+}
+
+// The ascending range of view keys of a reduce query.
+type viewReduceRange struct {
+	low, high                   interface{} // Nil when unbounded.
+	lowExclusive, highExclusive bool
+}
+
+func viewQueryReduceRange(p *ViewParams) *viewReduceRange {
+	low, high := viewQueryRange(p)
+	r := &viewReduceRange{low: low, high: high}
+	if p.Key == nil && !p.InclusiveEnd {
+		if p.Descending {
+			r.lowExclusive = true
+		} else {
+			r.highExclusive = true
+		}
+	}
+	return r
+}
+
+func (r *viewReduceRange) before(key interface{}) bool {
+	if r.low == nil {
+		return false
+	}
+	c := walrus.CollateJSON(key, r.low)
+	return c < 0 || (c == 0 && r.lowExclusive)
+}
+
+func (r *viewReduceRange) past(key interface{}) bool {
+	if r.high == nil {
+		return false
+	}
+	c := walrus.CollateJSON(key, r.high)
+	return c > 0 || (c == 0 && r.highExclusive)
+}
+
+// Walks a vbucket's reduction tree of a view in ascending order,
+// reducing the rows of each group within a range.
+type viewReduceWalk struct {
+	index, reductions *gkvlite.Collection
+	r                 *ViewReduceFunction
+	rr                *viewReduceRange
+	g                 viewGrouping
+	visitor           func(*ViewRow) bool
+
+	group    interface{}
+	grouping bool          // Whether group holds a group yet.
+	keys     []interface{} // The group's rows at the edges of nodes.
+	values   []interface{}
+	partials []interface{} // The reductions of the group's nodes.
+	stop     bool          // Past the range, or the visitor is done.
+	done     bool          // The visitor is done.
+}
+
+// Visits the children of a node, which end before end when it's not
+// nil.
+func (w *viewReduceWalk) walk(level int, start, end []byte) error {
+	if level == 1 {
+		var vErr error
+		err := visitColl(w.index, start, func(i *gkvlite.Item) bool {
+			if end != nil && viewIndexKeyCompare(i.Key, end) >= 0 {
+				return false
+			}
+			var key interface{}
+			if key, _, vErr = splitViewIndexKey(i.Key); vErr != nil {
+				return false
+			}
+			if w.rr.before(key) {
+				return true
+			}
+			if w.rr.past(key) {
+				w.stop = true
+				return false
+			}
+			var vals []interface{}
+			if vErr = json.Unmarshal(i.Val, &vals); vErr != nil {
+				return false
+			}
+			for _, val := range vals {
+				if vErr = w.add(key, val, false); vErr != nil || w.stop {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return vErr
+	}
+
+	type child struct {
+		start []byte
+		val   []byte
+	}
+	var children []child
+	err := w.reductions.VisitItemsAscend(viewReduceNodeKey(level-1, start), true,
+		func(i *gkvlite.Item) bool {
+			if int(i.Key[0]) != level-1 ||
+				(end != nil && viewIndexKeyCompare(i.Key[1:], end) >= 0) {
+				return false
+			}
+			children = append(children, child{i.Key[1:], i.Val})
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	for x, c := range children {
+		childEnd := end
+		if x+1 < len(children) {
+			childEnd = children[x+1].start
+		}
+		if err = w.visitNode(level-1, c.start, childEnd, c.val); err != nil {
+			return err
+		}
+		if w.stop {
+			break
+		}
+	}
+	return nil
+}
+
+// Uses a node's reduction when all its rows are within the range and
+// in one group, and otherwise visits its children.
+func (w *viewReduceWalk) visitNode(level int, start, end []byte,
+	val []byte) error {
+	if len(start) == 0 {
+		return w.walk(level, start, end) // Its first key isn't known.
+	}
+	startKey, _, err := splitViewIndexKey(start)
+	if err != nil {
+		return err
+	}
+	if w.rr.past(startKey) {
+		w.stop = true
+		return nil
+	}
+	whole := !w.rr.before(startKey)
+	if end == nil {
+		whole = whole && w.rr.high == nil && w.g.level == 0
+	} else {
+		endKey, _, err := splitViewIndexKey(end)
+		if err != nil {
+			return err
+		}
+		if w.rr.before(endKey) {
+			return nil // As all its keys collate up to the end's.
+		}
+		whole = whole && !w.rr.past(endKey) && w.g.spans(startKey, endKey)
+	}
+	if !whole {
+		return w.walk(level, start, end)
+	}
+	var partial interface{}
+	if err = json.Unmarshal(val, &partial); err != nil {
+		return err
+	}
+	return w.add(startKey, partial, true)
+}
+
+// Adds a row, or a node's reduction, to the group of its key.
+func (w *viewReduceWalk) add(key, value interface{}, partial bool) error {
+	group := w.g.key(key)
+	if !w.grouping || walrus.CollateJSON(group, w.group) != 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		w.group, w.grouping = group, true
+	}
+	if partial {
+		w.partials = append(w.partials, value)
+	} else {
+		w.keys = append(w.keys, key)
+		w.values = append(w.values, value)
+	}
+	return nil
+}
+
+// Visits the reduction of the current group.
+func (w *viewReduceWalk) flush() error {
+	if !w.grouping || w.done {
+		return nil
+	}
+	values := w.partials
+	if len(w.values) > 0 {
+		res, err := w.r.reduce(w.keys, w.values, false)
+		if err != nil {
+			return err
+		}
+		values = append(values, res)
+	}
+	value := values[0]
+	if len(values) > 1 {
+		var err error
+		if value, err = w.r.reduce(nil, values, true); err != nil {
+			return err
+		}
+	}
+	w.keys, w.values, w.partials = w.keys[:0], w.values[:0], nil
+	w.grouping = false
+	if !w.visitor(&ViewRow{Key: w.group, Value: value}) {
+		w.stop, w.done = true, true
+	}
+	return nil
+}
+
+// Visits the reductions of a vbucket's view by group, within a range,
+// in ascending order.
+func (v *VBucket) visitViewReductions(viewName string, r *ViewReduceFunction,
+	rr *viewReduceRange, g viewGrouping, visitor func(*ViewRow) bool) error {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return nil // Not indexed yet.
+	}
+	return viewReduceColls(vs.getPartitionStore(v.vbid), viewName,
+		func(index, reductions *gkvlite.Collection) error {
+			if index == nil || reductions == nil {
+				return nil
+			}
+			w := &viewReduceWalk{
+				index:      index,
+				reductions: reductions,
+				r:          r,
+				rr:         rr,
+				g:          g,
+				visitor:    visitor,
+			}
+			if err := w.walk(viewReduceLevels+1, nil, nil); err != nil {
+				return err
+			}
+			return w.flush()
+		})
+}
+
+// Returns the reductions of a view query's groups, in the query's
+// order, by rereducing each vbucket's reductions of a group.
+func queryViewReductions(vbs []*VBucket, view *View, viewName string,
+	p *ViewParams) (*ViewResult, error) {
+	rr := viewQueryReduceRange(p)
+	g := viewQueryGrouping(p)
+	rows := ViewRows{}
+	err := visitMergedViewRows(vbs, false,
+		func(vb *VBucket, visitor func(*ViewRow) bool) error {
+			r, err := view.GetViewReduceFunction()
+			if err != nil {
+				return err
+			}
+			defer view.PutViewReduceFunction(r)
+			return vb.visitViewReductions(viewName, r, rr, g, visitor)
+		},
+		func(row *ViewRow) bool {
+			rows = append(rows, row)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	vr, err := rereduceViewResult(&ViewResult{Rows: rows}, p, view)
+	if err != nil {
+		return nil, err
+	}
+	if p.Descending {
+		reverseViewRows(vr.Rows)
+	}
+	return vr, nil
+}
+
+// Combines the reductions of a query result by the group or
+// group_level params, rereducing where a group has more than one.
+func rereduceViewResult(result *ViewResult, p *ViewParams,
+	view *View) (*ViewResult, error) {
+	r, err := view.GetViewReduceFunction()
+	if err != nil {
+		return result, err
+	}
+	defer view.PutViewReduceFunction(r)
+
+	g := viewQueryGrouping(p)
+	results := make([]*ViewRow, 0, len(result.Rows))
+	values := make([]interface{}, 0, 200)
+
+	for i := 0; i < len(result.Rows); {
+		values = values[:0]
+		key := g.key(result.Rows[i].Key)
+		for ; i < len(result.Rows); i++ {
+			if walrus.CollateJSON(key, g.key(result.Rows[i].Key)) != 0 {
+				break
+			}
+			values = append(values, result.Rows[i].Value)
+		}
+		value := values[0]
+		if len(values) > 1 {
+			value, err = r.reduce(nil, values, true)
+			if err != nil {
+				return result, err
+			}
+		}
+		results = append(results, &ViewRow{Key: key, Value: value})
+	}
+
+	result.Rows = results
+	return result, nil
+}
+
+// Turns the final reductions of a reduce query into its results.
+func finalizeViewResult(result *ViewResult, view *View) (*ViewResult, error) {
+	r, err := view.GetViewReduceFunction()
+	if err != nil {
+		return result, err
+	}
+	defer view.PutViewReduceFunction(r)
+	for _, row := range result.Rows {
+		if row.Value, err = r.finalize(row.Value); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testExpectReductions(t *testing.T, vb *VBucket, view *View,
+	expected map[string]float64, desc string) {
+	r, err := view.GetViewReduceFunction()
+	if err != nil {
+		t.Fatalf("%v: expected GetViewReduceFunction to work, got: %v", desc, err)
+	}
+	defer view.PutViewReduceFunction(r)
+	got := map[string]float64{}
+	err = vb.visitViewReductions(view.hash(), r, &viewReduceRange{},
+		viewGrouping{viewGroupExact}, func(row *ViewRow) bool {
+			got[row.Key.(string)] = row.Value.(float64)
+			return true
+		})
+	if err != nil {
+		t.Errorf("%v: expected visitViewReductions to work, got: %v", desc, err)
+	}
+	if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", expected) {
+		t.Errorf("%v: expected reductions: %v, got: %v", desc, expected, got)
+	}
+}
+
+func TestViewReductionsMaintenance(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{`+
+			`"map":"function(doc) { emit(doc.category, doc.amount); }",`+
+			`"reduce":"_sum"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"category":"x","amount":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"category":"x","amount":2}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"category":"y","amount":5}`), VBActive)
+
+	view := (*bucket.GetDDocs())["_design/d0"].Views["v0"]
+	vb, _ := bucket.GetVBucket(0)
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testExpectReductions(t, vb, view,
+		map[string]float64{"x": 3, "y": 5}, "after refresh")
+
+	SetItem(bucket, []byte("b"), []byte(`{"category":"y","amount":10}`), VBActive)
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testExpectReductions(t, vb, view,
+		map[string]float64{"x": 1, "y": 15}, "after update")
+
+	res := vbMutate(vb, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: 0,
+		Key:     []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected delete to work, got: %v", res)
+	}
+	if _, err = vb.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testExpectReductions(t, vb, view,
+		map[string]float64{"y": 15}, "after delete")
+}
+
+// Checks the reductions of the tree against summing up the rows.
+func testExpectTreeSums(t *testing.T, vbs []*VBucket, view *View,
+	p *ViewParams, desc string) {
+	rows := ViewRows{}
+	for _, vb := range vbs {
+		err := vb.visitViewIndex(view.hash(), &viewKeyRange{},
+			func(row *ViewRow) bool {
+				rows = append(rows, row)
+				return true
+			})
+		if err != nil {
+			t.Fatalf("%v: expected visitViewIndex to work, got: %v", desc, err)
+		}
+	}
+	rr := viewQueryReduceRange(p)
+	g := viewQueryGrouping(p)
+	expected := map[string]float64{}
+	for _, row := range rows {
+		if rr.before(row.Key) || rr.past(row.Key) {
+			continue
+		}
+		j, _ := json.Marshal(g.key(row.Key))
+		expected[string(j)] += row.Value.(float64)
+	}
+
+	vr, err := queryViewReductions(vbs, view, view.hash(), p)
+	if err != nil {
+		t.Fatalf("%v: expected queryViewReductions to work, got: %v", desc, err)
+	}
+	got := map[string]float64{}
+	for _, row := range vr.Rows {
+		j, _ := json.Marshal(row.Key)
+		got[string(j)] += row.Value.(float64)
+	}
+	if len(vr.Rows) != len(got) ||
+		fmt.Sprintf("%v", got) != fmt.Sprintf("%v", expected) {
+		t.Errorf("%v: expected sums: %v, got: %v", desc, expected, vr.Rows)
+	}
+}
+
+func TestViewReductionsTree(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+
+	// Every fifth doc emits the same, hot, key.
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{"v0":{"map":"function(doc) {`+
+			` emit([doc.c, doc.n % 5 ? doc.n : 0], doc.n); }",`+
+			`"reduce":"_sum"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	view := (*bucket.GetDDocs())["_design/d0"].Views["v0"]
+	set := func(i, n int) {
+		SetItem(bucket, []byte(fmt.Sprintf("k%v", i)),
+			[]byte(fmt.Sprintf(`{"c":%v,"n":%v}`, i%3, n)), VBActive)
+	}
+	for i := 0; i < 3000; i++ {
+		set(i, i)
+	}
+
+	vbs := []*VBucket{}
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		vb, _ := bucket.GetVBucket(vbid)
+		vbs = append(vbs, vb)
+	}
+	params := []*ViewParams{
+		{Reduce: true, InclusiveEnd: true},
+		{Reduce: true, InclusiveEnd: true, GroupLevel: 1},
+		{Reduce: true, InclusiveEnd: true, Group: true},
+		{Reduce: true, InclusiveEnd: true,
+			StartKey: []interface{}{1.0, 100.0}, EndKey: []interface{}{2.0, 50.0}},
+		{Reduce: true, InclusiveEnd: false, GroupLevel: 1,
+			StartKey: []interface{}{0.0, 0.0}, EndKey: []interface{}{2.0, 0.0}},
+		{Reduce: true, InclusiveEnd: false, Descending: true,
+			StartKey: []interface{}{2.0}, EndKey: []interface{}{0.0, 0.0}},
+		{Reduce: true, InclusiveEnd: true, Key: []interface{}{1.0, 0.0}},
+	}
+	check := func(desc string) {
+		if err := viewsRefreshVBuckets(vbs); err != nil {
+			t.Fatalf("%v: expected viewsRefreshVBuckets to work, got: %v", desc, err)
+		}
+		for i, p := range params {
+			testExpectTreeSums(t, vbs, view, p, fmt.Sprintf("%v, params %v", desc, i))
+		}
+	}
+	check("after refresh")
+
+	for i := 0; i < 3000; i += 7 {
+		set(i, i+1) // Moves some rows onto or off the hot keys.
+	}
+	for i := 1; i < 3000; i += 11 {
+		vb, _ := GetVBucket(bucket, []byte(fmt.Sprintf("k%v", i)), VBActive)
+		vbMutate(vb, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.DELETE,
+			VBucket: vb.vbid,
+			Key:     []byte(fmt.Sprintf("k%v", i)),
+		})
+	}
+	check("after updates and deletes")
+}
+
+func TestCouchViewRereduceAcrossVBuckets(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+
+	err := bucket.SetDDoc("_design/d0",
+		[]byte(`{"views":{`+
+			`"sum":{"map":"function(doc) { emit([doc.c, doc.n], doc.n); }",`+
+			`"reduce":"_sum"},`+
+			`"count":{"map":"function(doc) { emit([doc.c, doc.n], doc.n); }",`+
+			`"reduce":"_count"},`+
+			`"stats":{"map":"function(doc) { emit(doc.c, doc.n); }",`+
+			`"reduce":"_stats"}}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		SetItem(bucket, []byte(fmt.Sprintf("k%v", i)),
+			[]byte(fmt.Sprintf(`{"c":%v,"n":%v}`, i%2, i)), VBActive)
+	}
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		vb, _ := bucket.GetVBucket(vbid)
+		if n, _, _ := vb.ps.getTotals(); n == 0 {
+			t.Fatalf("expected items in every vbucket, vbid: %v", vbid)
+		}
+	}
+
+	url := "http://127.0.0.1/default/_design/d0/_view/"
+	vr := testGetViewRows(t, mr, url+"sum")
+	if len(vr.Rows) != 1 || vr.Rows[0].Value.(float64) != 190 {
+		t.Errorf("expected a total sum of 190, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"sum?group_level=1")
+	if len(vr.Rows) != 2 ||
+		vr.Rows[0].Value.(float64) != 90 || vr.Rows[1].Value.(float64) != 100 {
+		t.Errorf("expected sums by category, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"sum?group=true")
+	if len(vr.Rows) != 20 {
+		t.Errorf("expected a row per key when grouped, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"count?startkey=[1]&endkey=[1,{}]")
+	if len(vr.Rows) != 1 || vr.Rows[0].Value.(float64) != 10 {
+		t.Errorf("expected a count of 10, got: %#v", vr.Rows)
+	}
+	vr = testGetViewRows(t, mr, url+"stats?group=true&key=1")
+	if len(vr.Rows) != 1 {
+		t.Fatalf("expected stats of one key, got: %#v", vr.Rows)
+	}
+	stats := vr.Rows[0].Value.(map[string]interface{})
+	if stats["count"].(float64) != 10 || stats["sum"].(float64) != 100 ||
+		stats["min"].(float64) != 1 || stats["max"].(float64) != 19 {
+		t.Errorf("expected rereduced stats, got: %#v", stats)
+	}
+}
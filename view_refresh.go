@@ -4,17 +4,39 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/steveyen/gkvlite"
 )
 
 const (
 	VIEWS_FILE_SUFFIX = "views"
 )
 
-// TODO: Make this configurable.
-var viewsRefresher = newPeriodically(10*time.Second, 5)
+// The number of vbuckets whose views may be refreshed at once, as
+// set by the view-workers flag.
+var viewsRefreshWorkers = runtime.NumCPU()
+
+var viewsRefresher = newPeriodically(10*time.Second, viewsRefreshWorkers)
+
+// Replaces the background views refresher with one of the given
+// number of workers, before any buckets are loaded.
+func configureViewsRefresher(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	viewsRefresher.Stop()
+	viewsRefreshWorkers = workers
+	viewsRefresher = newPeriodically(10*time.Second, workers)
+}
 
 func (v *VBucket) markStale() {
 	newval := atomic.AddInt64(&v.staleness, 1)
@@ -40,8 +62,8 @@ func (v *VBucket) viewsRefresh() (int64, error) {
 
 	d := atomic.LoadInt64(&v.staleness)
 
-	ddocs := v.parent.GetDDocs()
-	if ddocs != nil {
+	views := v.viewsInScope(ddocsViews(v.parent.GetDDocs()))
+	if len(views) > 0 {
 		viewsStore, err := v.getViewsStore()
 		if err != nil {
 			return 0, err
@@ -50,8 +72,12 @@ func (v *VBucket) viewsRefresh() (int64, error) {
 		if backIndexStore == nil {
 			return 0, fmt.Errorf("missing back index store, vbid: %v", v.vbid)
 		}
-		_, backIndexChanges := backIndexStore.colls()
+		_, backIndexChanges, release, err := backIndexStore.collsRef()
+		if err != nil {
+			return 0, err
+		}
 		backIndexLastChange, err := backIndexChanges.MaxItem(true)
+		release()
 		if err != nil {
 			return 0, err
 		}
@@ -59,9 +85,10 @@ func (v *VBucket) viewsRefresh() (int64, error) {
 		if backIndexLastChange != nil {
 			backIndexLastChangeCasBytes = backIndexLastChange.Key
 		}
+		mapErrs := &viewMapErrs{}
 		errVisit := v.ps.visitChanges(backIndexLastChangeCasBytes, true,
 			func(i *item) bool {
-				err = v.viewsRefreshItem(ddocs, backIndexStore, i)
+				err = v.viewsRefreshItem(views, backIndexStore, i, mapErrs)
 				if err != nil {
 					return false
 				}
@@ -78,24 +105,101 @@ func (v *VBucket) viewsRefresh() (int64, error) {
 	return atomic.AddInt64(&v.staleness, -d), nil
 }
 
-func (v *VBucket) viewsRefreshItem(ddocs *DDocs,
-	backIndexStore *partitionstore, i *item) error {
+// Counts the map function errors of each view during a views refresh,
+// which skips a view once there are so many that its map function is
+// likely just broken, while the other views keep being indexed.
+// Timeouts get a lower limit, as each one takes a while.
+type viewMapErrs struct {
+	errs     map[string]int // Keyed by view hash.
+	timeouts map[string]int
+	failed   map[string]bool
+}
+
+const maxViewTimeouts = 3
+
+func (e *viewMapErrs) add(viewName string, err error) (tooMany bool) {
+	if e.errs == nil {
+		e.errs = map[string]int{}
+		e.timeouts = map[string]int{}
+		e.failed = map[string]bool{}
+	}
+	e.errs[viewName]++
+	if _, ok := err.(*jsTimeoutError); ok {
+		e.timeouts[viewName]++
+	}
+	if e.errs[viewName] > maxViewErrors || e.timeouts[viewName] > maxViewTimeouts {
+		e.failed[viewName] = true
+	}
+	return e.failed[viewName]
+}
+
+func (v *VBucket) viewsRefreshItem(views map[string]*indexedView,
+	backIndexStore *partitionstore, i *item, mapErrs *viewMapErrs) error {
 	oldBackIndexItem, err := backIndexStore.get(i.key)
 	if err != nil {
 		return err
 	}
-	// TODO: One day do view hashing so view indexes are shared.
-	viewEmits := map[string]ViewRows{} // Keyed by "ddocId/viewId".
-	for ddocId, ddoc := range *ddocs {
-		for viewId, view := range ddoc.Views {
-			emits, err := v.execViewMapFunction(ddocId, ddoc, viewId, view, i)
-			if err != nil {
-				return err
+	prev := backIndexEntry{}
+	if oldBackIndexItem != nil {
+		// An entry in an older format is treated as empty, as those
+		// views files are rebuilt on load.
+		json.Unmarshal(oldBackIndexItem.data, &prev)
+	}
+	// Identical views share an index, keyed by the view hash.
+	viewEmits := map[string]ViewRows{}
+	reducers := map[string]*ViewReduceFunction{}
+	for viewName, iv := range views {
+		viewEmits[viewName] = nil
+		if iv.view.Reduce != "" {
+			// A broken reduce function fails the reduce queries,
+			// but shouldn't keep the map index from being built.
+			if r, err := iv.view.GetViewReduceFunction(); err == nil {
+				reducers[viewName] = r
+			}
+		}
+		if i.isDeletion() || mapErrs.failed[viewName] {
+			continue
+		}
+		emits, err := v.execViewMapFunction(iv.view, i)
+		if err != nil {
+			// The doc is left out of the view.  Once there are so
+			// many errors that the map function is likely just
+			// broken, the view is skipped for the rest of the
+			// refresh.
+			v.parent.AddViewError(viewName, &ViewError{
+				DocId:   string(i.key),
+				VBucket: v.vbid,
+				Error:   err.Error(),
+				Time:    time.Now(),
+			})
+			log.Printf("view map error, vbucket: %v, view: %v/%v,"+
+				" doc: %q, err: %v", v.vbid, iv.ddocId, iv.viewId, i.key, err)
+			if mapErrs.add(viewName, err) {
+				v.parent.AddViewError(viewName, &ViewError{
+					VBucket: v.vbid,
+					Error:   "too many map errors, view skipped until next refresh",
+					Time:    time.Now(),
+				})
+				log.Printf("view map errors, vbucket: %v, view: %v/%v,"+
+					" skipped until next refresh", v.vbid, iv.ddocId, iv.viewId)
 			}
-			viewEmits[ddocId+"/"+viewId] = emits
+			continue
 		}
+		viewEmits[viewName] = emits
+	}
+	next, err := updateViewIndexes(backIndexStore, i.key, prev, viewEmits,
+		reducers)
+	for viewName, r := range reducers {
+		views[viewName].view.PutViewReduceFunction(r)
 	}
-	j, err := json.Marshal(viewEmits)
+	if err != nil {
+		return err
+	}
+	if i.isDeletion() {
+		_, err = backIndexStore.del(i.key, i.cas, oldBackIndexItem)
+		return err
+	}
+	j, err := json.Marshal(next)
 	if err != nil {
 		return err
 	}
@@ -112,12 +216,15 @@ func (v *VBucket) viewsRefreshItem(ddocs *DDocs,
 	return nil
 }
 
-func (v *VBucket) execViewMapFunction(ddocId string, ddoc *DDoc,
-	viewId string, view *View, i *item) (ViewRows, error) {
+func (v *VBucket) execViewMapFunction(view *View, i *item) (ViewRows, error) {
+	if view.Pointers != nil {
+		return view.Pointers.emits(string(i.key), i.data)
+	}
 	pvmf, err := view.GetViewMapFunction()
 	if err != nil {
 		return nil, err
 	}
+	defer view.PutViewMapFunction(pvmf) // Unless its VM was halted.
 	docId := string(i.key)
 	docType := "json"
 	var doc interface{}
@@ -138,8 +245,11 @@ func (v *VBucket) execViewMapFunction(ddocId string, ddoc *DDoc,
 	if err != nil {
 		return nil, err
 	}
-	_, err = pvmf.mapf.Call(pvmf.mapf, odoc, ometa)
+	pvmf.halted = true // Until the call returns, as a panic leaves it so.
+	_, err = OttoCall(pvmf.otto, pvmf.mapf, odoc, ometa)
+	_, pvmf.halted = err.(*jsTimeoutError)
 	if err != nil {
+		pvmf.restartEmits() // Drop any partial emits.
 		return nil, err
 	}
 	emits, err := pvmf.restartEmits()
@@ -149,23 +259,275 @@ func (v *VBucket) execViewMapFunction(ddocId string, ddoc *DDoc,
 	for _, emit := range emits {
 		emit.Id = docId
 	}
+	if view.spatial {
+		return spatialEmits(emits)
+	}
 	return emits, nil
 }
 
 func (v *VBucket) getViewsStore() (res *bucketstore, err error) {
 	v.Apply(func() {
 		if v.viewsStore == nil {
-			// TODO: Handle views file versioning / compaction.
-			// TODO: Handle views file memory-only mode.
-			// TODO: Handle views file load.
-			ver := 0
-			settings := v.parent.GetBucketSettings()
-			fileName := fmt.Sprintf("%s_%d-%d.%s",
-				settings.UUID, v.vbid, ver, VIEWS_FILE_SUFFIX)
-			p := path.Join(v.parent.GetBucketDir(), fileName)
-			v.viewsStore, err = newBucketStore(p, *settings)
+			v.viewsStore, err = v.openViewsStore(false)
 		}
 		res = v.viewsStore
 	})
 	return res, err
 }
+
+// Returns the views store only if it's already open.
+func (v *VBucket) openedViewsStore() (res *bucketstore) {
+	v.Apply(func() {
+		res = v.viewsStore
+	})
+	return res
+}
+
+// Opens the latest version of the vbucket's views file, cleaning up
+// any older versions.  When mustExist is true and there's no views
+// file, returns nil.  Must be invoked while holding the vbucket lock.
+func (v *VBucket) openViewsStore(mustExist bool) (*bucketstore, error) {
+	settings := *v.parent.GetBucketSettings()
+	dir := v.parent.GetBucketDir()
+	fileName := makeViewsFileName(settings.UUID, v.vbid, 0)
+	created := true
+	if settings.MemoryOnly > MemoryOnly_LEVEL_PERSIST_EVERYTHING {
+		// Items aren't persisted, so neither are indexes of them.
+		if mustExist {
+			return nil, nil
+		}
+		settings.MemoryOnly = MemoryOnly_LEVEL_PERSIST_NOTHING
+	} else {
+		latest, stale, err := viewsFileNames(dir, settings.UUID, v.vbid)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range stale {
+			os.Remove(path.Join(dir, name))
+		}
+		if latest == "" && mustExist {
+			return nil, nil
+		}
+		if latest != "" {
+			fileName, created = latest, false
+		}
+	}
+	vs, err := newBucketStore(path.Join(dir, fileName), settings)
+	if err != nil || !created {
+		return vs, err
+	}
+	if err = setViewsIndexVersion(vs); err != nil {
+		vs.destroy()
+		return nil, err
+	}
+	return vs, nil
+}
+
+// Reopens the views store of a vbucket that's being loaded, if it
+// has one on disk.  An index that's seen changes beyond the last
+// loaded change, as when the views file was flushed after the data
+// file, can't be caught up and is thrown away to be rebuilt, as is an
+// index in an older format.  Must be
+// invoked while holding the vbucket lock.
+func (v *VBucket) loadViewsStore(lastCas uint64) error {
+	vs, err := v.openViewsStore(true)
+	if err != nil || vs == nil {
+		return err
+	}
+	if ver := viewsIndexVersion(vs); ver != VIEWS_INDEX_VERSION {
+		log.Printf("vbucket %v: rebuilding views index, version: %q",
+			v.vbid, ver)
+		vs.destroy()
+		v.markStale()
+		return nil
+	}
+	_, changes, release, err := vs.getPartitionStore(v.vbid).collsRef()
+	if err != nil {
+		vs.destroy()
+		return err
+	}
+	i, err := changes.MaxItem(false)
+	release()
+	if err != nil {
+		vs.destroy()
+		return err
+	}
+	if i != nil {
+		var indexedCas uint64
+		indexedCas, err = casBytesParse(i.Key)
+		if err != nil || indexedCas > lastCas {
+			log.Printf("vbucket %v: rebuilding views index, indexed cas: %v,"+
+				" last cas: %v, err: %v", v.vbid, indexedCas, lastCas, err)
+			vs.destroy()
+			vs = nil
+		}
+	}
+	v.viewsStore = vs
+	v.markStale() // To catch up the index with the loaded changes.
+	return nil
+}
+
+// Throws away the vbucket's views index, such as when a design doc
+// changes, so that it's rebuilt from scratch.
+func (v *VBucket) resetViewsStore() error {
+	v.viewsLock.Lock()
+	defer v.viewsLock.Unlock()
+
+	var vs *bucketstore
+	var err error
+	v.Apply(func() {
+		vs = v.viewsStore
+		v.viewsStore = nil
+		if vs == nil {
+			// Not opened yet, but there might be a views file.
+			vs, err = v.openViewsStore(true)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if vs != nil {
+		vs.destroy()
+	}
+	if vs != nil || atomic.LoadInt64(&v.stats.Items) > 0 {
+		v.markStale()
+	}
+	return nil
+}
+
+// Drops the indexes of views that no design doc references anymore.
+// Back-index entries may still name those views, but they're ignored,
+// as a view that shows up again gets its index rebuilt from scratch.
+func (v *VBucket) dropViewIndexes(viewNames []string) error {
+	v.viewsLock.Lock()
+	defer v.viewsLock.Unlock()
+
+	vs := v.openedViewsStore()
+	if vs == nil {
+		return nil
+	}
+	vs.getPartitionStore(v.vbid).mutate(func(keys, changes *gkvlite.Collection) {
+		store := vs.BSFData().store
+		counts := store.GetCollection(viewRowCountsCollName(v.vbid))
+		for _, viewName := range viewNames {
+			store.RemoveCollection(viewIndexCollName(v.vbid, viewName))
+			store.RemoveCollection(viewReduceCollName(v.vbid, viewName))
+			if counts != nil {
+				counts.Delete([]byte(viewName))
+			}
+		}
+	})
+	vs.dirty(false)
+	return nil
+}
+
+// Returns the views that the vbucket indexes, by view hash: every
+// production view, plus the dev views if the vbucket is in the dev
+// subset or full_set=true queries asked for them.
+func (v *VBucket) viewsInScope(prod, dev map[string]*indexedView) map[string]*indexedView {
+	rv := make(map[string]*indexedView, len(prod)+len(dev))
+	for viewName, iv := range prod {
+		rv[viewName] = iv
+	}
+	if len(dev) == 0 {
+		return rv
+	}
+	settings := v.parent.GetBucketSettings()
+	devSubset := inDevSubset(v.vbid, settings.NumPartitions,
+		settings.devSubsetPartitions())
+	v.Apply(func() {
+		for viewName, iv := range dev {
+			if devSubset || v.viewsFullSet[viewName] {
+				rv[viewName] = iv
+			}
+		}
+	})
+	return rv
+}
+
+// Adapts the vbucket's views index to a change of the views that it
+// indexes, by rebuilding it when there's a view it didn't index
+// before, or else dropping the indexes of views that are gone.
+func (v *VBucket) viewsScopeChanged(prev, next map[string]*indexedView) error {
+	for viewName := range next {
+		if prev[viewName] == nil {
+			// TODO: Build just the new view's index, rather than all.
+			return v.resetViewsStore()
+		}
+	}
+	dropped := []string{}
+	for viewName := range prev {
+		if next[viewName] == nil {
+			dropped = append(dropped, viewName)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	return v.dropViewIndexes(dropped)
+}
+
+// Has the vbucket index a dev view even though it's outside of the
+// dev subset.  That's remembered until restart, when a later
+// full_set=true query asks again.
+func (v *VBucket) addViewFullSet(viewName string) error {
+	added := false
+	v.Apply(func() {
+		if !v.viewsFullSet[viewName] {
+			if v.viewsFullSet == nil {
+				v.viewsFullSet = map[string]bool{}
+			}
+			v.viewsFullSet[viewName] = true
+			added = true
+		}
+	})
+	if !added {
+		return nil
+	}
+	return v.resetViewsStore()
+}
+
+// Views files follow a "UUID_VBID-VER.views" naming pattern.
+func makeViewsFileName(uuid string, vbid uint16, ver int) string {
+	return fmt.Sprintf("%s_%d-%d.%s", uuid, vbid, ver, VIEWS_FILE_SUFFIX)
+}
+
+// Returns the name of the latest views file of a vbucket, or "" if
+// there's none, and the names of any older versions or compaction
+// leftovers.
+func viewsFileNames(dir string, uuid string, vbid uint16) (
+	latest string, stale []string, err error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	prefix := fmt.Sprintf("%s_%d-", uuid, vbid)
+	suffix := "." + VIEWS_FILE_SUFFIX
+	latestVer := -1
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasSuffix(name, suffix+".compact") {
+			stale = append(stale, name)
+			continue
+		}
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		ver, err := strconv.Atoi(name[len(prefix) : len(name)-len(suffix)])
+		if err != nil {
+			continue
+		}
+		if ver > latestVer {
+			if latest != "" {
+				stale = append(stale, latest)
+			}
+			latest, latestVer = name, ver
+		} else {
+			stale = append(stale, name)
+		}
+	}
+	return latest, stale, nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Spatial views are the "spatial" map functions of design docs, which
+// emit GeoJSON geometries, like {"type": "Point", "coordinates":
+// [lon, lat]}, or [west, south, east, north] bounding boxes, instead
+// of keys.  They're indexed like other views, except that a row's key
+// is the geohash of the smallest geohash cell that holds the
+// geometry's bounding box, so a bounding box query only scans the
+// index ranges of the few cells that cover it, and the cells that
+// hold those.
+
+const (
+	geohashMaxPrecision = 12
+	geohashBase32       = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	// The most geohash cells that a query's bounding box is covered
+	// with, so a query scans at most that many ranges (plus their
+	// ancestors' cells).
+	spatialMaxQueryCells = 32
+)
+
+// A bounding box of west, south, east and north, in degrees.
+type spatialBbox [4]float64
+
+func (b spatialBbox) intersects(o spatialBbox) bool {
+	return b[0] <= o[2] && o[0] <= b[2] && b[1] <= o[3] && o[1] <= b[3]
+}
+
+func (b spatialBbox) slice() []float64 {
+	return []float64{b[0], b[1], b[2], b[3]}
+}
+
+// The stored value of a spatial view row, keyed by geohash cell.
+type spatialValue struct {
+	Bbox     []float64   `json:"bbox"`
+	Geometry interface{} `json:"geometry,omitempty"`
+	Value    interface{} `json:"value"`
+}
+
+// A row of a spatial query result, as GeoCouch has it.
+type SpatialRow struct {
+	Id       string        `json:"id"`
+	Bbox     []float64     `json:"bbox"`
+	Geometry interface{}   `json:"geometry,omitempty"`
+	Value    interface{}   `json:"value"`
+	Doc      *ViewDocValue `json:"doc,omitempty"`
+}
+
+type SpatialRows []*SpatialRow
+
+func (rows SpatialRows) Len() int           { return len(rows) }
+func (rows SpatialRows) Less(i, j int) bool { return rows[i].Id < rows[j].Id }
+func (rows SpatialRows) Swap(i, j int)      { rows[i], rows[j] = rows[j], rows[i] }
+
+// Turns the emits of a spatial map function into rows keyed by the
+// geohash cells of their geometries.
+func spatialEmits(emits ViewRows) (ViewRows, error) {
+	rv := make(ViewRows, 0, len(emits))
+	for _, emit := range emits {
+		bbox, geometry, err := parseSpatialKey(emit.Key)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, &ViewRow{
+			Id:  emit.Id,
+			Key: geohashCell(bbox),
+			Value: &spatialValue{
+				Bbox:     bbox.slice(),
+				Geometry: geometry,
+				Value:    emit.Value,
+			},
+		})
+	}
+	return rv, nil
+}
+
+// Returns the bounding box of an emitted GeoJSON geometry or array
+// bounding box, along with the geometry, if any.
+func parseSpatialKey(key interface{}) (spatialBbox, interface{}, error) {
+	switch k := key.(type) {
+	case []interface{}:
+		bbox, err := parseSpatialBbox(k)
+		return bbox, nil, err
+	case map[string]interface{}:
+		if k["type"] == "GeometryCollection" {
+			return spatialBbox{}, nil,
+				fmt.Errorf("spatial GeometryCollection not supported")
+		}
+		coords, ok := k["coordinates"]
+		if !ok {
+			return spatialBbox{}, nil,
+				fmt.Errorf("spatial geometry without coordinates: %v", k)
+		}
+		bbox := spatialBbox{180, 90, -180, -90}
+		if err := extendSpatialBbox(&bbox, coords); err != nil {
+			return spatialBbox{}, nil, err
+		}
+		if bbox[0] > bbox[2] {
+			return spatialBbox{}, nil,
+				fmt.Errorf("spatial geometry without positions: %v", k)
+		}
+		return bbox, k, nil
+	}
+	return spatialBbox{}, nil,
+		fmt.Errorf("spatial key not a geometry or bbox: %v", key)
+}
+
+func parseSpatialBbox(a []interface{}) (spatialBbox, error) {
+	var bbox spatialBbox
+	if len(a) != 4 {
+		return bbox, fmt.Errorf("spatial bbox not [w,s,e,n]: %v", a)
+	}
+	for i, x := range a {
+		f, ok := spatialNumber(x)
+		if !ok {
+			return bbox, fmt.Errorf("spatial bbox not numbers: %v", a)
+		}
+		bbox[i] = f
+	}
+	return bbox, checkSpatialBbox(bbox)
+}
+
+func checkSpatialBbox(b spatialBbox) error {
+	if b[0] < -180 || b[2] > 180 || b[1] < -90 || b[3] > 90 ||
+		b[0] > b[2] || b[1] > b[3] {
+		return fmt.Errorf("spatial bbox out of range: %v", b)
+	}
+	return nil
+}
+
+// Numbers exported from otto may be integers rather than float64's.
+func spatialNumber(x interface{}) (float64, bool) {
+	switch n := x.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Extends a bounding box by the positions of GeoJSON coordinates,
+// which nest arrays of positions to any depth.
+func extendSpatialBbox(b *spatialBbox, coords interface{}) error {
+	a, ok := coords.([]interface{})
+	if !ok {
+		return fmt.Errorf("spatial coordinates not an array: %v", coords)
+	}
+	if len(a) > 0 {
+		if _, nested := a[0].([]interface{}); nested {
+			for _, c := range a {
+				if err := extendSpatialBbox(b, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if len(a) < 2 {
+		return fmt.Errorf("spatial position too short: %v", a)
+	}
+	lon, ok0 := spatialNumber(a[0])
+	lat, ok1 := spatialNumber(a[1])
+	if !ok0 || !ok1 || lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return fmt.Errorf("spatial position out of range: %v", a)
+	}
+	if lon < b[0] {
+		b[0] = lon
+	}
+	if lon > b[2] {
+		b[2] = lon
+	}
+	if lat < b[1] {
+		b[1] = lat
+	}
+	if lat > b[3] {
+		b[3] = lat
+	}
+	return nil
+}
+
+// The longitude and latitude bits of geohashes of a precision, where
+// the bits interleave starting with longitude.
+func geohashBits(precision int) (lonBits, latBits uint) {
+	bits := uint(precision) * 5
+	return (bits + 1) / 2, bits / 2
+}
+
+// The index of the cell that holds a coordinate, out of 1<<bits
+// cells that evenly split the span from min to min+span.
+func geohashCellIndex(x, min, span float64, bits uint) uint64 {
+	n := uint64(1) << bits
+	i := (x - min) / span * float64(n)
+	if i < 0 {
+		return 0
+	}
+	if i >= float64(n) {
+		return n - 1
+	}
+	return uint64(i)
+}
+
+func geohashEncode(lonIdx, latIdx uint64, precision int) string {
+	lonBits, latBits := geohashBits(precision)
+	buf := make([]byte, precision)
+	var c, n uint
+	for i := uint(0); i < uint(precision)*5; i++ {
+		var bit uint64
+		if i%2 == 0 {
+			lonBits--
+			bit = (lonIdx >> lonBits) & 1
+		} else {
+			latBits--
+			bit = (latIdx >> latBits) & 1
+		}
+		c = c<<1 | uint(bit)
+		if i%5 == 4 {
+			buf[n] = geohashBase32[c]
+			c, n = 0, n+1
+		}
+	}
+	return string(buf)
+}
+
+func geohashPoint(lon, lat float64, precision int) string {
+	lonBits, latBits := geohashBits(precision)
+	return geohashEncode(geohashCellIndex(lon, -180, 360, lonBits),
+		geohashCellIndex(lat, -90, 180, latBits), precision)
+}
+
+// Returns the geohash of the smallest cell that holds a bounding box,
+// which is "" (the whole world) for a box that straddles the edges of
+// the top level cells.
+func geohashCell(b spatialBbox) string {
+	sw := geohashPoint(b[0], b[1], geohashMaxPrecision)
+	ne := geohashPoint(b[2], b[3], geohashMaxPrecision)
+	i := 0
+	for i < len(sw) && sw[i] == ne[i] {
+		i++
+	}
+	return sw[:i]
+}
+
+// Returns geohash cells that cover a bounding box, as many and as
+// small as spatialMaxQueryCells allows.
+func geohashCover(b spatialBbox) []string {
+	for precision := geohashMaxPrecision; precision > 0; precision-- {
+		lonBits, latBits := geohashBits(precision)
+		w := geohashCellIndex(b[0], -180, 360, lonBits)
+		e := geohashCellIndex(b[2], -180, 360, lonBits)
+		s := geohashCellIndex(b[1], -90, 180, latBits)
+		n := geohashCellIndex(b[3], -90, 180, latBits)
+		if (e-w+1)*(n-s+1) > spatialMaxQueryCells {
+			continue
+		}
+		cells := []string{}
+		for x := w; x <= e; x++ {
+			for y := s; y <= n; y++ {
+				cells = append(cells, geohashEncode(x, y, precision))
+			}
+		}
+		return cells
+	}
+	return []string{""}
+}
+
+// Parses a bbox query param of "west,south,east,north".
+func parseSpatialBboxParam(param string) (spatialBbox, error) {
+	parts := strings.Split(param, ",")
+	a := make([]interface{}, len(parts))
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return spatialBbox{}, fmt.Errorf("bad bbox: %q", param)
+		}
+		a[i] = f
+	}
+	return parseSpatialBbox(a)
+}
+
+// Visits a vbucket's spatial view rows whose bounding boxes
+// intersect a query's, by scanning the index ranges of the cells that
+// cover the query's box, and then the cells that hold those.
+func (v *VBucket) visitSpatialIndex(viewName string, bbox spatialBbox,
+	visitor func(*SpatialRow) bool) error {
+	cells := geohashCover(bbox)
+	ancestors := map[string]bool{}
+	for _, cell := range cells {
+		for i := 0; i < len(cell); i++ {
+			ancestors[cell[:i]] = true
+		}
+	}
+	ok := true
+	visit := func(row *ViewRow) bool {
+		m, _ := row.Value.(map[string]interface{})
+		if m == nil {
+			return true
+		}
+		a, _ := m["bbox"].([]interface{})
+		rowBbox, err := parseSpatialBbox(a)
+		if err != nil || !rowBbox.intersects(bbox) {
+			return true
+		}
+		ok = visitor(&SpatialRow{
+			Id:       row.Id,
+			Bbox:     rowBbox.slice(),
+			Geometry: m["geometry"],
+			Value:    m["value"],
+		})
+		return ok
+	}
+	for cell := range ancestors {
+		r := &viewKeyRange{start: cell, end: cell, inclusiveEnd: true}
+		if err := v.visitViewIndex(viewName, r, visit); err != nil || !ok {
+			return err
+		}
+	}
+	for _, cell := range cells {
+		r := &viewKeyRange{start: cell}
+		err := v.visitViewIndex(viewName, r, func(row *ViewRow) bool {
+			key, _ := row.Key.(string)
+			if !strings.HasPrefix(key, cell) {
+				return false // Past the cell's range.
+			}
+			return visit(row)
+		})
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the rows of a spatial view that intersect a bounding box,
+// in doc id order.
+func querySpatialIndexes(vbs []*VBucket, viewName string,
+	bbox spatialBbox) (SpatialRows, error) {
+	rows := SpatialRows{}
+	for _, vb := range vbs {
+		err := vb.visitSpatialIndex(viewName, bbox, func(row *SpatialRow) bool {
+			rows = append(rows, row)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Stable(rows)
+	return rows, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGeohash(t *testing.T) {
+	if got := geohashPoint(-5.6, 42.6, 5); got != "ezs42" {
+		t.Errorf("expected ezs42, got: %v", got)
+	}
+	if got := geohashPoint(-5.6, 42.6, 12); got[:5] != "ezs42" {
+		t.Errorf("expected an ezs42 prefix, got: %v", got)
+	}
+	tests := []struct {
+		bbox spatialBbox
+		exp  string
+	}{
+		{spatialBbox{-5.6, 42.6, -5.6, 42.6}, geohashPoint(-5.6, 42.6, 12)},
+		{spatialBbox{-5.61, 42.59, -5.59, 42.61}, "ezs42"},
+		{spatialBbox{-1, -1, 1, 1}, ""}, // Straddles the top level cells.
+	}
+	for _, test := range tests {
+		if got := geohashCell(test.bbox); got != test.exp {
+			t.Errorf("expected cell %q of %v, got: %q", test.exp, test.bbox, got)
+		}
+	}
+
+	cells := geohashCover(spatialBbox{-5.61, 42.59, -5.59, 42.61})
+	if len(cells) == 0 || len(cells) > spatialMaxQueryCells {
+		t.Errorf("expected a few cover cells, got: %v", cells)
+	}
+	for _, cell := range cells {
+		if cell[:5] != "ezs42" {
+			t.Errorf("expected cover cells within ezs42, got: %v", cells)
+		}
+	}
+	if cells = geohashCover(spatialBbox{-180, -90, 180, 90}); len(cells) != 32 {
+		t.Errorf("expected the whole world's cover to be the top cells, got: %v",
+			cells)
+	}
+}
+
+func TestParseSpatialKey(t *testing.T) {
+	tests := []struct {
+		key string
+		exp spatialBbox
+		err bool
+	}{
+		{`{"type":"Point","coordinates":[1,2]}`, spatialBbox{1, 2, 1, 2}, false},
+		{`{"type":"LineString","coordinates":[[1,2],[-3,4]]}`,
+			spatialBbox{-3, 2, 1, 4}, false},
+		{`{"type":"Polygon","coordinates":[[[0,0],[5,0],[5,6],[0,0]]]}`,
+			spatialBbox{0, 0, 5, 6}, false},
+		{`[1,2,3,4]`, spatialBbox{1, 2, 3, 4}, false},
+		{`[3,2,1,4]`, spatialBbox{}, true},
+		{`[1,2,3]`, spatialBbox{}, true},
+		{`{"type":"Point","coordinates":[200,2]}`, spatialBbox{}, true},
+		{`{"type":"Point"}`, spatialBbox{}, true},
+		{`"here"`, spatialBbox{}, true},
+	}
+	for _, test := range tests {
+		var key interface{}
+		json.Unmarshal([]byte(test.key), &key)
+		bbox, _, err := parseSpatialKey(key)
+		if (err != nil) != test.err || (!test.err && bbox != test.exp) {
+			t.Errorf("expected %v for %v, got: %v, %v",
+				test.exp, test.key, bbox, err)
+		}
+	}
+}
+
+func TestCouchSpatial(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	err := bucket.SetDDoc("_design/d0", []byte(`{"spatial":{"venues":`+
+		`"function(doc) { if (doc.lon !== undefined) {`+
+		` emit({type: 'Point', coordinates: [doc.lon, doc.lat]}, doc.name); }`+
+		` else if (doc.area) { emit(doc.area, doc.name); } }"}}`))
+	if err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	SetItem(bucket, []byte("a"), []byte(`{"name":"a","lon":-0.12,"lat":51.5}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte(`{"name":"b","lon":2.35,"lat":48.85}`), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"name":"c","lon":-0.1,"lat":51.52}`), VBActive)
+	SetItem(bucket, []byte("d"), []byte(`{"name":"d","area":[-1,50,3,52]}`), VBActive)
+	SetItem(bucket, []byte("e"), []byte(`{"name":"e","lon":-74,"lat":40.7}`), VBActive)
+
+	get := func(params string, code int) []*SpatialRow {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET",
+			"http://127.0.0.1/default/_design/d0/_spatial/venues"+params, nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != code {
+			t.Fatalf("expected %v to %v, got: %v, %v",
+				params, code, rr.Code, rr.Body.String())
+		}
+		res := struct{ Rows []*SpatialRow }{}
+		if code == 200 {
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("expected spatial json, got: %v", err)
+			}
+		}
+		return res.Rows
+	}
+	ids := func(rows []*SpatialRow) string {
+		s := ""
+		for _, row := range rows {
+			s += row.Id
+		}
+		return s
+	}
+
+	tests := []struct {
+		params string
+		exp    string
+	}{
+		{"", "abcde"},
+		{"?bbox=-0.2,51.4,0,51.6", "acd"},       // London, and the area.
+		{"?bbox=-0.11,51.51,-0.09,51.53", "cd"}, // Only c of London.
+		{"?bbox=2,48,3,49", "b"},
+		{"?bbox=2,48,3,51", "bd"},
+		{"?bbox=-80,30,-70,45", "e"},
+		{"?bbox=10,10,20,20", ""},
+		{"?bbox=-180,-90,180,90&skip=1&limit=2", "bc"},
+	}
+	for _, test := range tests {
+		if got := ids(get(test.params, 200)); got != test.exp {
+			t.Errorf("expected %v to be %v, got: %v", test.params, test.exp, got)
+		}
+	}
+
+	rows := get("?bbox=2,48,3,51&include_docs=true", 200)
+	if len(rows) != 2 || rows[0].Value != "b" || rows[0].Doc == nil ||
+		!reflect.DeepEqual(rows[0].Bbox, []float64{2.35, 48.85, 2.35, 48.85}) ||
+		rows[0].Geometry == nil || rows[1].Geometry != nil ||
+		!reflect.DeepEqual(rows[1].Bbox, []float64{-1, 50, 3, 52}) {
+		t.Errorf("expected rows with bboxes and docs, got: %#v, %#v",
+			rows[0], rows[1])
+	}
+
+	get("?bbox=1,2,3", 400)
+	get("?bbox=3,2,1,4", 400)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://127.0.0.1/default/_design/d0/_view/venues", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 404 {
+		t.Errorf("expected a spatial view not to be a view, got: %v", rr.Code)
+	}
+}
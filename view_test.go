@@ -59,7 +59,7 @@ func TestParseViewParams(t *testing.T) {
 	f := &testform{
 		m: map[string]string{
 			"key":            `"aaa"`,
-			"keys":           "1,2,3",
+			"keys":           "[1,2,3]",
 			"startkey":       `"AA"`,
 			"startkey_docid": "AADD",
 			"end_key":        `"ZZ"`,
@@ -82,7 +82,7 @@ func TestParseViewParams(t *testing.T) {
 	}
 	exp := &ViewParams{
 		Key:           "aaa",
-		Keys:          "1,2,3",
+		Keys:          []interface{}{1, 2, 3},
 		StartKey:      "AA",
 		StartKeyDocId: "AADD",
 		EndKey:        "ZZ",
@@ -336,3 +336,118 @@ func TestNoDDocViewsRefresh(t *testing.T) {
 		t.Errorf("expected ok viewsRefresh when no ddocs, got err/nil: %v, %v", err, n)
 	}
 }
+
+const testViewsDDoc = `{"views":{"v":{"map":"function(doc, meta) { emit(meta.id, null); }"}}}`
+
+func testViewsIndexed(t *testing.T, v *VBucket, expected uint64, desc string) {
+	vs := v.openedViewsStore()
+	if vs == nil {
+		t.Errorf("%v: expected an opened views store", desc)
+		return
+	}
+	n, _, err := vs.getPartitionStore(v.vbid).getTotals()
+	if err != nil || n != expected {
+		t.Errorf("%v: expected %v back index items, got: %v, err: %v",
+			desc, expected, n, err)
+	}
+}
+
+func TestViewsStorePersistence(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	settings := &BucketSettings{NumPartitions: MAX_VBUCKETS, UUID: "uuid"}
+	b0, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	if err = b0.SetDDoc("_design/d", []byte(testViewsDDoc)); err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	testLoadInts(t, r0, 2, 5)
+	if _, err = v0.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testViewsIndexed(t, v0, 5, "after refresh")
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if _, err = v0.openedViewsStore().Flush(); err != nil {
+		t.Errorf("expected views Flush to work, got: %v", err)
+	}
+
+	// Compaction covers the views store, too.
+	if err = b0.Compact(); err != nil {
+		t.Errorf("expected Compact to work, got: %v", err)
+	}
+	latest, stale, err := viewsFileNames(testBucketDir, "uuid", 2)
+	if err != nil || latest != makeViewsFileName("uuid", 2, 1) || len(stale) != 0 {
+		t.Errorf("expected compacted views file, got: %v, %v, %v",
+			latest, stale, err)
+	}
+	b0.Close()
+
+	b1, err := NewBucket(testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected reopening the bucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	v1, _ := b1.GetVBucket(2)
+	testViewsIndexed(t, v1, 5, "after reload")
+
+	// A design doc change with a new view throws away the index for
+	// a rebuild.
+	if err = b1.SetDDoc("_design/d",
+		[]byte(`{"views":{"v":{"map":"function(doc, meta) { emit(meta.id, 1); }"}}}`)); err != nil {
+		t.Fatalf("expected SetDDoc to work, got: %v", err)
+	}
+	if v1.openedViewsStore() != nil {
+		t.Errorf("expected views store to be reset")
+	}
+	latest, _, _ = viewsFileNames(testBucketDir, "uuid", 2)
+	if latest != "" {
+		t.Errorf("expected views file to be deleted, got: %v", latest)
+	}
+	if _, err = v1.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testViewsIndexed(t, v1, 5, "after rebuild")
+}
+
+func TestViewsStoreMemoryOnly(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			MemoryOnly:    MemoryOnly_LEVEL_PERSIST_METADATA,
+			UUID:          "uuid",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	b0.SetDDoc("_design/d", []byte(testViewsDDoc))
+	testLoadInts(t, r0, 2, 5)
+	if _, err = v0.viewsRefresh(); err != nil {
+		t.Errorf("expected viewsRefresh to work, got: %v", err)
+	}
+	testViewsIndexed(t, v0, 5, "memory-only")
+	v0.openedViewsStore().Flush()
+
+	latest, _, err := viewsFileNames(testBucketDir, "uuid", 2)
+	if err != nil || latest != "" {
+		t.Errorf("expected no views file when memory-only, got: %v, %v",
+			latest, err)
+	}
+}